@@ -0,0 +1,72 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package keysync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/square/keysync/output"
+	"github.com/square/keysync/ownership"
+)
+
+// parseACLEntry parses an ACL entry from the config, in setfacl's syntax: "user:alice:r" or "group:ops:r".
+// The permissions may be left out, but as with modes, only read access can be granted.
+func parseACLEntry(entry string) (group bool, name string, err error) {
+	fields := strings.Split(entry, ":")
+	if len(fields) == 3 {
+		if fields[2] != "r" && fields[2] != "r--" {
+			return false, "", fmt.Errorf("ACL entry '%s' can only grant read access", entry)
+		}
+		fields = fields[:2]
+	}
+	if len(fields) != 2 || fields[1] == "" {
+		return false, "", fmt.Errorf("invalid ACL entry '%s', expected user:NAME:r or group:NAME:r", entry)
+	}
+
+	switch fields[0] {
+	case "user", "u":
+		return false, fields[1], nil
+	case "group", "g":
+		return true, fields[1], nil
+	default:
+		return false, "", fmt.Errorf("invalid ACL entry '%s', expected user:NAME:r or group:NAME:r", entry)
+	}
+}
+
+// resolveACL looks up the users and groups named in ACL entries.  Numeric IDs are used as-is.
+func resolveACL(entries []string, lookup ownership.Lookup) (output.ACL, error) {
+	var acl output.ACL
+	for _, entry := range entries {
+		group, name, err := parseACLEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		var id int
+		if numeric, parseErr := strconv.ParseUint(name, 10 /* base */, 32 /* bits */); parseErr == nil {
+			id = int(numeric)
+		} else if group {
+			id, err = lookup.GID(name)
+		} else {
+			id, err = lookup.UID(name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("resolving ACL entry '%s': %v", entry, err)
+		}
+		acl = append(acl, output.ACLEntry{Group: group, ID: id})
+	}
+	return acl, nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package keysync
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/square/keysync/output"
+	"github.com/square/keysync/ownership"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseACLEntry(t *testing.T) {
+	group, name, err := parseACLEntry("user:alice:r")
+	require.NoError(t, err)
+	assert.False(t, group)
+	assert.Equal(t, "alice", name)
+
+	group, name, err = parseACLEntry("g:ops")
+	require.NoError(t, err)
+	assert.True(t, group)
+	assert.Equal(t, "ops", name)
+
+	for _, bad := range []string{"user:alice:rw", "other::r", "user:", "alice", "mask::r"} {
+		_, _, err = parseACLEntry(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestResolveACL(t *testing.T) {
+	lookup := &ownership.Mock{
+		Users:  map[string]int{"alice": 1000},
+		Groups: map[string]int{"ops": 2000},
+	}
+	acl, err := resolveACL([]string{"group:ops:r", "user:alice:r", "user:1234"}, lookup)
+	require.NoError(t, err)
+	assert.Equal(t, "user:1000:r,user:1234:r,group:2000:r", acl.String())
+
+	parsed, err := output.ParseACL(acl.String())
+	require.NoError(t, err)
+	assert.Equal(t, acl.String(), parsed.String())
+
+	_, err = resolveACL([]string{"user:nobody-here:r"}, lookup)
+	assert.Error(t, err)
+}
+
+func TestWriteACL(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ACLs are only supported on linux")
+	}
+	c, cc, _, out := testFixture(t)
+	defer os.RemoveAll(c.SecretsDir)
+	out.(*OutputDir).DefaultOwnership.Lookup = &ownership.Mock{Users: map[string]int{"alice": 1000}}
+
+	secret := testSecret("secret")
+	secret.Mode = "0400"
+	secret.ACL = []string{"user:alice:r"}
+	state, err := out.Write(&secret)
+	if err != nil && strings.Contains(err.Error(), "operation not supported") {
+		t.Skip("Filesystem doesn't support ACLs")
+	}
+	require.NoError(t, err)
+
+	assert.Equal(t, "user:1000:r", state.FileInfo.ACL)
+	// The mask is reflected in the group bits of the mode
+	assert.EqualValues(t, 0440, state.FileInfo.Mode.Perm())
+	assert.True(t, out.Validate(&secret, *state))
+
+	// Changing the configured ACL invalidates the secret
+	changed := secret
+	changed.ACL = []string{"user:alice:r", "group:1234:r"}
+	assert.False(t, out.Validate(&changed, *state))
+
+	// Removing the ACL from the file is detected as tampering
+	path := filepath.Join(c.SecretsDir, cc.DirName, "secret")
+	_, err = output.WriteFileAtomically(path, false, output.FileInfo{Mode: 0400}, 0, secret.Content)
+	require.NoError(t, err)
+	assert.False(t, out.Validate(&secret, *state))
+}
@@ -15,6 +15,7 @@
 package keysync
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -51,6 +52,9 @@ type StatusResponse struct {
 	Ok      bool     `json:"ok"`
 	Message string   `json:"message,omitempty"`
 	Updated *Updated `json:"updated,omitempty"`
+	// Set by the status endpoint: the server that most recently responded, and the health of all servers.
+	ActiveServer string         `json:"active_server,omitempty"`
+	Servers      []ServerStatus `json:"servers,omitempty"`
 }
 
 func writeSuccess(w http.ResponseWriter, updated *Updated) {
@@ -69,9 +73,31 @@ func writeError(w http.ResponseWriter, status int, err error) {
 	_, _ = w.Write([]byte("\n"))
 }
 
+// requestContext returns the request's context, bounded by the optional "timeout" query parameter.
+func requestContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	timeout := r.URL.Query().Get("timeout")
+	if timeout == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid timeout: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), duration)
+	return ctx, cancel, nil
+}
+
 func (a *APIServer) syncAll(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel, err := requestContext(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer cancel()
+
 	a.logger.Info("Syncing all from API")
-	updated, errs := a.syncer.RunOnce()
+	updated, errs := a.syncer.RunOnceContext(ctx)
 	if len(errs) != 0 {
 		err := fmt.Errorf("errors: %v", errs)
 		a.logger.WithError(err).Warn("error syncing")
@@ -96,6 +122,13 @@ func (a *APIServer) syncOne(w http.ResponseWriter, r *http.Request) {
 	sanitizedClient = strings.ReplaceAll(sanitizedClient, "\r", "")
 
 	logger := a.logger.WithField("client", sanitizedClient)
+	ctx, cancel, err := requestContext(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer cancel()
+
 	logger.Info("Syncing one")
 	a.syncer.syncMutex.Lock()
 	defer a.syncer.syncMutex.Unlock()
@@ -112,7 +145,7 @@ func (a *APIServer) syncOne(w http.ResponseWriter, r *http.Request) {
 
 	var updated Updated
 	if syncerEntry, ok := a.syncer.clients[client]; ok {
-		updated, err = syncerEntry.Sync()
+		updated, err = syncerEntry.SyncContext(ctx)
 		if err != nil {
 			logger.WithError(err).Warnf("Error syncing %s", sanitizedClient)
 			writeError(w, http.StatusInternalServerError, fmt.Errorf("error syncing %s: %s", sanitizedClient, err))
@@ -147,6 +180,56 @@ func (a *APIServer) runBackup(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// export responds with a client's secrets as a bundle, from the server unless the "source" query parameter is
+// "disk".  The bundle is always encrypted to the base64 "recipient" public key: the API isn't authenticated, and
+// mustn't hand a client's secrets to local users that can't read its files.
+func (a *APIServer) export(w http.ResponseWriter, r *http.Request) {
+	client := mux.Vars(r)["client"]
+	sanitizedClient := strings.ReplaceAll(client, "\n", "")
+	sanitizedClient = strings.ReplaceAll(sanitizedClient, "\r", "")
+	logger := a.logger.WithField("client", sanitizedClient)
+
+	source := r.URL.Query().Get("source")
+	if source == "" {
+		source = ExportFromServer
+	}
+	if source != ExportFromServer && source != ExportFromDisk {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid source: %s", source))
+		return
+	}
+	encoded := r.URL.Query().Get("recipient")
+	if encoded == "" {
+		writeError(w, http.StatusBadRequest, errors.New("a recipient public key is required"))
+		return
+	}
+	// An unescaped '+' in base64 arrives as a space.
+	recipient, err := backup.ParsePublicKey(strings.ReplaceAll(encoded, " ", "+"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid recipient: %v", err))
+		return
+	}
+	ctx, cancel, err := requestContext(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	defer cancel()
+
+	logger.WithField("source", source).Info("Exporting")
+	bundle, err := a.syncer.Export(ctx, client, source, recipient)
+	if unknown := (UnknownClient{}); errors.As(err, &unknown) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown client: %s", sanitizedClient))
+		return
+	} else if err != nil {
+		logger.WithError(err).Warn("Error exporting")
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("error exporting %s: %s", sanitizedClient, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(bundle)
+}
+
 func (a *APIServer) status(w http.ResponseWriter, r *http.Request) {
 	lastSuccess, ok := a.syncer.timeSinceLastSuccess()
 	if !ok {
@@ -161,7 +244,14 @@ func (a *APIServer) status(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	writeSuccess(w, nil)
+	resp := &StatusResponse{Ok: true}
+	if a.syncer.servers != nil {
+		resp.ActiveServer = a.syncer.servers.Active()
+		resp.Servers = a.syncer.servers.Status()
+	}
+	out, _ := json.MarshalIndent(resp, "", "  ")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(out)
 }
 
 // handle wraps the HandlerFunc with logging, and registers it in the given router.
@@ -199,6 +289,9 @@ func NewAPIServer(syncer *Syncer, backup backup.Backup, port uint16, baseLogger
 	// Create backup
 	handle(router, "/backup", httpPost, apiServer.runBackup, logger)
 
+	// Export a client's secrets as a bundle
+	handle(router, "/export/{client}", httpPost, apiServer.export, logger)
+
 	// Status and metrics endpoints
 	router.HandleFunc("/status", apiServer.status).Methods(httpGet...)
 	handle(router, "/metrics", httpGet, metrics.ServeHTTP, logger)
@@ -0,0 +1,187 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/keysync/output"
+	"github.com/square/keysync/ownership"
+)
+
+// Actions in a BundleChange.
+const (
+	ChangeAdd    = "add"
+	ChangeModify = "change"
+	ChangeRemove = "remove"
+)
+
+// BundleChange is a difference between a bundle and what's in a client's directory.
+type BundleChange struct {
+	Filename string
+	Action   string
+	Details  []string // For a ChangeModify, what differs, such as "mode 0400 -> 0440".  Never the contents.
+}
+
+func (c BundleChange) String() string {
+	switch c.Action {
+	case ChangeAdd:
+		return "+ " + c.Filename
+	case ChangeRemove:
+		return "- " + c.Filename
+	}
+	return fmt.Sprintf("~ %s %v", c.Filename, c.Details)
+}
+
+// DiffBundle returns how ApplyBundle would change a client's directory, without changing anything.  Only the
+// client's own directory is compared, not its mirrors.
+func DiffBundle(config *Config, clientConfig ClientConfig, bundle string, logger *logrus.Entry) ([]BundleChange, error) {
+	client, err := NewBackupBundleClient(bundle, clientConfig.SecretMapping, logger)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := client.SecretList()
+	if err != nil {
+		return nil, err
+	}
+
+	// Not from OutputDirCollection, which would create the directory.
+	out := &OutputDir{
+		WriteDirectory: filepath.Join(config.SecretsDir, clientConfig.DirName),
+		ChownFiles:     config.ChownFiles,
+		DefaultOwnership: ownership.NewOwnership(
+			clientConfig.User,
+			clientConfig.Group,
+			config.DefaultUser,
+			config.DefaultGroup,
+			ownership.Os{},
+			logger,
+		),
+		Logger: logger,
+	}
+	return out.diff(secrets)
+}
+
+// ApplyBundle writes a bundle's secrets to a client's directory and mirrors, as a sync from a server would.  Files
+// that aren't in the bundle are removed.  Other clients' directories are left alone.
+func ApplyBundle(config *Config, clientConfig ClientConfig, bundle string, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) (Updated, error) {
+	syncer, err := NewSyncerFromFile(config, clientConfig, bundle, logger, metricsHandle)
+	if err != nil {
+		return Updated{}, err
+	}
+	entry := syncer.clients[clientConfig.DirName]
+	return entry.Sync()
+}
+
+// diff compares secrets, keyed by filename, with what's in the directory.
+func (out *OutputDir) diff(secrets map[string]Secret) ([]BundleChange, error) {
+	var filenames []string
+	known := map[string]struct{}{}
+	for filename, secret := range secrets {
+		filenames = append(filenames, filename)
+		known[filename] = struct{}{}
+		for _, alias := range secret.Aliases {
+			known[alias] = struct{}{}
+		}
+	}
+	sort.Strings(filenames)
+
+	var changes []BundleChange
+	for _, filename := range filenames {
+		secret := secrets[filename]
+		details, exists, err := out.differences(filename, &secret)
+		if err != nil {
+			return nil, fmt.Errorf("comparing %s: %v", filename, err)
+		}
+		switch {
+		case !exists:
+			changes = append(changes, BundleChange{Filename: filename, Action: ChangeAdd})
+		case len(details) > 0:
+			changes = append(changes, BundleChange{Filename: filename, Action: ChangeModify, Details: details})
+		}
+	}
+
+	// As in Cleanup, anything else in the directory would be removed.
+	fileInfos, err := ioutil.ReadDir(out.WriteDirectory)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fileInfo := range fileInfos {
+		if _, present := known[fileInfo.Name()]; !present {
+			changes = append(changes, BundleChange{Filename: fileInfo.Name(), Action: ChangeRemove})
+		}
+	}
+	return changes, nil
+}
+
+// differences lists how a secret's file differs from what Write would make of it.  exists is false if there's no file.
+func (out *OutputDir) differences(filename string, secret *Secret) (details []string, exists bool, err error) {
+	f, err := os.Open(filepath.Join(out.WriteDirectory, filename))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	fileInfo, err := output.GetFileInfo(f)
+	if err != nil {
+		return nil, true, err
+	}
+	mode, err := secret.ModeValue()
+	if err != nil {
+		return nil, true, err
+	}
+	if fileInfo.Mode.Perm() != mode.Perm() {
+		details = append(details, fmt.Sprintf("mode %04o -> %04o", fileInfo.Mode.Perm(), mode.Perm()))
+	}
+	if out.ChownFiles {
+		owner := secret.OwnershipValue(out.DefaultOwnership)
+		if fileInfo.UID != owner.UID {
+			details = append(details, fmt.Sprintf("uid %d -> %d", fileInfo.UID, owner.UID))
+		}
+		if fileInfo.GID != owner.GID {
+			details = append(details, fmt.Sprintf("gid %d -> %d", fileInfo.GID, owner.GID))
+		}
+	}
+	acl, err := resolveACL(secret.ACL, out.DefaultOwnership.Lookup)
+	if err != nil {
+		return nil, true, err
+	}
+	if fileInfo.ACL != acl.String() {
+		details = append(details, fmt.Sprintf("acl '%s' -> '%s'", fileInfo.ACL, acl.String()))
+	}
+
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, true, err
+	}
+	if !bytes.Equal(contents, secret.Content) {
+		details = append(details, "contents")
+	}
+	for _, alias := range secret.Aliases {
+		if target, err := os.Readlink(filepath.Join(out.WriteDirectory, alias)); err != nil || target != filename {
+			details = append(details, "alias "+alias)
+		}
+	}
+	return details, true, nil
+}
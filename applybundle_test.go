@@ -0,0 +1,103 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffAndApplyBundle(t *testing.T) {
+	secretsDir, err := ioutil.TempDir("", "keysync-bundle")
+	require.Nil(t, err)
+	defer os.RemoveAll(secretsDir)
+
+	config := &Config{SecretsDir: secretsDir}
+	clientConfig := ClientConfig{DirName: "client"}
+	bundle := "fixtures/exportedSecretsBackupBundle.json"
+
+	// Nothing there yet, and a dry run doesn't create the directory.
+	changes, err := DiffBundle(config, clientConfig, bundle, testLogger())
+	require.Nil(t, err)
+	assert.Equal(t, []BundleChange{
+		{Filename: "General_Password", Action: ChangeAdd},
+		{Filename: "Hacking_Password", Action: ChangeAdd},
+	}, changes)
+	_, err = os.Stat(filepath.Join(secretsDir, "client"))
+	assert.True(t, os.IsNotExist(err))
+
+	// An out of date secret, and one that's not in the bundle.
+	clientDir := filepath.Join(secretsDir, "client")
+	require.Nil(t, os.MkdirAll(clientDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(clientDir, "General_Password"), []byte("old"), 0400))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(clientDir, "stale"), []byte("stale"), 0400))
+	changes, err = DiffBundle(config, clientConfig, bundle, testLogger())
+	require.Nil(t, err)
+	assert.Equal(t, []BundleChange{
+		{Filename: "General_Password", Action: ChangeModify, Details: []string{"mode 0400 -> 0440", "contents"}},
+		{Filename: "Hacking_Password", Action: ChangeAdd},
+		{Filename: "stale", Action: ChangeRemove},
+	}, changes)
+	assert.Equal(t, "~ General_Password [mode 0400 -> 0440 contents]", changes[0].String())
+	assert.Equal(t, "- stale", changes[2].String())
+
+	updated, err := ApplyBundle(config, clientConfig, bundle, testLogger(), metricsForTest())
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Added: 2, Deleted: 1}, updated)
+	contents, err := ioutil.ReadFile(filepath.Join(clientDir, "Hacking_Password"))
+	require.Nil(t, err)
+	assert.Equal(t, "1337", string(contents))
+
+	changes, err = DiffBundle(config, clientConfig, bundle, testLogger())
+	require.Nil(t, err)
+	assert.Empty(t, changes)
+}
+
+func TestApplyBundleUsesSecretMapping(t *testing.T) {
+	secretsDir, err := ioutil.TempDir("", "keysync-bundle")
+	require.Nil(t, err)
+	defer os.RemoveAll(secretsDir)
+
+	config := &Config{SecretsDir: secretsDir}
+	clientConfig := ClientConfig{DirName: "client", SecretMapping: SecretMapping{
+		Rename:  map[string]string{"Hacking_Password": "hacking"},
+		Aliases: map[string][]string{"Hacking_Password": {"hacking.alias"}},
+		Exclude: []string{"General_*"},
+	}}
+	bundle := "fixtures/exportedSecretsBackupBundle.json"
+
+	changes, err := DiffBundle(config, clientConfig, bundle, testLogger())
+	require.Nil(t, err)
+	assert.Equal(t, []BundleChange{{Filename: "hacking", Action: ChangeAdd}}, changes)
+
+	updated, err := ApplyBundle(config, clientConfig, bundle, testLogger(), metricsForTest())
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Added: 1}, updated)
+	clientDir := filepath.Join(secretsDir, "client")
+	contents, err := ioutil.ReadFile(filepath.Join(clientDir, "hacking.alias"))
+	require.Nil(t, err)
+	assert.Equal(t, "1337", string(contents))
+	_, err = os.Stat(filepath.Join(clientDir, "General_Password"))
+	assert.True(t, os.IsNotExist(err))
+
+	changes, err = DiffBundle(config, clientConfig, bundle, testLogger())
+	require.Nil(t, err)
+	assert.Empty(t, changes)
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -125,3 +126,50 @@ func decrypt(data, key []byte) ([]byte, error) {
 	// Nonce is prefixed to data
 	return aesgcm.Open(nil, data[:nonceSize], data[nonceSize:], nil)
 }
+
+// sealed is the JSON form of data encrypted by Seal, holding the wrapped key alongside the ciphertext.
+type sealed struct {
+	WrappedKey []byte
+	CipherText []byte
+}
+
+// Seal encrypts data with a new key wrapped to pubkey, as Backup does, but returns the wrapped key and
+// ciphertext together so they can be kept in a single file.
+func Seal(data []byte, pubkey *[32]byte) ([]byte, error) {
+	wrapped, ciphertext, err := encrypt(data, pubkey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(sealed{WrappedKey: wrapped, CipherText: ciphertext})
+}
+
+// Open decrypts the output of Seal with the private key matching the public key it was sealed to.
+func Open(data, privateKey []byte) ([]byte, error) {
+	var s sealed
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.Wrap(err, "error parsing sealed data")
+	}
+	key, err := Unwrap(s.WrappedKey, privateKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error unwrapping key")
+	}
+	// The nonce is prefixed to the ciphertext, followed by at least the GCM tag.
+	if len(s.CipherText) < 12+16 {
+		return nil, errors.New("sealed ciphertext is too short")
+	}
+	return decrypt(s.CipherText, key)
+}
+
+// ParsePublicKey decodes a base64 public key, as keyunwrap generate writes.
+func ParsePublicKey(encoded string) (*[32]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != 32 {
+		return nil, fmt.Errorf("public key wasn't 32 bytes: %d", len(decoded))
+	}
+	var pubkey [32]byte
+	copy(pubkey[:], decoded)
+	return &pubkey, nil
+}
@@ -3,6 +3,7 @@ package backup
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/base64"
 	"io"
 	"testing"
 
@@ -49,3 +50,39 @@ func TestEncryptDecrypt(t *testing.T) {
 	// Verify the testData wasn't modified during encryption
 	assert.Equal(t, copyData, testData)
 }
+
+func TestSealOpen(t *testing.T) {
+	pubkey, privkey, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	sealed, err := Seal([]byte("secret data"), pubkey)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(sealed, []byte("secret data")))
+
+	opened, err := Open(sealed, privkey[:])
+	require.NoError(t, err)
+	assert.Equal(t, []byte("secret data"), opened)
+
+	// The wrong key can't open it.
+	_, otherPrivkey, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, err = Open(sealed, otherPrivkey[:])
+	assert.Error(t, err)
+
+	_, err = Open([]byte(`{"WrappedKey": null, "CipherText": null}`), privkey[:])
+	assert.Error(t, err)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	pubkey, _, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	parsed, err := ParsePublicKey(base64.StdEncoding.EncodeToString(pubkey[:]))
+	require.NoError(t, err)
+	assert.Equal(t, pubkey, parsed)
+
+	_, err = ParsePublicKey("bm90IGEga2V5")
+	assert.EqualError(t, err, "public key wasn't 32 bytes: 9")
+	_, err = ParsePublicKey("not base64!")
+	assert.Error(t, err)
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// fetchResult is what happened to each secret requested by fetchSecrets, by filename.
+type fetchResult struct {
+	write     func(filename string, secret *Secret) // Called with each secret as it's retrieved
+	written   map[string]bool                       // Passed to write already
+	deleted   []string                              // Deleted since they were listed
+	forbidden []string                              // Listed, but this client may not read them
+}
+
+// fetchSecrets retrieves the contents of the given secrets, in batches of at most MaxBatchSize.  A batch the server
+// rejects is split in half and each half retried, so a few bad secrets cost a few extra requests rather than one
+// request per secret.  Once a batch is down to a single secret, it's fetched on its own so the server can say
+// whether it was deleted or is forbidden.  A batch that fails for another reason, such as a 5xx, is fetched one
+// secret at a time, as splitting it would likely fail again.  Each secret is passed to write once, as soon as it's
+// decoded, so a batch's contents needn't all be held in memory.  An error is only returned if ctx is done.
+func (entry *syncerEntry) fetchSecrets(ctx context.Context, filenames []string, secrets map[string]Secret, write func(filename string, secret *Secret)) (fetchResult, error) {
+	result := fetchResult{written: map[string]bool{}}
+	result.write = func(filename string, secret *Secret) {
+		result.written[filename] = true
+		write(filename, secret)
+	}
+	// Sorted, so secrets are batched the same way each sync.
+	filenames = append([]string(nil), filenames...)
+	sort.Strings(filenames)
+	size := entry.MaxBatchSize
+	if size <= 0 || size > len(filenames) {
+		size = len(filenames)
+	}
+	// With nothing to retrieve there's still one, empty, batch request, as there always has been.
+	start := 0
+	for {
+		end := start + size
+		if end > len(filenames) {
+			end = len(filenames)
+		}
+		if err := entry.fetchBatch(ctx, filenames[start:end], secrets, &result); err != nil {
+			return result, err
+		}
+		if end == len(filenames) {
+			return result, nil
+		}
+		start = end
+	}
+}
+
+func (entry *syncerEntry) fetchBatch(ctx context.Context, filenames []string, secrets map[string]Secret, result *fetchResult) error {
+	if len(filenames) == 1 {
+		return entry.fetchSecret(ctx, filenames[0], secrets[filenames[0]].Name, result)
+	}
+
+	// The server knows secrets by name, which may differ from the filename we've keyed them by.
+	var names []string
+	for _, filename := range filenames {
+		names = append(names, secrets[filename].Name)
+	}
+	var err error
+	if streamer, ok := entry.Client.(SecretStreamer); ok {
+		err = streamer.StreamSecretListWithContents(ctx, names, func(filename string, secret *Secret) error {
+			result.write(filename, secret)
+			return nil
+		})
+	} else {
+		var retrieved map[string]Secret
+		retrieved, err = entry.Client.SecretListWithContentsContext(ctx, names)
+		for filename, secret := range retrieved {
+			secret := secret
+			result.write(filename, &secret)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+	// Two secrets sharing a filename would clash however they're fetched.
+	var duplicate DuplicateFilename
+	if ctx.Err() != nil || errors.As(err, &duplicate) {
+		return err
+	}
+
+	// Secrets streamed before the batch failed needn't be fetched again.
+	var remaining []string
+	for _, filename := range filenames {
+		if !result.written[filename] {
+			remaining = append(remaining, filename)
+		}
+	}
+	if len(remaining) == 0 {
+		return nil
+	}
+
+	// A 4xx means the server didn't like something in the batch, such as a secret deleted between listing and
+	// fetching, or one we are not allowed to access.  A response over the size limit may fit once split.
+	// Anything else would likely fail again for each half, so each secret is fetched on its own.
+	var batchErr BatchError
+	var tooLarge ResponseTooLarge
+	if !errors.As(err, &tooLarge) && !(errors.As(err, &batchErr) && batchErr.StatusCode >= 400 && batchErr.StatusCode < 500) {
+		entry.Logger().WithError(err).WithField("secrets", len(remaining)).Warn("Failed to retrieve batch, retrieving secrets individually")
+		for _, filename := range remaining {
+			if err := entry.fetchSecret(ctx, filename, secrets[filename].Name, result); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	entry.Logger().WithError(err).WithField("secrets", len(remaining)).Info("Batch rejected, splitting it")
+	half := len(remaining) / 2
+	if err := entry.fetchBatch(ctx, remaining[:half], secrets, result); err != nil {
+		return err
+	}
+	return entry.fetchBatch(ctx, remaining[half:], secrets, result)
+}
+
+func (entry *syncerEntry) fetchSecret(ctx context.Context, filename, name string, result *fetchResult) error {
+	secret, err := entry.Client.SecretContext(ctx, name)
+	switch {
+	case err == nil:
+		result.write(filename, secret)
+	case ctx.Err() != nil:
+		return err
+	default:
+		switch err.(type) {
+		case SecretDeleted:
+			// This is essentially a race condition: A secret was deleted between listing and fetching
+			result.deleted = append(result.deleted, filename)
+		case SecretForbidden:
+			result.forbidden = append(result.forbidden, filename)
+		default:
+			entry.Logger().WithError(err).WithField("secret", name).Error("Failed to retrieve secret")
+		}
+	}
+	return nil
+}
+
+// readEach reads secrets one at a time, for servers with no batch API.  Like Keywhiz's batch API, it fails if any
+// secret can't be read, with a BatchError if one is missing or forbidden, so fetchSecrets can split the batch.
+func readEach(ctx context.Context, names []string, read func(ctx context.Context, name string) (*Secret, error)) ([]Secret, error) {
+	var list []Secret
+	for _, name := range names {
+		secret, err := read(ctx, name)
+		switch err.(type) {
+		case nil:
+			list = append(list, *secret)
+			continue
+		case SecretDeleted:
+			err = BatchError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("secret %s not found", name)}
+		case SecretForbidden:
+			err = BatchError{StatusCode: http.StatusForbidden, Message: fmt.Sprintf("secret %s is forbidden", name)}
+		}
+		return nil, err
+	}
+	return list, nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// batchServer serves secrets named secret00 onwards, some of which have been deleted or are forbidden.  It records
+// the size of each batch requested, and each secret fetched on its own.
+type batchServer struct {
+	*httptest.Server
+	deleted, forbidden map[string]bool
+	batchStatus        int               // If set, every batch request fails with this status
+	batchFilenames     map[string]string // Filenames given to secrets in batch responses only
+
+	mu      sync.Mutex
+	batches []int
+	singles []string
+}
+
+func newBatchServer(count int, deleted, forbidden []string) *batchServer {
+	s := &batchServer{deleted: map[string]bool{}, forbidden: map[string]bool{}}
+	for _, name := range deleted {
+		s.deleted[name] = true
+	}
+	for _, name := range forbidden {
+		s.forbidden[name] = true
+	}
+	secret := func(name string, withContent bool) map[string]string {
+		value := map[string]string{"name": name}
+		if withContent {
+			value["secret"] = "YXNkZGFz"
+		}
+		return value
+	}
+
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		switch {
+		case r.URL.Path == "/secrets":
+			var list []map[string]string
+			for i := 0; i < count; i++ {
+				list = append(list, secret(fmt.Sprintf("secret%02d", i), false))
+			}
+			json.NewEncoder(w).Encode(list)
+		case r.URL.Path == "/batchsecret":
+			var req map[string][]string
+			json.NewDecoder(r.Body).Decode(&req)
+			s.batches = append(s.batches, len(req["secrets"]))
+			if s.batchStatus != 0 {
+				w.WriteHeader(s.batchStatus)
+				return
+			}
+			var list []map[string]string
+			for _, name := range req["secrets"] {
+				if s.deleted[name] {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if s.forbidden[name] {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				value := secret(name, true)
+				if filename, ok := s.batchFilenames[name]; ok {
+					value["filename"] = filename
+				}
+				list = append(list, value)
+			}
+			json.NewEncoder(w).Encode(list)
+		case strings.HasPrefix(r.URL.Path, "/secret/"):
+			name := strings.TrimPrefix(r.URL.Path, "/secret/")
+			s.singles = append(s.singles, name)
+			switch {
+			case s.deleted[name]:
+				w.WriteHeader(http.StatusNotFound)
+			case s.forbidden[name]:
+				w.WriteHeader(http.StatusForbidden)
+			default:
+				json.NewEncoder(w).Encode(secret(name, true))
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	s.TLS = testCerts(testCaFile)
+	s.StartTLS()
+	return s
+}
+
+func newBatchEntry(t *testing.T, server *batchServer, maxBatchSize int) (*syncerEntry, *InMemoryOutput) {
+	serverURL, _ := url.Parse(server.URL)
+	cfg := defaultClientConfig()
+	cfg.MaxBatchSize = maxBatchSize
+	client, err := NewClient(cfg, testCaFile, serverURL, logrus.NewEntry(logrus.New()), metricsForTest())
+	require.Nil(t, err)
+	output := &InMemoryOutput{Secrets: map[string]Secret{}, logger: logrus.NewEntry(logrus.New())}
+	return &syncerEntry{client, *cfg, output, map[string]secretState{}}, output
+}
+
+func TestSyncBatchesSecrets(t *testing.T) {
+	server := newBatchServer(10, nil, nil)
+	defer server.Close()
+
+	entry, output := newBatchEntry(t, server, 4)
+	updated, err := entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Added: 10}, updated)
+	assert.Len(t, output.Secrets, 10)
+	assert.Equal(t, []int{4, 4, 2}, server.batches)
+	assert.Empty(t, server.singles)
+}
+
+func TestSyncBisectsRejectedBatches(t *testing.T) {
+	server := newBatchServer(16, []string{"secret05"}, []string{"secret12"})
+	defer server.Close()
+
+	entry, output := newBatchEntry(t, server, 0)
+	updated, err := entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Added: 14, Deleted: 1}, updated)
+	assert.Len(t, output.Secrets, 14)
+	assert.NotContains(t, output.Secrets, "secret05")
+	assert.NotContains(t, output.Secrets, "secret12")
+
+	// 16 -> 8 + 8 -> 4 + 4 + 4 + 4 -> 2 + 2 (twice) -> 1 + 1 (twice), with only the bad secrets fetched alone,
+	// rather than sixteen single requests.
+	assert.Equal(t, []int{16, 8, 4, 4, 2, 2, 8, 4, 4, 2, 2}, server.batches)
+	assert.ElementsMatch(t, []string{"secret04", "secret05", "secret12", "secret13"}, server.singles)
+
+	var written []string
+	result, err := entry.fetchSecrets(context.Background(), []string{"secret05", "secret12"}, map[string]Secret{
+		"secret05": {Name: "secret05"},
+		"secret12": {Name: "secret12"},
+	}, func(filename string, _ *Secret) {
+		written = append(written, filename)
+	})
+	require.Nil(t, err)
+	assert.Equal(t, []string{"secret05"}, result.deleted)
+	assert.Equal(t, []string{"secret12"}, result.forbidden)
+	assert.Empty(t, written)
+}
+
+func TestSyncSplitsOversizedBatches(t *testing.T) {
+	server := newBatchServer(8, nil, nil)
+	defer server.Close()
+
+	// Big enough for the listing and four secrets with contents, but not all eight.
+	entry, output := newBatchEntry(t, server, 0)
+	client := entry.Client.(*KeywhizHTTPClient)
+	client.params.maxResponseSize = 170
+
+	updated, err := entry.Sync()
+	require.Nil(t, err)
+	assert.Len(t, output.Secrets, 8)
+	// Secrets streamed before the limit was hit aren't fetched, or counted, again.
+	assert.Equal(t, Updated{Added: 8}, updated)
+	assert.Equal(t, []int{8, 2, 2}, server.batches)
+	assert.Empty(t, server.singles)
+}
+
+func TestSyncFetchesIndividuallyAfterServerError(t *testing.T) {
+	server := newBatchServer(4, []string{"secret02"}, nil)
+	server.batchStatus = http.StatusInternalServerError
+	defer server.Close()
+
+	entry, output := newBatchEntry(t, server, 0)
+	updated, err := entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Added: 3, Deleted: 1}, updated)
+	assert.Len(t, output.Secrets, 3)
+	assert.Equal(t, []string{"secret00", "secret01", "secret02", "secret03"}, server.singles)
+}
+
+func TestSyncStopsOnDuplicateFilename(t *testing.T) {
+	server := newBatchServer(4, nil, nil)
+	// The secrets were renamed between listing and fetching, so they only clash in the batch.
+	server.batchFilenames = map[string]string{"secret01": "clash", "secret02": "clash"}
+	defer server.Close()
+
+	entry, _ := newBatchEntry(t, server, 0)
+	_, err := entry.Sync()
+	require.NotNil(t, err)
+	var duplicate DuplicateFilename
+	assert.True(t, errors.As(err, &duplicate), "%v", err)
+	assert.Equal(t, DuplicateFilename{Filename: "clash", First: "secret01", Second: "secret02"}, duplicate)
+	// It isn't retried, whole or secret by secret.
+	assert.Equal(t, []int{4}, server.batches)
+	assert.Empty(t, server.singles)
+}
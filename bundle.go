@@ -15,6 +15,7 @@
 package keysync
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 
@@ -28,8 +29,9 @@ type BackupBundleClient struct {
 	logger  *logrus.Entry
 }
 
-// NewBackupBundleClient creates a new BackupBundleClient instance given a backup JSON file.
-func NewBackupBundleClient(path string, logger *logrus.Entry) (Client, error) {
+// NewBackupBundleClient creates a new BackupBundleClient instance given a backup JSON file.  The client's mapping
+// is applied to the bundle's secrets, as it would be to secrets from the server.
+func NewBackupBundleClient(path string, mapping SecretMapping, logger *logrus.Entry) (Client, error) {
 	raw, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -40,46 +42,68 @@ func NewBackupBundleClient(path string, logger *logrus.Entry) (Client, error) {
 		return nil, errors.Wrap(err, fmt.Sprintf("unable to parse secret list from path: %s", path))
 	}
 
-	client := BackupBundleClient{
-		secrets: map[string]Secret{},
-		logger:  logger.WithField("logger", "file_client"),
-	}
-
-	for _, secret := range parsed {
-		name, err := secret.Filename()
-		if err != nil {
-			return nil, errors.Wrap(err, "unable to get secret's filename")
-		}
-		client.secrets[name] = secret
+	secrets, err := secretsByFilename(parsed, &mapping)
+	if err != nil {
+		return nil, err
 	}
 
-	return &client, nil
+	return &BackupBundleClient{
+		secrets: secrets,
+		logger:  logger.WithField("logger", "file_client"),
+	}, nil
 }
 
 // Secret returns secret with the given name from the bundle.
 func (c BackupBundleClient) Secret(name string) (secret *Secret, err error) {
-	s, ok := c.secrets[name]
-	if !ok {
-		return nil, fmt.Errorf("unable to find %s in backup bundle", name)
+	return c.SecretContext(context.Background(), name)
+}
+
+// SecretContext returns secret with the given name from the bundle.  The bundle is already in memory,
+// so the context is only checked before starting.
+func (c BackupBundleClient) SecretContext(ctx context.Context, name string) (secret *Secret, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	return &s, nil
+	for _, s := range c.secrets {
+		if s.Name == name {
+			return &s, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to find %s in backup bundle", name)
 }
 
 // SecretList returns all secrets in a bundle (unlike the real Keywhiz interface,
 // it will return secrets' contents as well).
 func (c BackupBundleClient) SecretList() (map[string]Secret, error) {
+	return c.SecretListContext(context.Background())
+}
+
+// SecretListContext returns all secrets in a bundle.
+func (c BackupBundleClient) SecretListContext(ctx context.Context) (map[string]Secret, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return c.secrets, nil
 }
 
-// SecretListWithContents returns the requested secrets from a bundle.
+// SecretListWithContents returns the requested secrets from a bundle, keyed by filename.
 func (c BackupBundleClient) SecretListWithContents(secrets []string) (map[string]Secret, error) {
+	return c.SecretListWithContentsContext(context.Background(), secrets)
+}
+
+// SecretListWithContentsContext returns the requested secrets from a bundle, keyed by filename.
+func (c BackupBundleClient) SecretListWithContentsContext(ctx context.Context, secrets []string) (map[string]Secret, error) {
 	result := map[string]Secret{}
 	for _, name := range secrets {
-		s, ok := c.secrets[name]
-		if !ok {
-			return nil, fmt.Errorf("unable to find %s in backup bundle", name)
+		s, err := c.SecretContext(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		filename, err := s.Filename()
+		if err != nil {
+			return nil, err
 		}
-		result[name] = s
+		result[filename] = *s
 	}
 	return result, nil
 }
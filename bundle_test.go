@@ -25,7 +25,7 @@ import (
 func TestBackupBundleReader(t *testing.T) {
 	newAssert := assert.New(t)
 
-	client, err := NewBackupBundleClient("fixtures/exportedSecretsBackupBundle.json", logrus.NewEntry(logrus.New()))
+	client, err := NewBackupBundleClient("fixtures/exportedSecretsBackupBundle.json", SecretMapping{}, logrus.NewEntry(logrus.New()))
 	require.Nil(t, err)
 
 	secret, err := client.Secret("Hacking_Password")
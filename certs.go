@@ -0,0 +1,153 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileStamp identifies a version of a file, to tell when it needs to be re-read.
+type fileStamp struct {
+	modTime int64 // Nanoseconds, so stamps can be compared with ==
+	size    int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{info.ModTime().UnixNano(), info.Size()}, nil
+}
+
+// keyPairReloader holds a client certificate and key, re-reading them when either file changes.  If a new pair can't
+// be loaded, such as when only one of the files has been replaced so far, it keeps the last good pair.
+type keyPairReloader struct {
+	certFile, keyFile string
+	passphrase        KeyPassphrase
+	logger            *logrus.Entry
+
+	mu        sync.Mutex
+	certStamp fileStamp
+	keyStamp  fileStamp
+	keyPair   *tls.Certificate
+	leaf      *x509.Certificate
+}
+
+// newKeyPairReloader loads the pair, which must succeed the first time.
+func newKeyPairReloader(certFile, keyFile string, passphrase KeyPassphrase, logger *logrus.Entry) (*keyPairReloader, error) {
+	r := &keyPairReloader{certFile: certFile, keyFile: keyFile, passphrase: passphrase, logger: logger}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload re-reads the pair if the files have changed.  On error, the previous pair is kept.
+func (r *keyPairReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certStamp, err := statFile(r.certFile)
+	if err != nil {
+		return fmt.Errorf("Error loading Keypair '%s'/'%s': %v", r.certFile, r.keyFile, err)
+	}
+	keyStamp, err := statFile(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading Keypair '%s'/'%s': %v", r.certFile, r.keyFile, err)
+	}
+	if r.keyPair != nil && certStamp == r.certStamp && keyStamp == r.keyStamp {
+		return nil
+	}
+
+	keyPair, err := LoadX509KeyPair(r.certFile, r.keyFile, r.passphrase)
+	if err != nil {
+		return fmt.Errorf("Error loading Keypair '%s'/'%s': %v", r.certFile, r.keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("Error parsing certificate '%s': %v", r.certFile, err)
+	}
+
+	if r.keyPair != nil {
+		r.logger.WithField("not_after", leaf.NotAfter).Info("Reloaded client certificate")
+	}
+	keyPair.Leaf = leaf
+	r.keyPair, r.leaf = &keyPair, leaf
+	r.certStamp, r.keyStamp = certStamp, keyStamp
+	return nil
+}
+
+// GetClientCertificate is used as the tls.Config callback, so a changed certificate is used for the next handshake.
+func (r *keyPairReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if err := r.reload(); err != nil {
+		r.logger.WithError(err).Warn("Unable to reload client certificate, using previous one")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.keyPair, nil
+}
+
+// NotAfter returns the expiry of the certificate in use.
+func (r *keyPairReloader) NotAfter() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.leaf.NotAfter
+}
+
+// caReloader holds a CA bundle, re-reading it when it changes and otherwise keeping the last one read.
+type caReloader struct {
+	file   string
+	logger *logrus.Entry
+
+	mu    sync.Mutex
+	stamp fileStamp
+	pool  *x509.CertPool
+}
+
+// Pool returns the current CA pool.  It's an error if the CA file has never been read.
+func (c *caReloader) Pool() (*x509.CertPool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stamp, err := statFile(c.file)
+	if err == nil && c.pool != nil && stamp == c.stamp {
+		return c.pool, nil
+	}
+	var caCert []byte
+	if err == nil {
+		caCert, err = ioutil.ReadFile(c.file)
+	}
+	if err != nil {
+		if c.pool == nil {
+			return nil, fmt.Errorf("Error loading CA file '%s': %v", c.file, err)
+		}
+		c.logger.WithError(err).Warn("Unable to reload CA file, using previous one")
+		return c.pool, nil
+	}
+
+	c.pool = x509.NewCertPool()
+	c.pool.AppendCertsFromPEM(caCert)
+	c.stamp = stamp
+	return c.pool, nil
+}
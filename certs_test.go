@@ -0,0 +1,165 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// copyKeyPair copies a fixture certificate and key to dir, bumping the modification time so a reload sees the change.
+func copyKeyPair(t *testing.T, name, dir string, age time.Duration) (certFile, keyFile string) {
+	certFile, keyFile = filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	for src, dst := range map[string]string{"fixtures/clients/" + name + ".crt": certFile, "fixtures/clients/" + name + ".key": keyFile} {
+		data, err := ioutil.ReadFile(src)
+		require.Nil(t, err)
+		require.Nil(t, ioutil.WriteFile(dst, data, 0600))
+		mtime := time.Now().Add(age)
+		require.Nil(t, os.Chtimes(dst, mtime, mtime))
+	}
+	return certFile, keyFile
+}
+
+func TestKeyPairReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-certs")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := copyKeyPair(t, "client1", dir, -time.Hour)
+	reloader, err := newKeyPairReloader(certFile, keyFile, KeyPassphrase{}, logrus.NewEntry(logrus.New()))
+	require.Nil(t, err)
+	first, err := reloader.GetClientCertificate(nil)
+	require.Nil(t, err)
+	assert.Equal(t, first.Leaf.NotAfter, reloader.NotAfter())
+
+	// Unchanged files aren't re-read.
+	second, err := reloader.GetClientCertificate(nil)
+	require.Nil(t, err)
+	assert.True(t, first == second)
+
+	// A half-rotated pair fails to load, and the last good pair is kept.
+	require.Nil(t, ioutil.WriteFile(certFile, fixture("clients/client2.crt"), 0600))
+	assert.NotNil(t, reloader.reload())
+	second, err = reloader.GetClientCertificate(nil)
+	require.Nil(t, err)
+	assert.True(t, first == second)
+
+	// Once both files are replaced, the new pair is used.
+	copyKeyPair(t, "client2", dir, 0)
+	second, err = reloader.GetClientCertificate(nil)
+	require.Nil(t, err)
+	assert.NotEqual(t, first.Leaf.SerialNumber, second.Leaf.SerialNumber)
+
+	// The first load must succeed.
+	_, err = newKeyPairReloader(filepath.Join(dir, "missing.crt"), keyFile, KeyPassphrase{}, logrus.NewEntry(logrus.New()))
+	assert.NotNil(t, err)
+}
+
+func TestClientCertificateHotReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-certs")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var subjects []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		subjects = append(subjects, r.TLS.PeerCertificates[0].Subject.CommonName)
+		mu.Unlock()
+		w.Write(fixture("secretsWithoutContent.json"))
+	}))
+	var connections int32
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.TLS = testCerts(testCaFile)
+	server.TLS.ClientAuth = tls.RequireAnyClientCert
+	server.StartTLS()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	cfg := defaultClientConfig()
+	cfg.Cert, cfg.Key = copyKeyPair(t, "client1", dir, -time.Hour)
+	client, err := NewClient(cfg, testCaFile, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{})
+	require.Nil(t, err)
+	_, err = client.SecretList()
+	require.Nil(t, err)
+
+	// Unchanged, the connection is reused by the next sync.
+	require.Nil(t, client.RebuildClient())
+	_, err = client.SecretList()
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&connections))
+
+	copyKeyPair(t, "client2", dir, 0)
+	require.Nil(t, client.RebuildClient())
+	_, err = client.SecretList()
+	require.Nil(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&connections))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, subjects, 3)
+	assert.Equal(t, subjects[0], subjects[1])
+	assert.NotEqual(t, subjects[1], subjects[2])
+}
+
+func TestSyncerCertMetrics(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", server)
+	require.Nil(t, err)
+	_, err = syncer.LoadClients()
+	require.Nil(t, err)
+
+	keyPair, err := tls.LoadX509KeyPair("fixtures/clients/client1.crt", "fixtures/clients/client1.key")
+	require.Nil(t, err)
+	leaf, err := x509.ParseCertificate(keyPair.Certificate[0])
+	require.Nil(t, err)
+
+	// Gauges are updated from the callbacks in the background.
+	notAfter, ok := syncer.certExpiry.Load("client1")
+	require.True(t, ok)
+	assert.Equal(t, leaf.NotAfter, notAfter.(func() time.Time)())
+	assert.NotNil(t, syncer.metricsHandle.Registry.Get("runtime.client.client1.cert_not_after"))
+	assert.NotNil(t, syncer.metricsHandle.Registry.Get("runtime.client.client1.cert_seconds_to_expiry"))
+
+	// Removed clients stop reporting.
+	syncer.config.ClientsDir = "fixtures/configs/errorconfigs"
+	syncer.config.YamlExt = ".none"
+	_, err = syncer.LoadClients()
+	require.Nil(t, err)
+	_, ok = syncer.certExpiry.Load("client1")
+	assert.False(t, ok)
+}
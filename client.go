@@ -16,6 +16,7 @@ package keysync
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -30,36 +31,48 @@ import (
 	"time"
 
 	"github.com/jpillora/backoff"
-	pkgerr "github.com/pkg/errors"
 	"github.com/rcrowley/go-metrics"
 	"github.com/sirupsen/logrus"
 	sqmetrics "github.com/square/go-sq-metrics"
 )
 
-// Cipher suites enabled in the client.  Since we also control the server, we can be fairly
-// conservative here and only enable ECDHE / GCM suites.
+// Cipher suites enabled in the client, unless cipher_suites is configured.  Since we also control the
+// server, we can be fairly conservative here and only enable ECDHE / GCM suites.
 var ciphers = []uint16{
 	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 }
 
 // Client represents an interface to a secrets storage backend.
+// The Context variants stop retrying and return as soon as the context is done.
 type Client interface {
 	Secret(name string) (secret *Secret, err error)
+	SecretContext(ctx context.Context, name string) (secret *Secret, err error)
 	SecretList() (map[string]Secret, error)
+	SecretListContext(ctx context.Context) (map[string]Secret, error)
 	SecretListWithContents(secrets []string) (map[string]Secret, error)
+	SecretListWithContentsContext(ctx context.Context, secrets []string) (map[string]Secret, error)
 	Logger() *logrus.Entry
 	RebuildClient() error
 }
 
+// SecretStreamer is implemented by clients that can hand over secrets with their contents one at a time, as
+// they're decoded, rather than returning them all at once.
+type SecretStreamer interface {
+	StreamSecretListWithContents(ctx context.Context, secrets []string, fn func(filename string, secret *Secret) error) error
+}
+
 // KeywhizHTTPClient is a client that reads from a Keywhiz server over HTTP (v2 API).
 type KeywhizHTTPClient struct {
 	logger      *logrus.Entry
 	httpClient  *http.Client
-	url         *url.URL
+	servers     *ServerPool
 	params      httpClientParams
+	mapping     SecretMapping
 	failCount   metrics.Counter
 	lastSuccess metrics.Gauge
+	retries     retryMetrics
+	inputs      tlsInputs // What httpClient's connections were made with
 }
 
 // httpClientParams are values necessary for constructing a TLS client.
@@ -67,10 +80,32 @@ type httpClientParams struct {
 	CertFile   string `json:"cert_file"`
 	KeyFile    string `json:"key_file"`
 	CaBundle   string `json:"ca_bundle"`
+	ServerName string `json:"server_name"`
+	tls        *tlsPolicy
+	crls       *crlSet
+	keyPair    clientCertSource
+	ca         caSource
 	timeout    time.Duration
 	maxRetries int
 	minBackoff time.Duration
 	maxBackoff time.Duration
+	// Longest response body that will be read, or 0 for no limit
+	maxResponseSize int64
+	// Optional: Records every exchange, for replay
+	recorder *recorder
+	// Optional: Used instead of connecting to a server, such as to replay a recording
+	transport http.RoundTripper
+}
+
+// clientCertSource provides the client certificate, such as from files or a workload API.
+type clientCertSource interface {
+	GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+	NotAfter() time.Time
+}
+
+// caSource provides the CAs the server's certificate is checked against.
+type caSource interface {
+	Pool() (*x509.CertPool, error)
 }
 
 // SecretDeleted is returned as an error when the server 404s.
@@ -80,6 +115,32 @@ func (e SecretDeleted) Error() string {
 	return "deleted"
 }
 
+// SecretForbidden is returned as an error when the server 403s, because this client may not access the secret.
+type SecretForbidden struct{}
+
+func (e SecretForbidden) Error() string {
+	return "forbidden"
+}
+
+// ResponseTooLarge is returned when reading a response body longer than max_response_size.
+type ResponseTooLarge struct {
+	Limit int64
+}
+
+func (e ResponseTooLarge) Error() string {
+	return fmt.Sprintf("response is larger than the limit of %d bytes", e.Limit)
+}
+
+// BatchError is returned when the server rejects a request for secrets with contents.
+type BatchError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e BatchError) Error() string {
+	return fmt.Sprintf("bad response code getting secrets with contents: (status=%v, msg='%s')", e.StatusCode, e.Message)
+}
+
 func (c KeywhizHTTPClient) failCountInc() {
 	c.failCount.Inc(1)
 }
@@ -97,6 +158,11 @@ func (c KeywhizHTTPClient) Logger() *logrus.Entry {
 // NewClient produces a ready-to-use client struct given client config and
 // CA file with the list of trusted certificate authorities.
 func NewClient(cfg *ClientConfig, caFile string, serverURL *url.URL, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) (client Client, err error) {
+	return NewClientWithServers(cfg, caFile, singleServerPool(serverURL, metricsHandle), logger, metricsHandle)
+}
+
+// NewClientWithServers is NewClient for a client that fails over between the servers in a pool.
+func NewClientWithServers(cfg *ClientConfig, caFile string, servers *ServerPool, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) (client Client, err error) {
 	logger = logger.WithField("logger", "kwfs_client")
 
 	timeout, err := time.ParseDuration(cfg.Timeout)
@@ -114,44 +180,173 @@ func NewClient(cfg *ClientConfig, caFile string, serverURL *url.URL, logger *log
 		return &KeywhizHTTPClient{}, fmt.Errorf("bad max backoff value '%s': %+v", cfg.MaxBackoff, err)
 	}
 
+	policy, err := cfg.TLS.policy()
+	if err != nil {
+		return &KeywhizHTTPClient{}, err
+	}
+	policy.pinFailures = metrics.GetOrRegisterCounter("runtime.server.pin_mismatch", metricsHandle.Registry)
+
+	crls, err := newCRLSet(cfg.CRLFiles, logger)
+	if err != nil {
+		return &KeywhizHTTPClient{}, fmt.Errorf("loading CRLs: %v", err)
+	}
+
+	var keyPair clientCertSource
+	var ca caSource
+	if cfg.WorkloadAPI.Socket != "" {
+		workload, err := newWorkloadSource(cfg.WorkloadAPI, timeout, logger)
+		if err != nil {
+			return &KeywhizHTTPClient{}, err
+		}
+		keyPair, ca = workload, workload
+	} else {
+		if keyPair, err = newKeyPairReloader(cfg.Cert, cfg.Key, cfg.KeyPassphrase, logger); err != nil {
+			return &KeywhizHTTPClient{}, err
+		}
+		ca = &caReloader{file: caFile, logger: logger}
+	}
+
 	params := httpClientParams{
 		CertFile:   cfg.Cert,
 		KeyFile:    cfg.Key,
 		CaBundle:   caFile,
+		ServerName: cfg.ServerName,
+		tls:        policy,
+		crls:       crls,
+		keyPair:    keyPair,
+		ca:         ca,
 		timeout:    timeout,
 		maxRetries: int(cfg.MaxRetries),
 		minBackoff: minBackoff,
 		maxBackoff: maxBackoff,
+
+		maxResponseSize: cfg.ResponseLimit,
+	}
+	// A workload API stream or recording that's been started is released if the client isn't returned.
+	defer func() {
+		if err != nil {
+			(&KeywhizHTTPClient{params: params}).Close()
+		}
+	}()
+	if cfg.Record.Path != "" && (cfg.Backend == "" || cfg.Backend == BackendKeywhiz) {
+		if params.recorder, err = newRecorder(cfg.Record, logger); err != nil {
+			return &KeywhizHTTPClient{}, err
+		}
 	}
 
 	failCount := metrics.GetOrRegisterCounter("runtime.server.fails", metricsHandle.Registry)
 	lastSuccess := metrics.GetOrRegisterGauge("runtime.server.lastsuccess", metricsHandle.Registry)
 
+	inputs, err := params.tlsInputs()
+	if err != nil {
+		return &KeywhizHTTPClient{}, err
+	}
 	initial, err := params.buildClient()
 	if err != nil {
 		return &KeywhizHTTPClient{}, err
 	}
 
-	return &KeywhizHTTPClient{logger, initial, serverURL, params, failCount, lastSuccess}, nil
+	return &KeywhizHTTPClient{
+		logger:      logger,
+		httpClient:  initial,
+		servers:     servers,
+		params:      params,
+		mapping:     cfg.SecretMapping,
+		failCount:   failCount,
+		lastSuccess: lastSuccess,
+		retries:     newRetryMetrics(metricsHandle.Registry),
+		inputs:      inputs,
+	}, nil
 }
 
-// RebuildClient reloads certificates from disk.  It should be called periodically to ensure up-to-date client
-// certificates are used.  This is important if you're using short-lived certificates that are routinely replaced.
+// RebuildClient picks up a changed client certificate, CA or CRL.  It should be called periodically to ensure
+// up-to-date client certificates are used.  This is important if you're using short-lived certificates that are
+// routinely replaced.  While nothing has changed, the client is kept, so its connections are reused.
 func (c *KeywhizHTTPClient) RebuildClient() error {
+	inputs, err := c.params.tlsInputs()
+	if err != nil {
+		return err
+	}
+	if inputs.equal(c.inputs) {
+		return nil
+	}
 	client, err := c.params.buildClient()
 	if err != nil {
 		return err
 	}
+	// Connections made with the old certificate, CA or CRLs mustn't be reused.
+	c.httpClient.CloseIdleConnections()
 	c.httpClient = client
+	c.inputs = inputs
 	return nil
 }
 
+// tlsInputs identifies what a client's TLS connections are made with, to tell when it needs replacing.
+type tlsInputs struct {
+	pool *x509.CertPool
+	cert *tls.Certificate
+	crls []*CRL
+}
+
+// tlsInputs returns what connections would be made with now.  The sources only return new values when their
+// files or stream have changed.
+func (p httpClientParams) tlsInputs() (tlsInputs, error) {
+	var inputs tlsInputs
+	if p.transport != nil {
+		return inputs, nil
+	}
+	var err error
+	if inputs.pool, err = p.ca.Pool(); err != nil {
+		return inputs, err
+	}
+	if inputs.cert, err = p.keyPair.GetClientCertificate(nil); err != nil {
+		return inputs, err
+	}
+	if p.crls != nil {
+		inputs.crls = p.crls.current()
+	}
+	return inputs, nil
+}
+
+func (i tlsInputs) equal(other tlsInputs) bool {
+	if i.pool != other.pool || i.cert != other.cert || len(i.crls) != len(other.crls) {
+		return false
+	}
+	for n := range i.crls {
+		if i.crls[n] != other.crls[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// Close releases anything the client holds open, such as a recording or a workload API stream.
+func (c *KeywhizHTTPClient) Close() error {
+	if closer, ok := c.params.keyPair.(io.Closer); ok {
+		closer.Close()
+	}
+	if c.params.recorder != nil {
+		return c.params.recorder.file.Close()
+	}
+	return nil
+}
+
+// certNotAfter returns the expiry of the client certificate currently in use.
+func (c KeywhizHTTPClient) certNotAfter() time.Time {
+	return c.params.keyPair.NotAfter()
+}
+
 // ServerStatus returns raw JSON from the server's _status endpoint
 func (c KeywhizHTTPClient) ServerStatus() (data []byte, err error) {
+	return c.ServerStatusContext(context.Background())
+}
+
+// ServerStatusContext returns raw JSON from the server's _status endpoint
+func (c KeywhizHTTPClient) ServerStatusContext(ctx context.Context) (data []byte, err error) {
 	path := "_status"
 	logger := c.logger.WithField("logger", path)
 	now := time.Now()
-	resp, err := c.getWithRetry(path)
+	resp, err := c.getWithRetry(ctx, path)
 	if err != nil {
 		logger.WithError(err).Warn("Error retrieving server status")
 		return nil, err
@@ -173,9 +368,14 @@ func (c KeywhizHTTPClient) ServerStatus() (data []byte, err error) {
 
 // RawSecret returns raw JSON from requesting a secret.
 func (c KeywhizHTTPClient) RawSecret(name string) ([]byte, error) {
+	return c.RawSecretContext(context.Background(), name)
+}
+
+// RawSecretContext returns raw JSON from requesting a secret.
+func (c KeywhizHTTPClient) RawSecretContext(ctx context.Context, name string) ([]byte, error) {
 	// note: path.Join does not know how to properly escape for URLs!
 	pathname := path.Join("secret", name)
-	data, statusCode, err := c.queryKeywhizWithRetries(pathname, fmt.Sprintf("secret %s", name))
+	data, statusCode, err := c.queryKeywhizWithRetries(ctx, pathname, fmt.Sprintf("secret %s", name))
 	if err != nil {
 		c.logger.Errorf("Error querying Keywhiz for secret %v: %v", name, err)
 		c.failCountInc()
@@ -189,6 +389,9 @@ func (c KeywhizHTTPClient) RawSecret(name string) ([]byte, error) {
 	case 404:
 		c.logger.Warnf("Secret %v not found", name)
 		return nil, SecretDeleted{}
+	case 403:
+		c.logger.Warnf("Secret %v is forbidden to this client", name)
+		return nil, SecretForbidden{}
 	default:
 		msg := strings.Join(strings.Split(string(data), "\n"), " ")
 		c.logger.Errorf("Bad response code getting secret %v: (status=%v, msg='%s')", name, statusCode, msg)
@@ -199,7 +402,12 @@ func (c KeywhizHTTPClient) RawSecret(name string) ([]byte, error) {
 
 // Secret returns an unmarshalled Secret struct after requesting a secret.
 func (c KeywhizHTTPClient) Secret(name string) (secret *Secret, err error) {
-	data, err := c.RawSecret(name)
+	return c.SecretContext(context.Background(), name)
+}
+
+// SecretContext returns an unmarshalled Secret struct after requesting a secret.
+func (c KeywhizHTTPClient) SecretContext(ctx context.Context, name string) (secret *Secret, err error) {
+	data, err := c.RawSecretContext(ctx, name)
 	if err != nil {
 		return nil, err
 	}
@@ -209,16 +417,25 @@ func (c KeywhizHTTPClient) Secret(name string) (secret *Secret, err error) {
 		return nil, fmt.Errorf("Error decoding retrieved secret %v: %v", name, err)
 	}
 
+	if !c.mapping.apply(secret) {
+		return nil, fmt.Errorf("secret %v is excluded by client config", name)
+	}
+
 	return secret, nil
 }
 
 // RawSecretList returns raw JSON from requesting a listing of secrets.
 func (c KeywhizHTTPClient) RawSecretList() ([]byte, error) {
-	data, statusCode, err := c.queryKeywhizWithRetries("secrets", "secrets without contents")
+	return c.RawSecretListContext(context.Background())
+}
+
+// RawSecretListContext returns raw JSON from requesting a listing of secrets.
+func (c KeywhizHTTPClient) RawSecretListContext(ctx context.Context) ([]byte, error) {
+	data, statusCode, err := c.queryKeywhizWithRetries(ctx, "secrets", "secrets without contents")
 
 	if err != nil {
 		c.failCountInc()
-		return nil, fmt.Errorf("error querying Keywhiz for secrets without contents: %v", err)
+		return nil, fmt.Errorf("error querying Keywhiz for secrets without contents: %w", err)
 	} else if statusCode != 200 {
 		msg := strings.Join(strings.Split(string(data), "\n"), " ")
 		c.failCountInc()
@@ -231,7 +448,12 @@ func (c KeywhizHTTPClient) RawSecretList() ([]byte, error) {
 // SecretList returns a map of unmarshalled Secret structs without their contents after requesting a listing of secrets.
 // The map keys are the names of the secrets
 func (c KeywhizHTTPClient) SecretList() (map[string]Secret, error) {
-	data, err := c.RawSecretList()
+	return c.SecretListContext(context.Background())
+}
+
+// SecretListContext is SecretList, returning early if ctx is done.
+func (c KeywhizHTTPClient) SecretListContext(ctx context.Context) (map[string]Secret, error) {
+	data, err := c.RawSecretListContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -240,6 +462,29 @@ func (c KeywhizHTTPClient) SecretList() (map[string]Secret, error) {
 
 // RawSecretListWithContents returns raw JSON from requesting a listing of secrets with their contents.
 func (c KeywhizHTTPClient) RawSecretListWithContents(secrets []string) ([]byte, error) {
+	return c.RawSecretListWithContentsContext(context.Background(), secrets)
+}
+
+// RawSecretListWithContentsContext returns raw JSON from requesting a listing of secrets with their contents.
+func (c KeywhizHTTPClient) RawSecretListWithContentsContext(ctx context.Context, secrets []string) ([]byte, error) {
+	resp, err := c.postBatchSecret(ctx, secrets)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		c.failCountInc()
+		return nil, fmt.Errorf("error getting secrets with contents: %w", err)
+	}
+	c.markSuccess()
+	return data, nil
+}
+
+// postBatchSecret requests secrets with their contents, returning the response if it's a 200.  The caller must
+// close its body.
+func (c KeywhizHTTPClient) postBatchSecret(ctx context.Context, secrets []string) (*http.Response, error) {
 	pathname := "batchsecret"
 
 	req, err := json.Marshal(map[string][]string{
@@ -252,37 +497,76 @@ func (c KeywhizHTTPClient) RawSecretListWithContents(secrets []string) ([]byte,
 	}
 
 	now := time.Now()
-	resp, err := c.postWithRetry(pathname, "application/json", bytes.NewBuffer(req))
+	resp, err := c.postWithRetry(ctx, pathname, "application/json", req)
 	if err != nil {
 		c.failCountInc()
 		c.logger.Errorf("Error retrieving secrets with contents: %v", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
 	c.logger.Infof("POST /%s %d %v", pathname, resp.StatusCode, time.Since(now))
 
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
 		c.failCountInc()
-		return nil, fmt.Errorf("error getting secrets with contents: %v", err)
-	} else if resp.StatusCode != 200 {
+		if err != nil {
+			return nil, fmt.Errorf("error getting secrets with contents: %w", err)
+		}
 		msg := strings.Join(strings.Split(string(data), "\n"), " ")
-		c.failCountInc()
-		return nil, fmt.Errorf("bad response code getting secrets with contents: (status=%v, msg='%s')", resp.StatusCode, msg)
+		return nil, BatchError{StatusCode: resp.StatusCode, Message: msg}
 	}
-	c.markSuccess()
-	return data, nil
+	return resp, nil
 }
 
 // SecretList returns a map of unmarshalled Secret structs, including their contents, associated with the
 // given list of secrets. The map keys are the names of the secrets. All secrets must be accessible to this
 // client, or the entire request will fail.
 func (c KeywhizHTTPClient) SecretListWithContents(secrets []string) (map[string]Secret, error) {
-	data, err := c.RawSecretListWithContents(secrets)
+	return c.SecretListWithContentsContext(context.Background(), secrets)
+}
+
+// SecretListWithContentsContext is SecretListWithContents, returning early if ctx is done.
+func (c KeywhizHTTPClient) SecretListWithContentsContext(ctx context.Context, secrets []string) (map[string]Secret, error) {
+	secretMap := map[string]Secret{}
+	err := c.StreamSecretListWithContents(ctx, secrets, func(filename string, secret *Secret) error {
+		secretMap[filename] = *secret
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return c.processSecretList(data)
+	return secretMap, nil
+}
+
+// StreamSecretListWithContents is SecretListWithContentsContext, but calls fn with each secret as it's decoded
+// instead of collecting them, so only one secret's contents need be in memory at a time.  fn may have been called
+// for some of the secrets by the time an error is returned.
+func (c KeywhizHTTPClient) StreamSecretListWithContents(ctx context.Context, secrets []string, fn func(filename string, secret *Secret) error) error {
+	resp, err := c.postBatchSecret(ctx, secrets)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	index := newFilenameIndex(&c.mapping)
+	var fnErr error
+	err = DecodeSecretList(resp.Body, func(secret Secret) error {
+		filename, ok, err := index.add(&secret)
+		if err == nil && ok {
+			err = fn(filename, &secret)
+		}
+		fnErr = err
+		return err
+	})
+	if fnErr != nil {
+		c.failCountInc()
+		return fnErr
+	} else if err != nil {
+		c.failCountInc()
+		return fmt.Errorf("error decoding retrieved secrets: %w", err)
+	}
+	c.markSuccess()
+	return nil
 }
 
 func (c KeywhizHTTPClient) processSecretList(data []byte) (map[string]Secret, error) {
@@ -290,25 +574,12 @@ func (c KeywhizHTTPClient) processSecretList(data []byte) (map[string]Secret, er
 	if err != nil {
 		return nil, fmt.Errorf("error decoding retrieved secrets: %v", err)
 	}
-	secretMap := map[string]Secret{}
-	for _, secret := range secretList {
-		filename, err := secret.Filename()
-		if err != nil {
-			return nil, pkgerr.Wrap(err, "unable to get secret's filename")
-		}
-		if duplicate, ok := secretMap[filename]; ok {
-			// This is not supported by Keysync. This stops syncing until the data inconsistency is fixed in the server.
-			return nil, fmt.Errorf("duplicate filename detected: %s on secrets %s and %s",
-				filename, duplicate.Name, secret.Name)
-		}
-		secretMap[filename] = secret
-	}
-	return secretMap, nil
+	return secretsByFilename(secretList, &c.mapping)
 }
 
-func (c KeywhizHTTPClient) queryKeywhizWithRetries(pathname, goalForMsg string) (result []byte, status int, err error) {
+func (c KeywhizHTTPClient) queryKeywhizWithRetries(ctx context.Context, pathname, goalForMsg string) (result []byte, status int, err error) {
 	now := time.Now()
-	resp, err := c.getWithRetry(pathname)
+	resp, err := c.getWithRetry(ctx, pathname)
 	if err != nil {
 		c.logger.Errorf("Error retrieving %v: %v", goalForMsg, err)
 		return nil, -1, err
@@ -324,43 +595,69 @@ func (c KeywhizHTTPClient) queryKeywhizWithRetries(pathname, goalForMsg string)
 	return data, resp.StatusCode, err
 }
 
-// buildClient constructs a new TLS client.
+// buildClient constructs a new TLS client.  The key pair and CA are only re-read if their files have changed.
 func (p httpClientParams) buildClient() (*http.Client, error) {
-	keyPair, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
-	if err != nil {
-		return nil, fmt.Errorf("Error loading Keypair '%s'/'%s': %v", p.CertFile, p.KeyFile, err)
+	if p.transport != nil {
+		return &http.Client{Transport: p.transport, Timeout: p.timeout}, nil
 	}
-
-	caCert, err := ioutil.ReadFile(p.CaBundle)
+	caCertPool, err := p.ca.Pool()
 	if err != nil {
-		return nil, fmt.Errorf("Error loading CA file '%s': %v", p.CaBundle, err)
+		return nil, err
 	}
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
 
 	config := &tls.Config{
-		Certificates: []tls.Certificate{keyPair},
-		RootCAs:      caCertPool,
-		MinVersion:   tls.VersionTLS12, // TLSv1.2 and up is required
-		CipherSuites: ciphers,
+		GetClientCertificate: p.keyPair.GetClientCertificate,
+		RootCAs:              caCertPool,
+		ServerName:           p.ServerName,
+	}
+	p.tls.apply(config)
+	if p.crls != nil {
+		config.VerifyPeerCertificate = p.crls.verifyPeerCertificate
+	}
+	var transport http.RoundTripper = &http.Transport{TLSClientConfig: config}
+	if p.recorder != nil {
+		transport = &recordingTransport{next: transport, recorder: p.recorder, limit: p.maxResponseSize}
 	}
-	config.BuildNameToCertificate()
-	transport := &http.Transport{TLSClientConfig: config}
 	return &http.Client{Transport: transport, Timeout: p.timeout}, nil
 }
 
-// shouldRetry decides wether a request should be retried or not.
-// e.g. 500 is an intermittent error, but 404 is most likely not.
-func shouldRetry(resp *http.Response) bool {
-	return resp.StatusCode >= 500
+// getWithRetry encapsulates the retry logic for requests that failed, because of
+// intermittent issues.  Each attempt fails over between servers before backing off.
+func (c *KeywhizHTTPClient) getWithRetry(ctx context.Context, pathname string) (resp *http.Response, err error) {
+	return c.doWithRetry(ctx, "GET", pathname, func(serverURL *url.URL) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", requestURL(serverURL, pathname), nil)
+	})
 }
 
-// getWithRetry encapsulates the retry logic for requests that failed, because of
-// intermittent issues
-func (c *KeywhizHTTPClient) getWithRetry(url string) (resp *http.Response, err error) {
-	t := *c.url
-	t.Path = path.Join(c.url.Path, url)
+// postWithRetry encapsulates the retry logic for requests that failed, because of
+// intermittent issues.  The body is resent in full to each server tried.
+func (c *KeywhizHTTPClient) postWithRetry(ctx context.Context, pathname, contentType string, body []byte) (resp *http.Response, err error) {
+	return c.requestWithRetry(ctx, "POST", pathname, http.Header{"Content-Type": {contentType}}, body)
+}
 
+// requestWithRetry sends a request with any method, headers and body, with the same retries and failover as
+// getWithRetry.  Other backends use it to share the client's TLS and retry handling.
+func (c *KeywhizHTTPClient) requestWithRetry(ctx context.Context, method, pathname string, header http.Header, body []byte) (resp *http.Response, err error) {
+	return c.doWithRetry(ctx, method, pathname, func(serverURL *url.URL) (*http.Request, error) {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, requestURL(serverURL, pathname), reader)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		return req, nil
+	})
+}
+
+// doWithRetry sends a request, retrying connection errors, 5xx and 429 responses with backoff.  A Retry-After
+// header is honoured, but if it asks for longer than max_backoff the response is returned instead.  Bodies of
+// responses that are retried are closed; the final response is returned with its body open.
+func (c *KeywhizHTTPClient) doWithRetry(ctx context.Context, method, pathname string, newRequest func(*url.URL) (*http.Request, error)) (resp *http.Response, err error) {
 	b := &backoff.Backoff{
 		//These are the defaults
 		Min:    c.params.minBackoff,
@@ -368,45 +665,101 @@ func (c *KeywhizHTTPClient) getWithRetry(url string) (resp *http.Response, err e
 		Jitter: true,
 	}
 
-	for i := 0; i < c.params.maxRetries; i++ {
+	attempts := c.params.maxRetries
+	if attempts < 1 {
+		attempts = 1
+	}
+	for i := 0; ; i++ {
 		now := time.Now()
-		resp, err = c.httpClient.Get(t.String())
-		if err != nil || !shouldRetry(resp) {
-			return
+		resp, err = c.servers.do(ctx, func(serverURL *url.URL) (*http.Response, error) {
+			req, err := newRequest(serverURL)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := c.httpClient.Do(req)
+			if pinErr := (PinMismatch{}); errors.As(err, &pinErr) {
+				c.logger.WithError(pinErr).WithField("server", serverURL.Host).Error("Server public key pin mismatch")
+			}
+			if err == nil && c.params.maxResponseSize > 0 {
+				resp.Body = limitBody(resp.Body, c.params.maxResponseSize)
+			}
+			return resp, err
+		})
+		reason := retryReason(resp, err)
+		if reason == "" || i+1 >= attempts {
+			return resp, err
 		}
+
 		sleep := b.Duration()
-		c.logger.Infof("GET /%s %d %v, attempt %d out of %d, retry in %v\n", url, resp.StatusCode, time.Since(now), i+1, c.params.maxRetries, sleep)
+		if wait := retryAfter(resp, time.Now()); wait > c.params.maxBackoff {
+			c.logger.Warnf("%s /%s %d asked to retry after %v, longer than max backoff %v; not retrying", method, pathname, resp.StatusCode, wait, c.params.maxBackoff)
+			return resp, err
+		} else if wait > sleep {
+			sleep = wait
+		}
+		if !takeRetry(ctx) {
+			c.retries.budgetExhausted.Inc(1)
+			c.logger.Warnf("%s /%s: retry budget exhausted, not retrying", method, pathname)
+			return resp, err
+		}
+		c.retries.byReason[reason].Inc(1)
 
-		time.Sleep(sleep)
+		logger := c.logger.WithField("reason", reason)
+		if err != nil {
+			logger = logger.WithError(err)
+		} else {
+			logger = logger.WithField("StatusCode", resp.StatusCode)
+			resp.Body.Close()
+		}
+		logger.Infof("%s /%s %v, attempt %d out of %d, retry in %v", method, pathname, time.Since(now), i+1, attempts, sleep)
+
+		if err := sleepContext(ctx, sleep); err != nil {
+			return nil, err
+		}
 	}
+}
 
-	return
+// limitedBody is a response body that fails with ResponseTooLarge once more than limit bytes have been read.
+type limitedBody struct {
+	io.Reader
+	io.Closer
+	read, limit int64
 }
 
-// postWithRetry encapsulates the retry logic for requests that failed, because of
-// intermittent issues
-func (c *KeywhizHTTPClient) postWithRetry(url, contentType string, body io.Reader) (resp *http.Response, err error) {
-	t := *c.url
-	t.Path = path.Join(c.url.Path, url)
+func limitBody(body io.ReadCloser, limit int64) io.ReadCloser {
+	// Reading one byte past the limit tells a body of exactly the limit from a longer one.
+	return &limitedBody{Reader: io.LimitReader(body, limit+1), Closer: body, limit: limit}
+}
 
-	b := &backoff.Backoff{
-		//These are the defaults
-		Min:    c.params.minBackoff,
-		Max:    c.params.maxBackoff,
-		Jitter: true,
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		// Only the bytes up to the limit are returned, which is none once it's been reached.
+		over := b.read - b.limit
+		if over > int64(n) {
+			over = int64(n)
+		}
+		return n - int(over), ResponseTooLarge{Limit: b.limit}
 	}
+	return n, err
+}
 
-	for i := 0; i < c.params.maxRetries; i++ {
-		now := time.Now()
-		resp, err = c.httpClient.Post(t.String(), contentType, body)
-		if err != nil || !shouldRetry(resp) {
-			return
-		}
-		sleep := b.Duration()
-		c.logger.Infof("POST /%s %d %v, attempt %d out of %d, retry in %v\n", url, resp.StatusCode, time.Since(now), i+1, c.params.maxRetries, sleep)
+// requestURL joins a path onto a server's base URL.
+func requestURL(serverURL *url.URL, pathname string) string {
+	t := *serverURL
+	t.Path = path.Join(serverURL.Path, pathname)
+	return t.String()
+}
 
-		time.Sleep(sleep)
+// sleepContext sleeps for the given duration, returning early with the context's error if it's done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-
-	return
 }
@@ -15,12 +15,18 @@
 package keysync
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	sqmetrics "github.com/square/go-sq-metrics"
@@ -85,18 +91,26 @@ func TestClientCallsServer(t *testing.T) {
 }
 
 func TestClientRebuild(t *testing.T) {
-	serverURL, _ := url.Parse("http://dummy:8080")
-	client, err := NewClient(defaultClientConfig(), testCaFile, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{})
+	dir, err := ioutil.TempDir("", "keysync-rebuild")
 	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	require.Nil(t, ioutil.WriteFile(caFile, fixture("CA/localhost.crt"), 0644))
 
-	http1 := client.(*KeywhizHTTPClient).httpClient
-	err = client.RebuildClient()
+	serverURL, _ := url.Parse("http://dummy:8080")
+	client, err := NewClient(defaultClientConfig(), caFile, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{})
 	require.Nil(t, err)
-	http2 := client.(*KeywhizHTTPClient).httpClient
 
-	if http1 == http2 {
-		t.Error("should not be same http client")
-	}
+	// Nothing changed, so connections are kept for the next sync.
+	http1 := client.(*KeywhizHTTPClient).httpClient
+	require.Nil(t, client.RebuildClient())
+	assert.True(t, http1 == client.(*KeywhizHTTPClient).httpClient)
+
+	// A changed CA needs new connections.
+	future := time.Now().Add(time.Minute)
+	require.Nil(t, os.Chtimes(caFile, future, future))
+	require.Nil(t, client.RebuildClient())
+	assert.False(t, http1 == client.(*KeywhizHTTPClient).httpClient)
 }
 
 func TestClientCallsServerErrors(t *testing.T) {
@@ -310,3 +324,35 @@ func TestDuplicateFilenames(t *testing.T) {
 	_, err = client.SecretList()
 	assert.EqualError(t, err, "duplicate filename detected: overridden_filename on secrets SecretA and SecretB")
 }
+
+func TestClientContextCancelsRetries(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	cfg := defaultClientConfig()
+	cfg.MaxRetries = 10
+	cfg.MinBackoff = "10s"
+	cfg.MaxBackoff = "10s"
+	client, err := NewClient(cfg, testCaFile, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{})
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = client.SecretListContext(ctx)
+	assert.Error(t, err)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Expected deadline exceeded, got %v", err)
+	assert.True(t, time.Since(start) < 5*time.Second, "Expected backoff to be interrupted")
+
+	_, err = client.SecretListWithContentsContext(ctx, []string{"secret"})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Expected deadline exceeded, got %v", err)
+
+	_, err = client.SecretContext(ctx, "secret")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "Expected deadline exceeded, got %v", err)
+}
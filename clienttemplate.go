@@ -0,0 +1,126 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// ExpandConfig makes one client entry stand for many similar clients.  The entry's name, key, cert, directory,
+// user, group and mirror directories are templates, executed with each name in turn as {{.Name}}.
+type ExpandConfig struct {
+	Names []string `yaml:"names"` // Optional: Names to expand over
+	Glob  string   `yaml:"glob"`  // Optional: Files to expand over, relative to client_directory if not absolute.  Each is named by its filename without the extension, and is {{.File}}.
+}
+
+// clientTemplateData is what templates in client configs are executed with.
+type clientTemplateData struct {
+	Name string
+	File string // The matching file's absolute path, when expanding over a glob or discovering
+}
+
+// expand returns the clients an entry stands for, by name.  An entry without expand stands for itself.
+func (c ClientConfig) expand(entry string, config *Config) (map[string]ClientConfig, error) {
+	if len(c.Expand.Names) == 0 && c.Expand.Glob == "" {
+		return map[string]ClientConfig{entry: c}, nil
+	}
+	if !strings.Contains(entry, "{{") {
+		return nil, fmt.Errorf("templated client %s must use {{.Name}} in its name", entry)
+	}
+
+	var items []clientTemplateData
+	for _, name := range c.Expand.Names {
+		items = append(items, clientTemplateData{Name: name})
+	}
+	if c.Expand.Glob != "" {
+		matches, err := filepath.Glob(resolvePath(config.ClientsDir, c.Expand.Glob))
+		if err != nil {
+			return nil, fmt.Errorf("bad expand glob '%s': %v", c.Expand.Glob, err)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			file, err := filepath.Abs(match)
+			if err != nil {
+				return nil, err
+			}
+			base := filepath.Base(file)
+			items = append(items, clientTemplateData{Name: strings.TrimSuffix(base, filepath.Ext(base)), File: file})
+		}
+	}
+
+	clients := map[string]ClientConfig{}
+	for _, item := range items {
+		client := c
+		client.Expand = ExpandConfig{}
+		// Copied, as setDefaults resolves them in place.
+		client.CRLFiles = append([]string(nil), c.CRLFiles...)
+		mirrors, err := expandMirrors(c.Mirrors, item)
+		if err != nil {
+			return nil, fmt.Errorf("expanding mirrors of %s for %s: %v", entry, item.Name, err)
+		}
+		client.Mirrors = mirrors
+		name := entry
+		for _, field := range []struct {
+			label string
+			value *string
+		}{
+			{"name", &name}, {"key", &client.Key}, {"cert", &client.Cert},
+			{"directory", &client.DirName}, {"user", &client.User}, {"group", &client.Group},
+		} {
+			expanded, err := executeTemplate(*field.value, item)
+			if err != nil {
+				return nil, fmt.Errorf("expanding %s of %s for %s: %v", field.label, entry, item.Name, err)
+			}
+			*field.value = expanded
+		}
+		if _, ok := clients[name]; ok {
+			return nil, fmt.Errorf("templated client %s expands to %s more than once", entry, name)
+		}
+		clients[name] = client
+	}
+	return clients, nil
+}
+
+// expandMirrors returns a copy of mirrors for one client, with each directory executed as a template.
+func expandMirrors(mirrors []MirrorConfig, data clientTemplateData) ([]MirrorConfig, error) {
+	var expanded []MirrorConfig
+	for _, mirror := range mirrors {
+		directory, err := executeTemplate(mirror.Directory, data)
+		if err != nil {
+			return nil, err
+		}
+		mirror.Directory = directory
+		expanded = append(expanded, mirror)
+	}
+	return expanded, nil
+}
+
+// executeTemplate executes a template in a client config.
+func executeTemplate(text string, data clientTemplateData) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
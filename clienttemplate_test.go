@@ -0,0 +1,150 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// templateConfig returns a config with an empty client directory, and a function to write client yaml into it.
+func templateConfig(t *testing.T) (*Config, func(file, contents string)) {
+	dir, err := ioutil.TempDir("", "keysync-template")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	config := &Config{
+		ClientsDir:    dir,
+		SecretsDir:    "/tmp/keysync-secrets",
+		YamlExt:       ".yaml",
+		ClientTimeout: "60s",
+		MinBackoff:    "100ms",
+		MaxBackoff:    "10s",
+		MaxRetries:    1,
+	}
+	return config, func(file, contents string) {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, file), []byte(contents), 0644))
+	}
+}
+
+func TestExpandClientNames(t *testing.T) {
+	config, write := templateConfig(t)
+	write("services.yaml", `
+"svc-{{.Name}}":
+  expand:
+    names: [web, api]
+  key: "certs/{{.Name}}.key"
+  cert: "certs/{{.Name}}.crt"
+  directory: "services/{{.Name}}"
+  user: "{{.Name}}"
+  group: services
+  max_batch_size: 5
+  mirrors:
+    - directory: "/mirror/{{.Name}}"
+`)
+
+	clients, err := config.LoadClients()
+	require.Nil(t, err)
+	require.Len(t, clients, 2)
+	web := clients["svc-web"]
+	assert.Equal(t, filepath.Join(config.ClientsDir, "certs/web.key"), web.Key)
+	assert.Equal(t, filepath.Join(config.ClientsDir, "certs/web.crt"), web.Cert)
+	assert.Equal(t, "services/web", web.DirName)
+	assert.Equal(t, "web", web.User)
+	assert.Equal(t, "services", web.Group)
+	assert.Equal(t, 5, web.MaxBatchSize)
+	assert.Equal(t, ExpandConfig{}, web.Expand)
+	assert.Equal(t, []MirrorConfig{{Directory: "/mirror/web"}}, web.Mirrors)
+	assert.Equal(t, "api", clients["svc-api"].User)
+	assert.Equal(t, []MirrorConfig{{Directory: "/mirror/api"}}, clients["svc-api"].Mirrors)
+}
+
+func TestExpandClientGlob(t *testing.T) {
+	config, write := templateConfig(t)
+	require.Nil(t, os.Mkdir(filepath.Join(config.ClientsDir, "certs"), 0755))
+	write("certs/web.pem", "")
+	write("certs/api.pem", "")
+	write("services.yaml", `
+"{{.Name}}":
+  expand:
+    glob: certs/*.pem
+  key: "{{.File}}"
+`)
+
+	clients, err := config.LoadClients()
+	require.Nil(t, err)
+	require.Len(t, clients, 2)
+	assert.Equal(t, filepath.Join(config.ClientsDir, "certs/api.pem"), clients["api"].Key)
+	assert.Equal(t, "api", clients["api"].DirName)
+}
+
+func TestExpandClientErrors(t *testing.T) {
+	for _, test := range []struct {
+		yaml, err string
+	}{
+		{`
+services:
+  expand: {names: [web, api]}
+  key: client.key
+`, "templated client services must use {{.Name}} in its name"},
+		{`
+"{{.Name}}":
+  expand: {names: [web, web]}
+  key: client.key
+`, "templated client {{.Name}} expands to web more than once"},
+		{`
+"{{.Name}}":
+  expand: {names: [web]}
+  key: "{{.Nmae}}.key"
+`, "expanding key of {{.Name}} for web"},
+	} {
+		config, write := templateConfig(t)
+		write("services.yaml", test.yaml)
+		_, err := config.LoadClients()
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), test.err)
+	}
+}
+
+func TestLoadClientsDuplicates(t *testing.T) {
+	config, write := templateConfig(t)
+	write("a.yaml", "web:\n  key: web.key\n")
+	write("b.yaml", "\"{{.Name}}\":\n  expand: {names: [api, web]}\n  key: \"{{.Name}}.key\"\n")
+	_, err := config.LoadClients()
+	assert.EqualError(t, err, "client web in b.yaml is also configured in a.yaml")
+
+	write("b.yaml", "api:\n  key: api.key\n  directory: web\n")
+	_, err = config.LoadClients()
+	assert.EqualError(t, err, "clients api in b.yaml and web in a.yaml both use directory web")
+
+	write("b.yaml", "api:\n  key: api.key\n  directory: ./web/\n")
+	_, err = config.LoadClients()
+	assert.EqualError(t, err, "clients api in b.yaml and web in a.yaml both use directory web")
+
+	// Mirrors too, such as from a template that doesn't use {{.Name}} in them.
+	write("a.yaml", "web:\n  key: web.key\n  mirrors: [{directory: /mirror}]\n")
+	write("b.yaml", "\"{{.Name}}\":\n  expand: {names: [api]}\n  key: \"{{.Name}}.key\"\n  mirrors: [{directory: /mirror/}]\n")
+	_, err = config.LoadClients()
+	assert.EqualError(t, err, "clients api in b.yaml and web in a.yaml both use directory /mirror")
+
+	write("b.yaml", "api:\n  key: api.key\n")
+	clients, err := config.LoadClients()
+	require.Nil(t, err)
+	assert.Len(t, clients, 2)
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/square/keysync/keywhiztest"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func main() {
+	var (
+		app      = kingpin.New("fakekeywhiz", "A fake Keywhiz server for testing keysync")
+		listen   = app.Flag("listen", "Address to serve Keywhiz on").Default("127.0.0.1:4444").String()
+		certFile = app.Flag("cert", "Server certificate").Required().ExistingFile()
+		keyFile  = app.Flag("key", "Server private key").Required().ExistingFile()
+		clientCA = app.Flag("client-ca", "CA that client certificates must be signed by").Required().ExistingFile()
+		secrets  = app.Flag("secrets", "Secrets to serve, as a JSON list in Keywhiz's format").ExistingFile()
+		allow    = app.Flag("allow", "Limit a client to some secrets, as client=secret1,secret2").Strings()
+		admin    = app.Flag("admin", "Address to serve the unauthenticated admin API on, for scripting").String()
+	)
+	kingpin.MustParse(app.Parse(os.Args[1:]))
+
+	server := keywhiztest.New()
+	if *secrets != "" {
+		data, err := ioutil.ReadFile(*secrets)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		if err := server.LoadSecrets(data); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	for _, grant := range *allow {
+		parts := strings.SplitN(grant, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("bad --allow '%s', expected client=secret1,secret2", grant)
+		}
+		server.Allow(parts[0], strings.Split(parts[1], ",")...)
+	}
+
+	tlsConfig, err := keywhiztest.TLSConfig(*certFile, *keyFile, *clientCA)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if *admin != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*admin, adminHandler(server)))
+		}()
+	}
+
+	log.Printf("Serving Keywhiz on %s", *listen)
+	httpServer := &http.Server{Addr: *listen, Handler: server, TLSConfig: tlsConfig}
+	log.Fatal(httpServer.ListenAndServeTLS("", ""))
+}
+
+// adminHandler lets scripts change the server while it runs:
+//
+//	PUT /secret/{name}      sets a secret's contents to the request body
+//	DELETE /secret/{name}   deletes a secret
+//	POST /delete-after-list deletes the secrets in a JSON list once they've next been listed
+//	POST /fault             injects a fault, as JSON with Path, Latency (in nanoseconds), Status, Truncate and Times
+//	DELETE /fault           clears all faults
+//	GET /requests           lists the requests served so far
+func adminHandler(server *keywhiztest.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/secret/") && r.Method == "PUT":
+			content, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			server.Set(keywhiztest.Secret{
+				Name:     strings.TrimPrefix(r.URL.Path, "/secret/"),
+				Content:  content,
+				Filename: r.URL.Query().Get("filename"),
+				Mode:     r.URL.Query().Get("mode"),
+				Owner:    r.URL.Query().Get("owner"),
+				Group:    r.URL.Query().Get("group"),
+			})
+		case strings.HasPrefix(r.URL.Path, "/secret/") && r.Method == "DELETE":
+			server.Delete(strings.TrimPrefix(r.URL.Path, "/secret/"))
+		case r.URL.Path == "/delete-after-list" && r.Method == "POST":
+			var names []string
+			if err := json.NewDecoder(r.Body).Decode(&names); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			server.DeleteAfterList(names...)
+		case r.URL.Path == "/fault" && r.Method == "POST":
+			var fault keywhiztest.Fault
+			if err := json.NewDecoder(r.Body).Decode(&fault); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			server.Inject(fault)
+		case r.URL.Path == "/fault" && r.Method == "DELETE":
+			server.ClearFaults()
+		case r.URL.Path == "/requests" && r.Method == "GET":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(server.Requests())
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
@@ -20,16 +20,22 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	stdlog "log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/square/keysync"
+	"github.com/square/keysync/backup"
 
 	"github.com/evalphobia/logrus_sentry"
 	"github.com/getsentry/raven-go"
@@ -49,8 +55,23 @@ func main() {
 	var (
 		app        = kingpin.New("keysync", "A client for Keywhiz")
 		configFile = app.Flag("config", "The base YAML configuration file").PlaceHolder("config.yaml").Required().String()
+
+		runCmd = app.Command("run", "Sync secrets from the server").Default()
+
+		bundleCmd    = app.Command("apply-bundle", "Install a client's secrets from an exported bundle, such as during an outage")
+		bundleClient = bundleCmd.Flag("client", "The client whose directory to write").Required().String()
+		bundleFile   = bundleCmd.Flag("bundle", "The bundle, as exported from Keywhiz").PlaceHolder("bundle.json").Required().ExistingFile()
+		dryRun       = bundleCmd.Flag("dry-run", "Show what would change, without changing anything").Bool()
+		showDiff     = bundleCmd.Flag("diff", "Print each file that's added, changed or removed").Bool()
+		thenSync     = bundleCmd.Flag("sync", "Carry on syncing from the server once the bundle is applied").Bool()
+
+		exportCmd       = app.Command("export", "Write a client's secrets to a bundle, optionally encrypted")
+		exportClient    = exportCmd.Flag("client", "The client whose secrets to export").Required().String()
+		exportSource    = exportCmd.Flag("source", "Fetch secrets from the server, or read what's on disk").Default(keysync.ExportFromServer).Enum(keysync.ExportFromServer, keysync.ExportFromDisk)
+		exportRecipient = exportCmd.Flag("recipient", "Encrypt the bundle to this public key, from keyunwrap generate").ExistingFile()
+		exportOutput    = exportCmd.Flag("output", "Where to write the bundle, or - for stdout").Default("-").String()
 	)
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -87,7 +108,28 @@ func main() {
 	captured, errorId := raven.CapturePanicAndWait(func() {
 		metricsHandle := sqmetrics.NewMetrics("", config.MetricsPrefix, http.DefaultClient, 1*time.Second, metrics.DefaultRegistry, &stdlog.Logger{})
 
-		syncer, err := keysync.NewSyncer(config, keysync.OutputDirCollection{Config: config}, logger, metricsHandle)
+		if command == bundleCmd.FullCommand() {
+			applyBundle(config, *bundleClient, *bundleFile, *dryRun, *showDiff, logger, metricsHandle)
+			if *dryRun || !*thenSync {
+				return
+			}
+		} else if command == exportCmd.FullCommand() {
+			exportBundle(config, *exportClient, *exportSource, *exportRecipient, *exportOutput, logger, metricsHandle)
+			return
+		} else if command != runCmd.FullCommand() {
+			logger.Fatalf("Unknown command %s", command)
+		}
+
+		var outputCollection keysync.OutputCollection = keysync.OutputDirCollection{Config: config}
+		if config.SocketPath != "" {
+			logger.WithField("path", config.SocketPath).Info("Serving secrets on socket")
+			outputCollection, err = keysync.NewSocketOutputCollection(config, logger)
+			if err != nil {
+				logger.WithError(err).Fatal("Failed while creating socket server")
+			}
+		}
+
+		syncer, err := keysync.NewSyncer(config, outputCollection, logger, metricsHandle)
 		if err != nil {
 			logger.WithError(err).Fatal("Failed while creating syncer")
 		}
@@ -102,9 +144,20 @@ func main() {
 			keysync.NewAPIServer(syncer, fileBackup, config.APIPort, logger, metricsHandle)
 		}
 
+		// Stop syncing on SIGINT or SIGTERM, abandoning any requests in progress.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			logger.WithField("signal", sig).Info("Received signal, stopping")
+			cancel()
+		}()
+
 		logger.Info("Starting syncer")
-		err = syncer.Run()
-		if err != nil {
+		err = syncer.RunContext(ctx)
+		if err != nil && err != context.Canceled {
 			logger.WithError(err).Fatal("Failed while running syncer")
 		}
 	}, nil)
@@ -116,6 +169,88 @@ func main() {
 	}
 }
 
+// applyBundle installs a client's secrets from a bundle, or with dryRun only shows what that would change.
+func applyBundle(config *keysync.Config, clientName, bundle string, dryRun, showDiff bool, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) {
+	clients, err := config.LoadClients()
+	if err != nil {
+		logger.WithError(err).Fatal("Failed loading client configuration")
+	}
+	clientConfig, ok := clients[clientName]
+	if !ok {
+		logger.WithField("client", clientName).Fatal("No such client")
+	}
+	logger = logger.WithFields(logrus.Fields{"client": clientName, "bundle": bundle})
+
+	if dryRun || showDiff {
+		changes, err := keysync.DiffBundle(config, clientConfig, bundle, logger)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed comparing bundle")
+		}
+		if showDiff {
+			for _, change := range changes {
+				fmt.Println(change)
+			}
+		}
+		if dryRun {
+			logger.WithField("changes", len(changes)).Info("Dry run, not applying bundle")
+			return
+		}
+	}
+
+	updated, err := keysync.ApplyBundle(config, clientConfig, bundle, logger, metricsHandle)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed applying bundle")
+	}
+	logger.WithFields(logrus.Fields{
+		"Added":   updated.Added,
+		"Changed": updated.Changed,
+		"Deleted": updated.Deleted,
+	}).Info("Bundle applied")
+}
+
+// exportBundle writes a client's secrets to a bundle, encrypted if a recipient public key file is given.
+func exportBundle(config *keysync.Config, clientName, source, recipientFile, outputPath string, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) {
+	logger = logger.WithFields(logrus.Fields{"client": clientName, "source": source})
+	var recipient *[32]byte
+	if recipientFile != "" {
+		encoded, err := ioutil.ReadFile(recipientFile)
+		if err != nil {
+			logger.WithError(err).Fatal("Failed reading recipient public key")
+		}
+		if recipient, err = backup.ParsePublicKey(strings.TrimSpace(string(encoded))); err != nil {
+			logger.WithError(err).Fatal("Failed parsing recipient public key")
+		}
+	}
+
+	syncer, err := keysync.NewSyncer(config, keysync.OutputDirCollection{Config: config}, logger, metricsHandle)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed while creating syncer")
+	}
+	// A new syncer has no clients to clean up.
+	if _, err := syncer.LoadClients(); err != nil {
+		logger.WithError(err).Fatal("Failed loading client configuration")
+	}
+	bundle, err := syncer.Export(context.Background(), clientName, source, recipient)
+	if err != nil {
+		logger.WithError(err).Fatal("Failed exporting secrets")
+	}
+
+	out := os.Stdout
+	if outputPath != "-" {
+		// Only the owner can read the bundle, which may not be encrypted.
+		if out, err = os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			logger.WithError(err).Fatal("Failed creating bundle")
+		}
+	}
+	if _, err := out.Write(bundle); err != nil {
+		logger.WithError(err).Fatal("Failed writing bundle")
+	}
+	if err := out.Close(); err != nil {
+		logger.WithError(err).Fatal("Failed writing bundle")
+	}
+	logger.WithFields(logrus.Fields{"output": outputPath, "encrypted": recipient != nil}).Info("Exported secrets")
+}
+
 // This is modified from raven.newTransport()
 func newTransport(CaFile string) (raven.Transport, error) {
 	t := &raven.HTTPTransport{}
@@ -0,0 +1,79 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/keysync"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportBundleFromDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-export")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"clients", "local", "secrets/app"} {
+		require.Nil(t, os.MkdirAll(filepath.Join(dir, sub), 0755))
+	}
+	configFile := filepath.Join(dir, "config.yaml")
+	require.Nil(t, ioutil.WriteFile(configFile, []byte(fmt.Sprintf(`
+client_directory: %[1]s/clients
+secrets_directory: %[1]s/secrets
+ca_file: %[1]s/ca.crt
+server: localhost:4444
+`, dir)), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "clients", "app.yaml"), []byte(`
+app:
+  backend: local
+  local:
+    path: ../local
+  rename:
+    db_password: db.conf
+`), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "secrets", "app", "db.conf"), []byte("hunter2"), 0440))
+
+	config, err := keysync.LoadConfig(configFile)
+	require.Nil(t, err)
+	bundleFile := filepath.Join(dir, "bundle.json")
+	metricsHandle := sqmetrics.NewMetrics("", "test", nil, time.Second, metrics.DefaultRegistry, &stdlog.Logger{})
+	// Like the command, this syncer has never synced, so it has no state for the files on disk.
+	exportBundle(config, "app", keysync.ExportFromDisk, "", bundleFile, logrus.NewEntry(logrus.New()), metricsHandle)
+
+	bundle, err := ioutil.ReadFile(bundleFile)
+	require.Nil(t, err)
+	secrets, err := keysync.ParseSecretList(bundle)
+	require.Nil(t, err)
+	require.Len(t, secrets, 1)
+	assert.Equal(t, "db_password", secrets[0].Name)
+	assert.EqualValues(t, "hunter2", secrets[0].Content)
+	sum := sha256.Sum256([]byte("hunter2"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), secrets[0].Checksum)
+	assert.Equal(t, "0440", secrets[0].Mode)
+	assert.NotEmpty(t, secrets[0].Owner)
+	assert.NotEmpty(t, secrets[0].Group)
+}
@@ -15,7 +15,6 @@
 package main
 
 import (
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
@@ -59,17 +58,28 @@ func checkClientHealth(config *keysync.Config) []error {
 			errs = append(errs, err)
 		}
 
+		// Clients may trust a different CA than the global one.
+		if err := checkCaFile(name, &client); err != nil {
+			errs = append(errs, err)
+		}
+
+		errs = append(errs, checkCRLs(name, &client)...)
+
 	}
 
 	return errs
 }
 
 func checkCertificate(name string, client *keysync.ClientConfig, minCertLifetime time.Duration) error {
+	if !usesServer(client) || client.WorkloadAPI.Socket != "" {
+		// SVIDs from a workload API are rotated in memory, with no files to check.
+		return nil
+	}
 	if client.Key == "" {
 		return fmt.Errorf("no key specified in config for client %s", name)
 	}
 
-	keyPair, err := tls.LoadX509KeyPair(client.Cert, client.Key)
+	keyPair, err := keysync.LoadX509KeyPair(client.Cert, client.Key, client.KeyPassphrase)
 	if err != nil {
 		return fmt.Errorf("unable to load certificate and key for client %s: %s", name, err)
 	}
@@ -92,6 +102,68 @@ func checkCertificate(name string, client *keysync.ClientConfig, minCertLifetime
 	return nil
 }
 
+func checkCaFile(name string, client *keysync.ClientConfig) error {
+	if !usesServer(client) || client.WorkloadAPI.Socket != "" {
+		// A workload API's trust bundle replaces the CA file.
+		return nil
+	}
+	if client.CaFile == "" {
+		// No CA configured anywhere, which checkPaths reports.
+		return nil
+	}
+
+	caCert, err := ioutil.ReadFile(client.CaFile)
+	if err != nil {
+		return fmt.Errorf("unable to load CA file for client %s: %s", name, err)
+	}
+
+	if !x509.NewCertPool().AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("no certificates in CA file %s for client %s", client.CaFile, name)
+	}
+
+	return nil
+}
+
+// usesServer returns false for clients that read secrets without connecting to a server, so have no certificate
+// or CA to check.
+func usesServer(client *keysync.ClientConfig) bool {
+	switch client.Backend {
+	case keysync.BackendLocal, keysync.BackendBundle, keysync.BackendReplay:
+		return false
+	}
+	return true
+}
+
+// checkCRLs warns about CRLs that are past their next update time, or that revoke the client's certificate.
+func checkCRLs(name string, client *keysync.ClientConfig) []error {
+	if len(client.CRLFiles) == 0 {
+		return nil
+	}
+
+	var leaf *x509.Certificate
+	if keyPair, err := keysync.LoadX509KeyPair(client.Cert, client.Key, client.KeyPassphrase); err == nil {
+		// Failing to load the certificate is reported by checkCertificate.
+		leaf, _ = x509.ParseCertificate(keyPair.Certificate[0])
+	}
+
+	var errs []error
+	now := time.Now()
+	for _, path := range client.CRLFiles {
+		crl, err := keysync.ParseCRLFile(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to load CRL for client %s: %s", name, err))
+			continue
+		}
+		if crl.HasExpired(now) {
+			errs = append(errs, fmt.Errorf("stale CRL %s for client %s: NextUpdate %s", path, name, crl.NextUpdate.Format(time.RFC3339)))
+		}
+		if leaf != nil && keysync.CRLRevokes(crl, leaf) {
+			errs = append(errs, fmt.Errorf("revoked client certificate for client %s: serial %s is in CRL %s", name, leaf.SerialNumber, path))
+		}
+	}
+	return errs
+}
+
 func checkHasSecrets(name string, client *keysync.ClientConfig, secretsDir string, minSecretsCount int) error {
 	dir := path.Join(secretsDir, client.DirName)
 	files, err := ioutil.ReadDir(dir)
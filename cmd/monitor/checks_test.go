@@ -15,7 +15,10 @@
 package main
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io/ioutil"
+	"math/big"
 	"os"
 	"path"
 	"strings"
@@ -23,6 +26,7 @@ import (
 	"time"
 
 	"github.com/square/keysync"
+	"github.com/square/keysync/keywhiztest"
 	"github.com/stretchr/testify/assert"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -96,3 +100,107 @@ func TestCheckClientHealth(t *testing.T) {
 	// Client certificate has a NotAfter of 2020-12-05 23:52 UTC
 	assertError(t, errs, "expired client certificate")
 }
+
+func TestCheckClientHealthCaFile(t *testing.T) {
+	config := setupTestEnvironment(t)
+	defer cleanupTestEnvironment(t, config)
+
+	// The client overrides the CA with one that isn't a certificate.
+	caPath := path.Join(config.ClientsDir, "other-ca.crt")
+	assert.NoError(t, ioutil.WriteFile(caPath, []byte(strings.TrimSpace(testClientKey)), 0600))
+
+	client := struct {
+		Client *keysync.ClientConfig `yaml:"client"`
+	}{
+		Client: &keysync.ClientConfig{
+			Cert:   path.Join(config.ClientsDir, "test-client.crt"),
+			Key:    path.Join(config.ClientsDir, "test-client.key"),
+			CaFile: "other-ca.crt",
+		},
+	}
+	clientYAML, err := yaml.Marshal(client)
+	assert.Nil(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(config.ClientsDir, "client.yaml"), clientYAML, 0600))
+
+	errs := checkClientHealth(config)
+	assertError(t, errs, "no certificates in CA file "+caPath+" for client client")
+
+	// A valid CA passes.
+	assert.NoError(t, ioutil.WriteFile(caPath, []byte(strings.TrimSpace(testClientCert)), 0600))
+	for _, err := range checkClientHealth(config) {
+		assert.NotContains(t, err.Error(), "CA file")
+	}
+}
+
+func TestCheckCRLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, err := keywhiztest.NewCA("test-ca")
+	assert.Nil(t, err)
+	cert, err := ca.Issue(&x509.Certificate{SerialNumber: big.NewInt(42), Subject: pkix.Name{CommonName: "client"}})
+	assert.Nil(t, err)
+	certPEM, keyPEM, err := keywhiztest.EncodeKeyPair(cert)
+	assert.Nil(t, err)
+
+	client := &keysync.ClientConfig{
+		Cert:     path.Join(dir, "client.crt"),
+		Key:      path.Join(dir, "client.key"),
+		CRLFiles: []string{path.Join(dir, "ca.crl")},
+	}
+	assert.NoError(t, ioutil.WriteFile(client.Cert, certPEM, 0600))
+	assert.NoError(t, ioutil.WriteFile(client.Key, keyPEM, 0600))
+
+	writeCRL := func(nextUpdate time.Time, serial int64) {
+		crl, err := ca.CRL(nextUpdate, serial)
+		assert.Nil(t, err)
+		assert.NoError(t, ioutil.WriteFile(client.CRLFiles[0], crl, 0600))
+	}
+
+	writeCRL(time.Now().Add(time.Hour), 7)
+	assert.Empty(t, checkCRLs("client", client))
+
+	writeCRL(time.Now().Add(-time.Hour), 42)
+	errs := checkCRLs("client", client)
+	assert.Len(t, errs, 2)
+	assertError(t, errs, "stale CRL")
+	assertError(t, errs, "revoked client certificate for client client: serial 42")
+}
+
+func TestCheckCertificateEncryptedKey(t *testing.T) {
+	client := &keysync.ClientConfig{
+		Cert:          "../../fixtures/clients/client1.crt",
+		Key:           "../../fixtures/clients/client1-pkcs8.key",
+		KeyPassphrase: keysync.KeyPassphrase{File: "../../fixtures/keypass.txt"},
+	}
+	assert.Nil(t, checkCertificate("client1", client, time.Hour))
+
+	client.KeyPassphrase = keysync.KeyPassphrase{}
+	err := checkCertificate("client1", client, time.Hour)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no key_passphrase")
+}
+
+func TestCheckCertificateBackends(t *testing.T) {
+	// Backends that don't connect to a server have no key or CA.
+	for _, backend := range []string{keysync.BackendLocal, keysync.BackendBundle, keysync.BackendReplay} {
+		client := &keysync.ClientConfig{Backend: backend, CaFile: "/nonexistent/ca.crt"}
+		assert.Nil(t, checkCertificate("client", client, time.Hour), backend)
+		assert.Nil(t, checkCaFile("client", client), backend)
+	}
+
+	client := &keysync.ClientConfig{Backend: keysync.BackendVault}
+	err := checkCertificate("client", client, time.Hour)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no key specified")
+}
+
+func TestCheckCertificateWorkloadAPI(t *testing.T) {
+	client := &keysync.ClientConfig{
+		WorkloadAPI: keysync.WorkloadAPIConfig{Socket: "unix:///run/spire/agent.sock"},
+		CaFile:      "/nonexistent/ca.crt",
+	}
+	assert.Nil(t, checkCertificate("client", client, time.Hour))
+	assert.Nil(t, checkCaFile("client", client))
+}
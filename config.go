@@ -15,11 +15,11 @@
 package keysync
 
 import (
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -31,29 +31,39 @@ import (
 
 // Config is the main yaml configuration file passed to the keysync binary
 type Config struct {
-	ClientsDir    string            `yaml:"client_directory"`  // A directory of configuration files
-	SecretsDir    string            `yaml:"secrets_directory"` // The directory secrets will be written to
-	CaFile        string            `yaml:"ca_file"`           // The CA to trust (PEM) for Keywhiz communication
-	YamlExt       string            `yaml:"yaml_ext"`          // The filename extension of the yaml config files
-	PollInterval  string            `yaml:"poll_interval"`     // If specified, poll at the given interval, otherwise, exit after syncing
-	ClientTimeout string            `yaml:"client_timeout"`    // If specified, timeout client connections after specified duration, otherwise use default.
-	MinBackoff    string            `yaml:"min_backoff"`       // If specified, wait time before first retry, otherwise, use default.
-	MaxBackoff    string            `yaml:"max_backoff"`       // If specified, max wait time before retries, otherwise, use default.
-	MaxRetries    uint16            `yaml:"max_retries"`       // If specified, retry each HTTP call after non-200 response
-	Server        string            `yaml:"server"`            // The server to connect to (host:port)
-	Debug         bool              `yaml:"debug"`             // Enable debugging output
-	DefaultUser   string            `yaml:"default_user"`      // Default user to own files
-	DefaultGroup  string            `yaml:"default_group"`     // Default group to own files
-	APIPort       uint16            `yaml:"api_port"`          // Port for API to listen on
-	SentryDSN     string            `yaml:"sentry_dsn"`        // Sentry DSN
-	SentryCaFile  string            `yaml:"sentry_ca_file"`    // The CA to trust (PEM) for Sentry communication
-	FsType        output.Filesystem `yaml:"filesystem_type"`   // Enforce writing this type of filesystem. Use value from statfs.
-	ChownFiles    bool              `yaml:"chown_files"`       // Do we chown files? Set to false when running without CAP_CHOWN.
-	MetricsPrefix string            `yaml:"metrics_prefix"`    // Prefix metric names with this
-	Monitor       MonitorConfig     `yaml:"monitor"`           // Config for monitoring/alerts
-	BackupPath    string            `yaml:"backup_path"`       // If specified, back up secrets as an encrypted tarball to this location
-	BackupKeyPath string            `yaml:"backup_key_path"`   // write wrapped key encrypting the backup to this location
-	BackupPubkey  string            `yaml:"backup_pubkey"`     // Public key to wrap backup keys to, from keyunwrap --generate
+	ClientsDir     string            `yaml:"client_directory"`  // A directory of configuration files
+	SecretsDir     string            `yaml:"secrets_directory"` // The directory secrets will be written to
+	CaFile         string            `yaml:"ca_file"`           // The CA to trust (PEM) for Keywhiz communication
+	YamlExt        string            `yaml:"yaml_ext"`          // The filename extension of the yaml config files
+	PollInterval   string            `yaml:"poll_interval"`     // If specified, poll at the given interval, otherwise, exit after syncing
+	ClientTimeout  string            `yaml:"client_timeout"`    // If specified, timeout client connections after specified duration, otherwise use default.
+	MinBackoff     string            `yaml:"min_backoff"`       // If specified, wait time before first retry, otherwise, use default.
+	MaxBackoff     string            `yaml:"max_backoff"`       // If specified, max wait time before retries, otherwise, use default.
+	MaxRetries     uint16            `yaml:"max_retries"`       // If specified, retry each HTTP call after non-200 response
+	RetryBudget    uint16            `yaml:"retry_budget"`      // If specified, the most retries a client may make in one sync
+	MaxBatchSize   int               `yaml:"max_batch_size"`    // If specified, request at most this many secrets' contents at once
+	ResponseLimit  int64             `yaml:"max_response_size"` // Longest Keywhiz response to read, in bytes.  Defaults to 64 MiB.
+	Server         string            `yaml:"server"`            // The server to connect to (host:port)
+	Servers        []ServerConfig    `yaml:"servers"`           // If specified, fail over between these servers instead of using server
+	ServerCooldown string            `yaml:"server_cooldown"`   // How long to avoid a server after it fails, unless all servers have failed
+	TLSServerName  string            `yaml:"tls_server_name"`   // Name to verify on the server's certificate, if not its address
+	TLS            TLSConfig         `yaml:"tls"`               // TLS versions, ciphers and public-key pins for Keywhiz communication
+	CRLFiles       []string          `yaml:"crl_files"`         // If specified, reject server certificates revoked by these CRLs (PEM or DER)
+	Debug          bool              `yaml:"debug"`             // Enable debugging output
+	DefaultUser    string            `yaml:"default_user"`      // Default user to own files
+	DefaultGroup   string            `yaml:"default_group"`     // Default group to own files
+	APIPort        uint16            `yaml:"api_port"`          // Port for API to listen on
+	SentryDSN      string            `yaml:"sentry_dsn"`        // Sentry DSN
+	SentryCaFile   string            `yaml:"sentry_ca_file"`    // The CA to trust (PEM) for Sentry communication
+	FsType         output.Filesystem `yaml:"filesystem_type"`   // Enforce writing this type of filesystem. Use value from statfs.
+	ChownFiles     bool              `yaml:"chown_files"`       // Do we chown files? Set to false when running without CAP_CHOWN.
+	MetricsPrefix  string            `yaml:"metrics_prefix"`    // Prefix metric names with this
+	Monitor        MonitorConfig     `yaml:"monitor"`           // Config for monitoring/alerts
+	BackupPath     string            `yaml:"backup_path"`       // If specified, back up secrets as an encrypted tarball to this location
+	BackupKeyPath  string            `yaml:"backup_key_path"`   // write wrapped key encrypting the backup to this location
+	BackupPubkey   string            `yaml:"backup_pubkey"`     // Public key to wrap backup keys to, from keyunwrap --generate
+	SocketPath     string            `yaml:"socket_path"`       // If specified, serve secrets on this Unix socket instead of writing files
+	Discover       []DiscoveryConfig `yaml:"discover"`          // If specified, also find clients from certificate files in these directories
 }
 
 // The MonitorConfig has extra settings for monitoring/alerts.
@@ -65,17 +75,70 @@ type MonitorConfig struct {
 	AlertEmailSender    string        `yaml:"alert_email_sender"`    // For alert emails: Sender (from) for alert emails
 }
 
+// Backends a client can read its secrets from.
+const (
+	BackendKeywhiz = "keywhiz"
+	BackendVault   = "vault"
+	BackendLocal   = "local"  // A directory tree of plain files
+	BackendBundle  = "bundle" // An encrypted bundle file
+	BackendHTTP    = "http"   // A JSON API described by an HTTPConfig
+	BackendReplay  = "replay" // A recording of a Keywhiz client's traffic
+)
+
 // The ClientConfig describes a single Keywhiz client.  There are typically many of these per keysync instance.
 type ClientConfig struct {
-	Key        string `yaml:"key"`       // Mandatory: Path to PEM key to use
-	Cert       string `yaml:"cert"`      // Optional: PEM Certificate (If cert isn't in key file)
-	User       string `yaml:"user"`      // Optional: User and Group are defaults for files without metadata
-	DirName    string `yaml:"directory"` // Optional: What directory under SecretsDir this client is in. Defaults to the client name.
-	Group      string `yaml:"group"`     // Optional: If unspecified, the global defaults are used.
+	Key        string    `yaml:"key"`             // Mandatory: Path to PEM key to use
+	Cert       string    `yaml:"cert"`            // Optional: PEM Certificate (If cert isn't in key file)
+	User       string    `yaml:"user"`            // Optional: User and Group are defaults for files without metadata
+	DirName    string    `yaml:"directory"`       // Optional: What directory under SecretsDir this client is in. Defaults to the client name.
+	Group      string    `yaml:"group"`           // Optional: If unspecified, the global defaults are used.
+	Server     string    `yaml:"server"`          // Optional: Keywhiz server (host:port) to use instead of the global one
+	CaFile     string    `yaml:"ca_file"`         // Optional: CA to trust (PEM) instead of the global one
+	ServerName string    `yaml:"tls_server_name"` // Optional: Name to verify on the server's certificate, if not its address
+	TLS        TLSConfig `yaml:"tls"`             // Optional: Overrides parts of the global TLS policy
+	CRLFiles   []string  `yaml:"crl_files"`       // Optional: CRLs to check instead of the global ones
 	MaxRetries uint16
 	Timeout    string
 	MinBackoff string
 	MaxBackoff string
+	// Retries allowed in one sync, across all requests.  0 means unlimited.
+	RetryBudget uint16
+	// Longest response to read, in bytes.  0 means unlimited.
+	ResponseLimit int64
+	// Optional: The most secrets to request contents for at once, instead of the global max_batch_size
+	MaxBatchSize int `yaml:"max_batch_size"`
+	// Optional: Get the client certificate and CA bundle from a SPIFFE Workload API, instead of key and cert
+	WorkloadAPI WorkloadAPIConfig `yaml:"workload_api"`
+	// Optional: Where to read the passphrase for an encrypted key (PKCS#8 or legacy encrypted PEM)
+	KeyPassphrase KeyPassphrase `yaml:"key_passphrase"`
+	// Optional: Filter and rename this client's secrets.
+	SecretMapping `yaml:",inline"`
+	// Optional: Also write this client's secrets to these directories.
+	Mirrors []MirrorConfig `yaml:"mirrors"`
+	// Optional: Where to read secrets from, "keywhiz" (the default), "vault", "local", "bundle", "http" or "replay"
+	Backend string `yaml:"backend"`
+	// Optional: Where this client's secrets are in Vault, with backend: vault
+	Vault VaultConfig `yaml:"vault"`
+	// Optional: The directory this client's secrets are read from, with backend: local
+	Local LocalConfig `yaml:"local"`
+	// Optional: The encrypted bundle this client's secrets are read from, with backend: bundle
+	Bundle BundleConfig `yaml:"bundle"`
+	// Optional: The JSON API this client's secrets are read from, with backend: http
+	HTTP HTTPConfig `yaml:"http"`
+	// Optional: The recording this client's secrets are replayed from, with backend: replay
+	Replay ReplayConfig `yaml:"replay"`
+	// Optional: Record this client's requests and responses to Keywhiz, for replay
+	Record RecordConfig `yaml:"record"`
+	// Optional: Make this entry a template for many clients, one for each name
+	Expand ExpandConfig `yaml:"expand"`
+}
+
+// MirrorConfig is an extra location a client's secrets are written to, such as a path bind-mounted into a container.
+type MirrorConfig struct {
+	Directory string            `yaml:"directory"`       // Mandatory: Absolute path to write secrets to
+	User      string            `yaml:"user"`            // Optional: User and Group default to the client's
+	Group     string            `yaml:"group"`           // Optional
+	FsType    output.Filesystem `yaml:"filesystem_type"` // Optional: Defaults to the global filesystem_type
 }
 
 // LoadConfig loads the "global" keysync configuration file.  This would generally be called on startup.
@@ -103,6 +166,16 @@ func LoadConfig(configFile string) (*Config, error) {
 		return nil, fmt.Errorf("backup_key specified (%s) without backup_key_path", config.BackupPath)
 	}
 
+	if config.Server != "" && len(config.Servers) > 0 {
+		return nil, fmt.Errorf("only one of server and servers may be specified: %s", configFile)
+	}
+
+	for _, server := range config.Servers {
+		if server.Address == "" {
+			return nil, fmt.Errorf("server with no address in servers: %s", configFile)
+		}
+	}
+
 	if config.MaxRetries < 1 {
 		config.MaxRetries = 1
 	}
@@ -119,6 +192,14 @@ func LoadConfig(configFile string) (*Config, error) {
 		config.MaxBackoff = "10s"
 	}
 
+	if config.ResponseLimit == 0 {
+		config.ResponseLimit = 64 << 20
+	}
+
+	if config.ServerCooldown == "" {
+		config.ServerCooldown = "30s"
+	}
+
 	return &config, nil
 }
 
@@ -127,22 +208,16 @@ func BackupFromConfig(cfg *Config) (backup.Backup, error) {
 	if cfg.BackupPath != "" && cfg.BackupKeyPath != "" {
 		// Public key is base64 encoded in yaml, but the yaml decoder doesn't automatically load
 		// []byte like json, so we do it here.
-		pubkeyslice, err := base64.StdEncoding.DecodeString(cfg.BackupPubkey)
+		pubkey, err := backup.ParsePublicKey(cfg.BackupPubkey)
 		if err != nil {
 			return nil, err
 		}
-		if len(pubkeyslice) != 32 {
-			return nil, fmt.Errorf("public key wasn't 32 bytes: %d", len(pubkeyslice))
-		}
-		// Fix type to fixed-length array
-		var pubkey [32]byte
-		copy(pubkey[:], pubkeyslice)
 
 		fileBackup = &backup.FileBackup{
 			SecretsDirectory: cfg.SecretsDir,
 			BackupPath:       cfg.BackupPath,
 			BackupKeyPath:    cfg.BackupKeyPath,
-			Pubkey:           &pubkey,
+			Pubkey:           pubkey,
 			Chown:            cfg.ChownFiles,
 			EnforceFS:        cfg.FsType,
 		}
@@ -150,6 +225,14 @@ func BackupFromConfig(cfg *Config) (backup.Backup, error) {
 	return fileBackup, nil
 }
 
+// ServerConfigs returns the servers to connect to, treating a single server as a list of one.
+func (config *Config) ServerConfigs() []ServerConfig {
+	if len(config.Servers) > 0 {
+		return config.Servers
+	}
+	return []ServerConfig{{Address: config.Server}}
+}
+
 // LoadClients looks in directory for files with suffix, and tries to load them
 // as Yaml files describing clients for Keysync to load
 // We filter by the yaml extension so we can keep configs and keys in the same directory
@@ -159,6 +242,7 @@ func (config *Config) LoadClients() (map[string]ClientConfig, error) {
 		return nil, fmt.Errorf("failed opening directory %s: %+v", config.ClientsDir, err)
 	}
 	configs := map[string]ClientConfig{}
+	sources := map[string]string{} // Where each client was configured
 	for _, file := range files {
 		fileName := file.Name()
 		if strings.HasSuffix(fileName, config.YamlExt) {
@@ -172,38 +256,205 @@ func (config *Config) LoadClients() (map[string]ClientConfig, error) {
 			if err != nil {
 				return nil, fmt.Errorf("failed parsing %s: %+v", fileName, err)
 			}
-			for name, client := range newClients {
-				// TODO: Check if this is a duplicate.
-				if client.DirName == "" {
-					client.DirName = name
+			var entries []string
+			for entry := range newClients {
+				entries = append(entries, entry)
+			}
+			sort.Strings(entries)
+			for _, entry := range entries {
+				expanded, err := newClients[entry].expand(entry, config)
+				if err != nil {
+					return nil, fmt.Errorf("failed expanding %s: %v", fileName, err)
 				}
+				var names []string
+				for name := range expanded {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					client := expanded[name]
+					if other, ok := sources[name]; ok {
+						return nil, fmt.Errorf("client %s in %s is also configured in %s", name, fileName, other)
+					}
+					if client.DirName == "" {
+						client.DirName = name
+					}
+
+					if err := client.prepare(config); err != nil {
+						return nil, fmt.Errorf("failed validating %s: %+v", fileName, err)
+					}
 
-				client.setDefaults(config)
-				if err := client.validate(); err != nil {
-					return nil, fmt.Errorf("failed validating %s: %+v", fileName, err)
+					configs[name] = client
+					sources[name] = fileName
 				}
-				client.resolveKeyPair(config)
+			}
+		}
+	}
+
+	for _, discovery := range config.Discover {
+		discovered, discoveredFrom, err := config.discoverClients(discovery)
+		if err != nil {
+			return nil, err
+		}
+		for name, client := range discovered {
+			if other, ok := sources[name]; ok {
+				return nil, fmt.Errorf("client %s discovered from %s is also configured in %s", name, discoveredFrom[name], other)
+			}
+			if err := client.prepare(config); err != nil {
+				return nil, fmt.Errorf("failed validating client discovered from %s: %+v", discoveredFrom[name], err)
+			}
+			configs[name] = client
+			sources[name] = discoveredFrom[name]
+		}
+	}
 
-				configs[name] = client
+	// Clients sharing a directory or mirror would delete each other's secrets.
+	var names []string
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dirNames := map[string]string{}
+	for _, name := range names {
+		// Mirrors are absolute, and client directories are relative to secrets_directory, so they can't clash.
+		dirs := []string{configs[name].DirName}
+		for _, mirror := range configs[name].Mirrors {
+			dirs = append(dirs, mirror.Directory)
+		}
+		for _, dir := range dirs {
+			dirName := filepath.Clean(dir)
+			if other, ok := dirNames[dirName]; ok {
+				return nil, fmt.Errorf("clients %s in %s and %s in %s both use directory %s", other, sources[other], name, sources[name], dirName)
 			}
+			dirNames[dirName] = name
 		}
 	}
 	return configs, nil
 }
 
+// prepare readies a client from a yaml file or discovery alike: it fills in defaults, validates the client and
+// resolves its key pair.
+func (c *ClientConfig) prepare(cfg *Config) error {
+	c.setDefaults(cfg)
+	if err := c.validate(cfg); err != nil {
+		return err
+	}
+	c.resolveKeyPair(cfg)
+	return nil
+}
+
 func (c *ClientConfig) setDefaults(cfg *Config) {
 	c.MinBackoff = cfg.MinBackoff
 	c.MaxBackoff = cfg.MaxBackoff
 	c.MaxRetries = cfg.MaxRetries
+	c.RetryBudget = cfg.RetryBudget
+	c.ResponseLimit = cfg.ResponseLimit
+	if c.MaxBatchSize == 0 {
+		c.MaxBatchSize = cfg.MaxBatchSize
+	}
 	c.Timeout = cfg.ClientTimeout
+	if c.ServerName == "" {
+		c.ServerName = cfg.TLSServerName
+	}
+	c.TLS.setDefaults(cfg.TLS)
+	if len(c.CRLFiles) == 0 {
+		c.CRLFiles = cfg.CRLFiles
+	} else {
+		for i, path := range c.CRLFiles {
+			c.CRLFiles[i] = resolvePath(cfg.ClientsDir, path)
+		}
+	}
+	if c.CaFile == "" {
+		c.CaFile = cfg.CaFile
+	} else {
+		c.CaFile = resolvePath(cfg.ClientsDir, c.CaFile)
+	}
+	if c.Local.Path != "" {
+		c.Local.Path = resolvePath(cfg.ClientsDir, c.Local.Path)
+	}
+	if c.Local.Metadata != "" {
+		c.Local.Metadata = resolvePath(cfg.ClientsDir, c.Local.Metadata)
+	}
+	if c.Bundle.Path != "" {
+		c.Bundle.Path = resolvePath(cfg.ClientsDir, c.Bundle.Path)
+	}
+	if c.Bundle.PrivateKey != "" {
+		c.Bundle.PrivateKey = resolvePath(cfg.ClientsDir, c.Bundle.PrivateKey)
+	}
+	if c.Replay.Path != "" {
+		c.Replay.Path = resolvePath(cfg.ClientsDir, c.Replay.Path)
+	}
+	if c.Replay.PrivateKey != "" {
+		c.Replay.PrivateKey = resolvePath(cfg.ClientsDir, c.Replay.PrivateKey)
+	}
+	if c.Record.Path != "" {
+		c.Record.Path = resolvePath(cfg.ClientsDir, c.Record.Path)
+	}
 }
 
-func (c *ClientConfig) validate() error {
-	if c.Key == "" {
+func (c *ClientConfig) validate(cfg *Config) error {
+	var err error
+	switch c.Backend {
+	case "", BackendKeywhiz:
+	case BackendVault:
+		err = c.Vault.validate()
+	case BackendLocal:
+		err = c.Local.validate()
+	case BackendBundle:
+		err = c.Bundle.validate()
+	case BackendHTTP:
+		err = c.HTTP.validate()
+	case BackendReplay:
+		err = c.Replay.validate()
+	default:
+		return fmt.Errorf("unknown backend '%s'", c.Backend)
+	}
+	if err != nil {
+		return err
+	}
+	if c.Record.Path != "" && c.Backend != "" && c.Backend != BackendKeywhiz {
+		// Only Keywhiz responses are known well enough to keep secrets out of a recording.
+		return errors.New("record is only supported with backend: keywhiz")
+	}
+	if err := c.Record.validate(); err != nil {
+		return fmt.Errorf("bad record config: %v", err)
+	}
+	if c.WorkloadAPI.Socket != "" {
+		if err := c.WorkloadAPI.validate(c); err != nil {
+			return err
+		}
+	} else if c.Key == "" && c.Backend != BackendLocal && c.Backend != BackendBundle && c.Backend != BackendReplay {
+		// Secrets read from local files don't need a client certificate.
 		return errors.New("no key in config")
 	}
 
-	return nil
+	if c.MaxBatchSize < 0 {
+		return fmt.Errorf("max_batch_size must not be negative: %d", c.MaxBatchSize)
+	}
+
+	secretsDir, err := filepath.Abs(cfg.SecretsDir)
+	if err != nil {
+		return err
+	}
+	for _, mirror := range c.Mirrors {
+		if !filepath.IsAbs(mirror.Directory) {
+			return fmt.Errorf("mirror directory must be an absolute path: '%s'", mirror.Directory)
+		}
+		// Anything else in the secrets directory is deleted as an unknown client.
+		if rel, err := filepath.Rel(secretsDir, mirror.Directory); err == nil && !strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("mirror directory '%s' can't be inside secrets_directory", mirror.Directory)
+		}
+	}
+
+	if err := c.KeyPassphrase.validate(); err != nil {
+		return err
+	}
+
+	if _, err := c.TLS.policy(); err != nil {
+		return err
+	}
+
+	return c.SecretMapping.validate()
 }
 
 func (c *ClientConfig) resolveKeyPair(cfg *Config) {
@@ -214,6 +465,9 @@ func (c *ClientConfig) resolveKeyPair(cfg *Config) {
 		// If no cert is provided, it's in the Key file.
 		c.Cert = c.Key
 	}
+	if c.KeyPassphrase.File != "" {
+		c.KeyPassphrase.File = resolvePath(cfg.ClientsDir, c.KeyPassphrase.File)
+	}
 }
 
 // resolvePath returns path if it's absolute, and joins it to directory otherwise.
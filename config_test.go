@@ -41,6 +41,25 @@ func TestConfigLoadConfigSuccess(t *testing.T) {
 	// TODO: Test loading defaults
 }
 
+func TestConfigLoadConfigServers(t *testing.T) {
+	config, err := LoadConfig("fixtures/configs/servers-config.yaml")
+	require.Nil(t, err)
+	assert.Equal(t, "2m", config.ServerCooldown)
+	assert.Equal(t, []ServerConfig{
+		{Address: "localhost:4444", Priority: 0},
+		{Address: "backup.example.com:4444", Priority: 10},
+	}, config.ServerConfigs())
+
+	// A single server is a list of one, with the default cooldown
+	config, err = LoadConfig("fixtures/configs/test-config.yaml")
+	require.Nil(t, err)
+	assert.Equal(t, "30s", config.ServerCooldown)
+	assert.Equal(t, []ServerConfig{{Address: "localhost:4444"}}, config.ServerConfigs())
+
+	_, err = LoadConfig("fixtures/configs/errorconfigs/server-and-servers-config.yaml")
+	assert.NotNil(t, err)
+}
+
 func TestConfigLoadConfigMissingOrInvalidFiles(t *testing.T) {
 	newAssert := assert.New(t)
 
@@ -76,6 +95,8 @@ func TestConfigLoadClientsSuccess(t *testing.T) {
 	}
 
 	assert.Equal(t, "client4_overridden", clients["client4"].DirName)
+	// An absolute cert path is kept as it is.
+	assert.Equal(t, "/nonexistent/non-dir/missing-dir/test-absolute-path/client1.crt", clients["abscert"].Cert)
 
 	client, ok := clients["missingcert"]
 	newAssert.True(ok)
@@ -0,0 +1,191 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CertificateRevoked is returned when the server presents a certificate that's listed in a configured CRL.
+type CertificateRevoked struct {
+	Subject string
+	Serial  *big.Int
+}
+
+func (e CertificateRevoked) Error() string {
+	return fmt.Sprintf("certificate %s (serial %s) has been revoked", e.Subject, e.Serial)
+}
+
+// CRL is a certificate revocation list, reduced to what keysync checks.  It's parsed with the newest API the Go
+// release has, which is why it doesn't expose the standard library's types.
+type CRL struct {
+	Issuer         string    // The issuer's distinguished name, as pkix.RDNSequence.String formats it
+	AuthorityKeyID []byte    // The issuer's key ID, if the CRL has one
+	NextUpdate     time.Time // When the issuer promises a new CRL, or zero if it doesn't
+	Revoked        []*big.Int
+
+	signed signedCRL
+}
+
+// HasExpired returns true if the issuer should have published a newer CRL by now.
+func (crl *CRL) HasExpired(now time.Time) bool {
+	return !crl.NextUpdate.IsZero() && !now.Before(crl.NextUpdate)
+}
+
+// ParseCRLFile reads a certificate revocation list, in PEM or DER form.
+func ParseCRLFile(path string) (*CRL, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("expected X509 CRL in %s, found %s", path, block.Type)
+		}
+		data = block.Bytes
+	}
+	crl, err := parseCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CRL %s: %v", path, err)
+	}
+	return crl, nil
+}
+
+// CRLRevokes returns true if the CRL is from the certificate's issuer, and lists the certificate.
+// The issuer is matched by name and, if both have one, authority key ID.  It doesn't check the CRL's signature.
+func CRLRevokes(crl *CRL, cert *x509.Certificate) bool {
+	if issuer, err := rdnString(cert.RawIssuer); err != nil || issuer != crl.Issuer {
+		return false
+	}
+	if len(crl.AuthorityKeyID) > 0 && len(cert.AuthorityKeyId) > 0 && !bytes.Equal(crl.AuthorityKeyID, cert.AuthorityKeyId) {
+		return false
+	}
+	for _, serial := range crl.Revoked {
+		if serial.Cmp(cert.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// rdnString formats a DER-encoded name, so names from certificates and CRLs compare the same however they're parsed.
+func rdnString(raw []byte) (string, error) {
+	var name pkix.RDNSequence
+	if _, err := asn1.Unmarshal(raw, &name); err != nil {
+		return "", err
+	}
+	return name.String(), nil
+}
+
+// crlSet holds parsed CRL files, re-reading each one when its modification time or size changes.
+type crlSet struct {
+	mu     sync.Mutex
+	files  []*crlFile
+	logger *logrus.Entry
+}
+
+type crlFile struct {
+	path  string
+	stamp fileStamp
+	crl   *CRL
+	// warned is set once the CRL has been reported as expired, so it's only reported again after a reload.
+	warned bool
+}
+
+// newCRLSet loads the CRL files.  Unlike a later reload, it's an error if one can't be read.
+func newCRLSet(paths []string, logger *logrus.Entry) (*crlSet, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	s := &crlSet{logger: logger}
+	for _, path := range paths {
+		file := &crlFile{path: path}
+		if err := file.load(); err != nil {
+			return nil, err
+		}
+		s.files = append(s.files, file)
+	}
+	return s, nil
+}
+
+func (f *crlFile) load() error {
+	stamp, err := statFile(f.path)
+	if err != nil {
+		return err
+	}
+	if f.crl != nil && stamp == f.stamp {
+		return nil
+	}
+	crl, err := ParseCRLFile(f.path)
+	if err != nil {
+		return err
+	}
+	f.crl, f.stamp, f.warned = crl, stamp, false
+	return nil
+}
+
+// current reloads changed files, and returns the CRLs.  A file that can no longer be read keeps its previous contents,
+// so a CRL being replaced non-atomically doesn't break connections.
+func (s *crlSet) current() []*CRL {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var crls []*CRL
+	for _, file := range s.files {
+		if err := file.load(); err != nil {
+			s.logger.WithError(err).WithField("crl", file.path).Warn("Unable to reload CRL, using previous version")
+		}
+		if !file.warned && file.crl.HasExpired(time.Now()) {
+			s.logger.WithField("crl", file.path).Warn("CRL is past its next update time")
+			file.warned = true
+		}
+		crls = append(crls, file.crl)
+	}
+	return crls
+}
+
+// verifyPeerCertificate runs after the chain has been verified against the CA.  It rejects any certificate in the
+// chain that's revoked by a CRL signed by the certificate's issuer.
+func (s *crlSet) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	crls := s.current()
+	for _, chain := range verifiedChains {
+		// The last certificate is a trusted root, with no issuer to revoke it.
+		for i := 0; i+1 < len(chain); i++ {
+			cert, issuer := chain[i], chain[i+1]
+			for _, crl := range crls {
+				if !CRLRevokes(crl, cert) {
+					continue
+				}
+				if err := crl.checkSignatureFrom(issuer); err != nil {
+					s.logger.WithError(err).Warn("Ignoring CRL with bad signature")
+					continue
+				}
+				return CertificateRevoked{Subject: cert.Subject.String(), Serial: cert.SerialNumber}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !go1.21
+// +build !go1.21
+
+package keysync
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+)
+
+// x509.ParseRevocationList arrived in Go 1.19 and RevocationList.RevokedCertificateEntries in 1.21, so older
+// releases parse CRLs with the API they replaced.
+type signedCRL = *pkix.CertificateList
+
+func parseCRL(der []byte) (*CRL, error) {
+	list, err := x509.ParseCRL(der)
+	if err != nil {
+		return nil, err
+	}
+	var revoked []*big.Int
+	for _, entry := range list.TBSCertList.RevokedCertificates {
+		revoked = append(revoked, entry.SerialNumber)
+	}
+	return &CRL{
+		Issuer:         list.TBSCertList.Issuer.String(),
+		AuthorityKeyID: crlAuthorityKeyID(list),
+		NextUpdate:     list.TBSCertList.NextUpdate,
+		Revoked:        revoked,
+		signed:         list,
+	}, nil
+}
+
+func (crl *CRL) checkSignatureFrom(issuer *x509.Certificate) error {
+	return issuer.CheckCRLSignature(crl.signed)
+}
+
+// The authority key identifier extension, and the part of it keysync uses.
+var oidAuthorityKeyID = asn1.ObjectIdentifier{2, 5, 29, 35}
+
+type authorityKeyID struct {
+	ID []byte `asn1:"optional,tag:0"`
+}
+
+// crlAuthorityKeyID returns the key ID of the CRL's issuer, if it has one.
+func crlAuthorityKeyID(list *pkix.CertificateList) []byte {
+	for _, ext := range list.TBSCertList.Extensions {
+		if !ext.Id.Equal(oidAuthorityKeyID) {
+			continue
+		}
+		var aki authorityKeyID
+		if _, err := asn1.Unmarshal(ext.Value, &aki); err == nil {
+			return aki.ID
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build go1.21
+// +build go1.21
+
+package keysync
+
+import (
+	"crypto/x509"
+	"math/big"
+)
+
+type signedCRL = *x509.RevocationList
+
+func parseCRL(der []byte) (*CRL, error) {
+	list, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := rdnString(list.RawIssuer)
+	if err != nil {
+		return nil, err
+	}
+	var revoked []*big.Int
+	for _, entry := range list.RevokedCertificateEntries {
+		revoked = append(revoked, entry.SerialNumber)
+	}
+	return &CRL{
+		Issuer:         issuer,
+		AuthorityKeyID: list.AuthorityKeyId,
+		NextUpdate:     list.NextUpdate,
+		Revoked:        revoked,
+		signed:         list,
+	}, nil
+}
+
+func (crl *CRL) checkSignatureFrom(issuer *x509.Certificate) error {
+	return crl.signed.CheckSignatureFrom(issuer)
+}
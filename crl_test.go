@@ -0,0 +1,171 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/keysync/keywhiztest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues certificates and CRLs for tests that need more than the fixture certificates.
+type testCA struct {
+	*keywhiztest.CA
+}
+
+func newTestCA(t *testing.T) testCA {
+	ca, err := keywhiztest.NewCA("keysync test CA")
+	require.Nil(t, err)
+	return testCA{ca}
+}
+
+// issue returns a certificate for 127.0.0.1, usable by a server or client.
+func (ca testCA) issue(t *testing.T, serial int64) tls.Certificate {
+	cert, err := ca.Issue(&x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	})
+	require.Nil(t, err)
+	return cert
+}
+
+// writeCRL writes a PEM CRL revoking the given serials, with a modification time in the future so it's seen to change.
+func (ca testCA) writeCRL(t *testing.T, path string, nextUpdate time.Time, serials ...int64) {
+	crl, err := ca.CRL(nextUpdate, serials...)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(path, crl, 0644))
+	future := time.Now().Add(time.Duration(len(serials)+1) * time.Minute)
+	require.Nil(t, os.Chtimes(path, future, future))
+}
+
+func TestClientChecksCRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-crl")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	caPath := filepath.Join(dir, "ca.crt")
+	require.Nil(t, ioutil.WriteFile(caPath, ca.CertPEM(), 0644))
+	crlPath := filepath.Join(dir, "ca.crl")
+	ca.writeCRL(t, crlPath, time.Now().Add(time.Hour), 100)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(fixture("secretsWithoutContent.json"))
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, 2)}}
+	server.StartTLS()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+
+	cfg := defaultClientConfig()
+	cfg.CRLFiles = []string{crlPath}
+	client, err := NewClient(cfg, caPath, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{})
+	require.Nil(t, err)
+	_, err = client.SecretList()
+	require.Nil(t, err)
+
+	// The CRL is reloaded when it changes, and new connections are refused.
+	ca.writeCRL(t, crlPath, time.Now().Add(time.Hour), 100, 2)
+	require.Nil(t, client.RebuildClient())
+	_, err = client.SecretList()
+	require.NotNil(t, err)
+	var revoked CertificateRevoked
+	require.True(t, errors.As(err, &revoked), "%v", err)
+	assert.EqualValues(t, 2, revoked.Serial.Int64())
+
+	// An unreadable CRL keeps its last good version.
+	require.Nil(t, ioutil.WriteFile(crlPath, []byte("garbage"), 0644))
+	require.Nil(t, client.RebuildClient())
+	_, err = client.SecretList()
+	assert.True(t, errors.As(err, &revoked), "%v", err)
+
+	// But it must be readable to start with.
+	_, err = NewClient(cfg, caPath, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{})
+	assert.NotNil(t, err)
+}
+
+func TestCRLRevokesOnlyFromIssuer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-crl")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	cert, err := x509.ParseCertificate(ca.issue(t, 2).Certificate[0])
+	require.Nil(t, err)
+
+	crlPath := filepath.Join(dir, "other.crl")
+	otherCA.writeCRL(t, crlPath, time.Now().Add(time.Hour), 2)
+	crl, err := ParseCRLFile(crlPath)
+	require.Nil(t, err)
+	assert.False(t, CRLRevokes(crl, cert))
+
+	ca.writeCRL(t, crlPath, time.Now().Add(time.Hour), 2)
+	crl, err = ParseCRLFile(crlPath)
+	require.Nil(t, err)
+	assert.True(t, CRLRevokes(crl, cert))
+}
+
+func TestExpiredCRLWarnedOncePerReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-crl")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	crlPath := filepath.Join(dir, "ca.crl")
+	ca.writeCRL(t, crlPath, time.Now().Add(-time.Minute), 2)
+	logger, hook := logtest.NewNullLogger()
+	crls, err := newCRLSet([]string{crlPath}, logrus.NewEntry(logger))
+	require.Nil(t, err)
+
+	warnings := func() int {
+		count := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "CRL is past its next update time" {
+				count++
+			}
+		}
+		return count
+	}
+	// Every handshake asks for the current CRLs.
+	crls.current()
+	crls.current()
+	assert.Equal(t, 1, warnings())
+
+	ca.writeCRL(t, crlPath, time.Now().Add(-time.Minute), 2, 3)
+	crls.current()
+	crls.current()
+	assert.Equal(t, 2, warnings())
+}
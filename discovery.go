@@ -0,0 +1,184 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Where a discovered client's name comes from.
+const (
+	DiscoverNameCN       = "cn"       // The certificate's common name
+	DiscoverNameSAN      = "san"      // The certificate's first DNS name, or else the last part of its first URI
+	DiscoverNameFilename = "filename" // The certificate's filename, without its extension
+)
+
+// DiscoveryConfig finds clients from their certificate files, so that each doesn't need its own yaml.
+type DiscoveryConfig struct {
+	Directory    string       `yaml:"directory"`     // Mandatory: Where to look, relative to client_directory if not absolute
+	Pattern      string       `yaml:"pattern"`       // Optional: Glob matching certificate files.  Defaults to "*.pem".
+	KeyExtension string       `yaml:"key_extension"` // Optional: A certificate's key is in the file with this extension, if there is one, and otherwise in the certificate file.  Defaults to ".key".
+	Name         string       `yaml:"name"`          // Optional: "cn" (the default), "san" or "filename"
+	Template     ClientConfig `yaml:"template"`      // Optional: Settings for every client found, such as user and group.  Its directory and mirror directories may use {{.Name}}.
+}
+
+func (d *DiscoveryConfig) setDefaults() {
+	if d.Pattern == "" {
+		d.Pattern = "*.pem"
+	}
+	if d.KeyExtension == "" {
+		d.KeyExtension = ".key"
+	}
+	if d.Name == "" {
+		d.Name = DiscoverNameCN
+	}
+}
+
+func (d *DiscoveryConfig) validate() error {
+	if d.Directory == "" {
+		return errors.New("discover needs a directory")
+	}
+	if _, err := filepath.Match(d.Pattern, ""); err != nil {
+		return fmt.Errorf("bad discover pattern '%s': %v", d.Pattern, err)
+	}
+	switch d.Name {
+	case DiscoverNameCN, DiscoverNameSAN, DiscoverNameFilename:
+	default:
+		return fmt.Errorf("unknown discover name '%s', expected cn, san or filename", d.Name)
+	}
+	if d.Template.Key != "" || d.Template.Cert != "" {
+		return errors.New("discover template can't have a key or cert")
+	}
+	if len(d.Template.Expand.Names) > 0 || d.Template.Expand.Glob != "" {
+		return errors.New("discover template can't expand")
+	}
+	return nil
+}
+
+// discoverClients returns the clients found from certificate files, by name, and the file each was found from.
+func (config *Config) discoverClients(d DiscoveryConfig) (map[string]ClientConfig, map[string]string, error) {
+	d.setDefaults()
+	if err := d.validate(); err != nil {
+		return nil, nil, err
+	}
+	directory, err := filepath.Abs(resolvePath(config.ClientsDir, d.Directory))
+	if err != nil {
+		return nil, nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(directory, d.Pattern))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(matches)
+
+	clients := map[string]ClientConfig{}
+	sources := map[string]string{}
+	for _, certFile := range matches {
+		if strings.HasSuffix(certFile, d.KeyExtension) {
+			continue
+		}
+		if info, err := os.Stat(certFile); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		name, err := discoveredName(certFile, d.Name)
+		if err != nil {
+			// One bad file, such as a CA certificate or a half-written one, shouldn't stop every client loading.
+			logrus.WithError(err).WithField("file", certFile).Warn("Skipping file that doesn't name a client")
+			continue
+		}
+		if other, ok := sources[name]; ok {
+			return nil, nil, fmt.Errorf("clients discovered from %s and %s are both named %s", other, certFile, name)
+		}
+
+		data := clientTemplateData{Name: name, File: certFile}
+		client := d.Template
+		// Copied, as setDefaults resolves them in place.
+		client.CRLFiles = append([]string(nil), d.Template.CRLFiles...)
+		if client.Mirrors, err = expandMirrors(d.Template.Mirrors, data); err != nil {
+			return nil, nil, fmt.Errorf("discovering client from %s: bad mirror template: %v", certFile, err)
+		}
+		client.Cert = certFile
+		client.Key = certFile
+		keyFile := strings.TrimSuffix(certFile, filepath.Ext(certFile)) + d.KeyExtension
+		if _, err := os.Stat(keyFile); err == nil {
+			client.Key = keyFile
+		}
+		if d.Template.DirName == "" {
+			client.DirName = name
+		} else if client.DirName, err = executeTemplate(d.Template.DirName, data); err != nil {
+			return nil, nil, fmt.Errorf("discovering client from %s: bad directory template: %v", certFile, err)
+		}
+
+		clients[name] = client
+		sources[name] = certFile
+	}
+	return clients, sources, nil
+}
+
+// discoveredName names a client from its certificate file.
+func discoveredName(certFile, source string) (string, error) {
+	var name string
+	if source == DiscoverNameFilename {
+		base := filepath.Base(certFile)
+		name = strings.TrimSuffix(base, filepath.Ext(base))
+	} else {
+		cert, err := readCertificate(certFile)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case source == DiscoverNameCN:
+			name = cert.Subject.CommonName
+		case len(cert.DNSNames) > 0:
+			name = cert.DNSNames[0]
+		case len(cert.URIs) > 0:
+			name = path.Base(cert.URIs[0].Path)
+		}
+	}
+	if name == "" || name == "." || name == ".." || name == "/" || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("no usable %s for a client name: '%s'", source, name)
+	}
+	return name, nil
+}
+
+// readCertificate reads the first certificate in a PEM file, which may also hold a key.
+func readCertificate(file string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
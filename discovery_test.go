@@ -0,0 +1,183 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// discoveryConfig returns a config whose client directory has a certs directory, with client1's certificate and key
+// in separate files as svc-a, and client2's in one file as svc-b.
+func discoveryConfig(t *testing.T) *Config {
+	dir, err := ioutil.TempDir("", "keysync-discover")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	certs := filepath.Join(dir, "certs")
+	require.Nil(t, os.Mkdir(certs, 0755))
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(certs, "svc-a.pem"), fixture("clients/client1.crt"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(certs, "svc-a.key"), fixture("clients/client1.key"), 0600))
+	combined := append(fixture("clients/client2.crt"), fixture("clients/client2.key")...)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(certs, "svc-b.pem"), combined, 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(certs, "notes.txt"), []byte("not a certificate"), 0644))
+
+	return &Config{
+		ClientsDir:    dir,
+		SecretsDir:    "/tmp/keysync-secrets",
+		YamlExt:       ".yaml",
+		ClientTimeout: "60s",
+		MinBackoff:    "100ms",
+		MaxBackoff:    "10s",
+		MaxRetries:    1,
+	}
+}
+
+func TestDiscoverClients(t *testing.T) {
+	config := discoveryConfig(t)
+	require.Nil(t, yaml.Unmarshal([]byte(`
+discover:
+  - directory: certs
+    template:
+      user: service
+      group: service
+      directory: "svc/{{.Name}}"
+      max_batch_size: 10
+      mirrors:
+        - directory: "/mirror/{{.Name}}"
+`), config))
+
+	clients, err := config.LoadClients()
+	require.Nil(t, err)
+	require.Len(t, clients, 2)
+	client1 := clients["client1"]
+	assert.Equal(t, "svc/client1", client1.DirName)
+	assert.Equal(t, "service", client1.User)
+	assert.Equal(t, 10, client1.MaxBatchSize)
+	assert.Equal(t, "60s", client1.Timeout, "Global defaults apply")
+	assert.True(t, strings.HasSuffix(client1.Cert, "certs/svc-a.pem"))
+	assert.True(t, strings.HasSuffix(client1.Key, "certs/svc-a.key"))
+	assert.True(t, filepath.IsAbs(client1.Key))
+	assert.Equal(t, []MirrorConfig{{Directory: "/mirror/client1"}}, client1.Mirrors)
+	client2 := clients["client2"]
+	assert.Equal(t, client2.Cert, client2.Key, "The key is in the certificate file")
+
+	// Named from the filename or SAN instead.
+	config.Discover[0].Name = DiscoverNameFilename
+	clients, err = config.LoadClients()
+	require.Nil(t, err)
+	assert.Equal(t, "svc/svc-a", clients["svc-a"].DirName)
+	config.Discover[0].Name = DiscoverNameSAN
+	clients, err = config.LoadClients()
+	require.Nil(t, err)
+	assert.Contains(t, clients, "client2")
+}
+
+func TestDiscoverClientsConflicts(t *testing.T) {
+	config := discoveryConfig(t)
+	config.Discover = []DiscoveryConfig{{Directory: "certs"}}
+
+	// Merged with clients configured in yaml.
+	require.Nil(t, ioutil.WriteFile(filepath.Join(config.ClientsDir, "explicit.yaml"), []byte(`
+other:
+  key: certs/svc-a.key
+  cert: certs/svc-a.pem
+`), 0644))
+	clients, err := config.LoadClients()
+	require.Nil(t, err)
+	assert.Len(t, clients, 3)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(config.ClientsDir, "explicit.yaml"), []byte(`
+client1:
+  key: certs/svc-a.key
+  cert: certs/svc-a.pem
+`), 0644))
+	_, err = config.LoadClients()
+	require.NotNil(t, err)
+	assert.Regexp(t, "client client1 discovered from .*/certs/svc-a.pem is also configured in explicit.yaml", err.Error())
+	require.Nil(t, os.Remove(filepath.Join(config.ClientsDir, "explicit.yaml")))
+
+	// Two certificates for the same client.
+	require.Nil(t, ioutil.WriteFile(filepath.Join(config.ClientsDir, "certs", "svc-c.pem"), fixture("clients/client1.crt"), 0644))
+	_, err = config.LoadClients()
+	require.NotNil(t, err)
+	assert.Regexp(t, "clients discovered from .*/svc-a.pem and .*/svc-c.pem are both named client1", err.Error())
+}
+
+func TestDiscoveryConfigValidation(t *testing.T) {
+	config := discoveryConfig(t)
+	for _, test := range []struct {
+		discovery DiscoveryConfig
+		err       string
+	}{
+		{DiscoveryConfig{}, "discover needs a directory"},
+		{DiscoveryConfig{Directory: "certs", Pattern: "["}, "bad discover pattern '[': syntax error in pattern"},
+		{DiscoveryConfig{Directory: "certs", Name: "serial"}, "unknown discover name 'serial', expected cn, san or filename"},
+		{DiscoveryConfig{Directory: "certs", Template: ClientConfig{Key: "client.key"}}, "discover template can't have a key or cert"},
+	} {
+		config.Discover = []DiscoveryConfig{test.discovery}
+		_, err := config.LoadClients()
+		require.NotNil(t, err)
+		assert.Contains(t, err.Error(), test.err)
+	}
+}
+
+func TestDiscoverClientsSkipsBadFiles(t *testing.T) {
+	config := discoveryConfig(t)
+	config.Discover = []DiscoveryConfig{{Directory: "certs"}}
+
+	// A key without a certificate, and a file that isn't PEM at all, are skipped.
+	require.Nil(t, ioutil.WriteFile(filepath.Join(config.ClientsDir, "certs", "stray.pem"), fixture("clients/client1.key"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(config.ClientsDir, "certs", "junk.pem"), []byte("junk"), 0600))
+	clients, err := config.LoadClients()
+	require.Nil(t, err)
+	assert.Len(t, clients, 2)
+
+	config.Discover[0].Pattern = "*.txt"
+	clients, err = config.LoadClients()
+	require.Nil(t, err)
+	assert.Empty(t, clients)
+}
+
+func TestDiscoverClientsWithKeyPassphrase(t *testing.T) {
+	config := discoveryConfig(t)
+	certs := filepath.Join(config.ClientsDir, "certs")
+	require.Nil(t, ioutil.WriteFile(filepath.Join(certs, "svc-a.key"), fixture("clients/client1-pkcs8.key"), 0600))
+	require.Nil(t, os.Remove(filepath.Join(certs, "svc-b.pem")))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(config.ClientsDir, "keypass.txt"), fixture("keypass.txt"), 0600))
+	require.Nil(t, yaml.Unmarshal([]byte(`
+discover:
+  - directory: certs
+    template:
+      key_passphrase:
+        file: keypass.txt
+`), config))
+
+	// The passphrase file is found relative to client_directory, as for a client configured in yaml.
+	clients, err := config.LoadClients()
+	require.Nil(t, err)
+	require.Len(t, clients, 1)
+	client1 := clients["client1"]
+	assert.Equal(t, filepath.Join(config.ClientsDir, "keypass.txt"), client1.KeyPassphrase.File)
+	_, err = LoadX509KeyPair(client1.Cert, client1.Key, client1.KeyPassphrase)
+	assert.Nil(t, err)
+}
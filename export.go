@@ -0,0 +1,203 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/square/keysync/backup"
+)
+
+// Where Export reads a client's secrets from.
+const (
+	ExportFromServer = "server" // Fetched with the client's identity, as a sync would
+	ExportFromDisk   = "disk"   // The files in the client's directory
+)
+
+// UnknownClient is returned by Export for a client that isn't configured.
+type UnknownClient struct {
+	Name string
+}
+
+func (e UnknownClient) Error() string {
+	return fmt.Sprintf("unknown client: %s", e.Name)
+}
+
+// exportedSecret is a Secret in the format BackupBundleClient reads, which is Keywhiz's own.
+type exportedSecret struct {
+	Name      string    `json:"name"`
+	Content   content   `json:"secret"`
+	Length    uint64    `json:"secretLength"`
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"creationDate"`
+	UpdatedAt time.Time `json:"updateDate"`
+	Filename  *string   `json:"filename,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	Group     string    `json:"group,omitempty"`
+}
+
+// Export returns a client's secrets as a bundle that apply-bundle or a BackupBundleClient can read.  With a
+// recipient public key, the bundle is encrypted with backup.Seal, as the bundle backend reads.  Only clients that are
+// already loaded can be exported.
+func (s *Syncer) Export(ctx context.Context, client, source string, recipient *[32]byte) ([]byte, error) {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+
+	entry, ok := s.clients[client]
+	if !ok {
+		return nil, UnknownClient{client}
+	}
+
+	var secrets []Secret
+	var err error
+	switch source {
+	case ExportFromServer:
+		secrets, err = entry.exportFromServer(ctx)
+	case ExportFromDisk:
+		secrets, err = entry.exportFromDisk(filepath.Join(s.config.SecretsDir, entry.DirName))
+	default:
+		return nil, fmt.Errorf("unknown export source '%s'", source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].Name < secrets[j].Name })
+	exported := []exportedSecret{}
+	for _, secret := range secrets {
+		exported = append(exported, exportedSecret{
+			Name:      secret.Name,
+			Content:   secret.Content,
+			Length:    uint64(len(secret.Content)),
+			Checksum:  secret.Checksum,
+			CreatedAt: secret.CreatedAt,
+			UpdatedAt: secret.UpdatedAt,
+			Filename:  secret.FilenameOverride,
+			Mode:      secret.Mode,
+			Owner:     secret.Owner,
+			Group:     secret.Group,
+		})
+	}
+	bundle, err := json.Marshal(exported)
+	if err != nil {
+		return nil, err
+	}
+	if recipient == nil {
+		return bundle, nil
+	}
+	return backup.Seal(bundle, recipient)
+}
+
+// exportFromServer fetches every secret the client can read.  Secrets deleted or forbidden since they were listed
+// are left out.
+func (entry *syncerEntry) exportFromServer(ctx context.Context) ([]Secret, error) {
+	listed, err := entry.Client.SecretListContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var filenames []string
+	for filename := range listed {
+		filenames = append(filenames, filename)
+	}
+	var secrets []Secret
+	fetched, err := entry.fetchSecrets(ctx, filenames, listed, func(filename string, secret *Secret) {
+		secrets = append(secrets, *secret)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Anything else failed, and a bundle missing secrets could do more harm than good.
+	if missing := len(filenames) - len(secrets) - len(fetched.deleted) - len(fetched.forbidden); missing > 0 {
+		return nil, fmt.Errorf("failed to fetch %d of %d secrets", missing, len(filenames))
+	}
+	return secrets, nil
+}
+
+// exportFromDisk reads the secrets in a client's directory.  Files keysync wrote and that haven't changed since get
+// their checksum, mode, owner and group from the sync state.  Others, such as every file when keysync was started
+// just to export, are described from the disk: a renamed file gets back its secret's name, its checksum is a hash of
+// its contents, and its mode, owner and group are the file's.  Aliases aren't exported, as they come from the
+// client's config rather than the server.
+func (entry *syncerEntry) exportFromDisk(directory string) ([]Secret, error) {
+	fileInfos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for name, filename := range entry.Rename {
+		names[filename] = name
+	}
+	var secrets []Secret
+	for _, fileInfo := range fileInfos {
+		filename := fileInfo.Name()
+		if !fileInfo.Mode().IsRegular() || strings.HasPrefix(filename, ".") {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(directory, filename))
+		if err != nil {
+			return nil, err
+		}
+		secret := Secret{
+			Name:      filename,
+			Content:   contents,
+			Mode:      fmt.Sprintf("%04o", fileInfo.Mode().Perm()),
+			UpdatedAt: fileInfo.ModTime(),
+		}
+		if name, ok := names[filename]; ok {
+			secret.Name = name
+		}
+		if state, ok := entry.SyncState[filename]; ok && state.ContentHash == sha256.Sum256(contents) {
+			secret.Checksum, secret.Owner, secret.Group = state.Checksum, state.Owner, state.Group
+			if state.Mode != "" {
+				secret.Mode = state.Mode
+			}
+		} else {
+			sum := sha256.Sum256(contents)
+			secret.Checksum = hex.EncodeToString(sum[:])
+			secret.Owner, secret.Group = fileOwner(fileInfo)
+		}
+		secrets = append(secrets, secret)
+	}
+	return secrets, nil
+}
+
+// fileOwner returns the names of a file's owner and group, leaving out any that can't be looked up.
+func fileOwner(fileInfo os.FileInfo) (owner, group string) {
+	stat, ok := fileInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", ""
+	}
+	if u, err := user.LookupId(strconv.Itoa(int(stat.Uid))); err == nil {
+		owner = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(int(stat.Gid))); err == nil {
+		group = g.Name
+	}
+	return owner, group
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/square/keysync/backup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestExportFromServer(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", server)
+	require.Nil(t, err)
+
+	// Exporting doesn't load clients, which could clean up removed ones.
+	_, err = syncer.Export(context.Background(), "client1", ExportFromServer, nil)
+	assert.Equal(t, UnknownClient{"client1"}, err)
+	_, err = syncer.LoadClients()
+	require.Nil(t, err)
+
+	bundle, err := syncer.Export(context.Background(), "client1", ExportFromServer, nil)
+	require.Nil(t, err)
+	secrets, err := ParseSecretList(bundle)
+	require.Nil(t, err)
+	require.Len(t, secrets, 2)
+	assert.Equal(t, "General_Password..0be68f903f8b7d86", secrets[0].Name)
+	assert.Equal(t, "Nobody_PgPass", secrets[1].Name)
+	assert.Equal(t, "0400", secrets[1].Mode)
+	assert.NotEmpty(t, secrets[1].Content)
+
+	// It's the format a bundle is read in.
+	file, err := ioutil.TempFile("", "keysync-export")
+	require.Nil(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.Write(bundle)
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+	client, err := NewBackupBundleClient(file.Name(), SecretMapping{}, logrus.NewEntry(logrus.New()))
+	require.Nil(t, err)
+	secret, err := client.Secret("Nobody_PgPass")
+	require.Nil(t, err)
+	assert.Equal(t, secrets[1].Content, secret.Content)
+
+	_, err = syncer.Export(context.Background(), "nonexistent", ExportFromServer, nil)
+	assert.Equal(t, UnknownClient{"nonexistent"}, err)
+}
+
+func TestExportEncrypted(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", server)
+	require.Nil(t, err)
+	_, err = syncer.LoadClients()
+	require.Nil(t, err)
+
+	pubkey, privkey, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	sealed, err := syncer.Export(context.Background(), "client1", ExportFromServer, pubkey)
+	require.Nil(t, err)
+	bundle, err := backup.Open(sealed, privkey[:])
+	require.Nil(t, err)
+	secrets, err := ParseSecretList(bundle)
+	require.Nil(t, err)
+	assert.Len(t, secrets, 2)
+}
+
+func TestExportFromDisk(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", server)
+	require.Nil(t, err)
+	_, err = syncer.LoadClients()
+	require.Nil(t, err)
+
+	secretsDir, err := ioutil.TempDir("", "keysync-export")
+	require.Nil(t, err)
+	defer os.RemoveAll(secretsDir)
+	syncer.config.SecretsDir = secretsDir
+	clientDir := filepath.Join(secretsDir, syncer.clients["client1"].DirName)
+	require.Nil(t, os.MkdirAll(clientDir, 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(clientDir, "synced"), []byte("synced"), 0400))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(clientDir, "edited"), []byte("edited"), 0440))
+	require.Nil(t, os.Symlink("synced", filepath.Join(clientDir, "alias")))
+	syncer.clients["client1"].SyncState["synced"] = secretState{
+		ContentHash: sha256.Sum256([]byte("synced")), Checksum: "ABCD", Owner: "nobody", Mode: "0400",
+	}
+	syncer.clients["client1"].SyncState["edited"] = secretState{Checksum: "EF01", Owner: "nobody"}
+
+	bundle, err := syncer.Export(context.Background(), "client1", ExportFromDisk, nil)
+	require.Nil(t, err)
+	secrets, err := ParseSecretList(bundle)
+	require.Nil(t, err)
+	require.Len(t, secrets, 2)
+	assert.Equal(t, "edited", secrets[0].Name)
+	assert.Equal(t, "0440", secrets[0].Mode)
+	// Changed on disk, so the sync state doesn't apply.
+	sum := sha256.Sum256([]byte("edited"))
+	assert.Equal(t, hex.EncodeToString(sum[:]), secrets[0].Checksum)
+	current, err := user.Current()
+	require.Nil(t, err)
+	assert.Equal(t, current.Username, secrets[0].Owner)
+	assert.Equal(t, "synced", secrets[1].Name)
+	assert.Equal(t, "ABCD", secrets[1].Checksum)
+	assert.Equal(t, "nobody", secrets[1].Owner)
+	assert.EqualValues(t, "synced", secrets[1].Content)
+}
+
+func TestAPIExport(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", server)
+	require.Nil(t, err)
+	_, err = syncer.LoadClients()
+	require.Nil(t, err)
+	api := &APIServer{syncer: syncer, logger: logrus.NewEntry(logrus.New())}
+
+	export := func(client string, query url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/export/"+client+"?"+query.Encode(), nil)
+		req = mux.SetURLVars(req, map[string]string{"client": client})
+		recorder := httptest.NewRecorder()
+		api.export(recorder, req)
+		return recorder
+	}
+
+	pubkey, privkey, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	recipient := base64.StdEncoding.EncodeToString(pubkey[:])
+	res := export("client1", url.Values{"recipient": {recipient}})
+	require.Equal(t, http.StatusOK, res.Code)
+	bundle, err := backup.Open(res.Body.Bytes(), privkey[:])
+	require.Nil(t, err)
+	secrets, err := ParseSecretList(bundle)
+	require.Nil(t, err)
+	assert.Len(t, secrets, 2)
+
+	// Secrets are never sent in the clear.
+	var status StatusResponse
+	res = export("client1", url.Values{})
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &status))
+	assert.Equal(t, "a recipient public key is required", status.Message)
+
+	res = export("nonexistent", url.Values{"recipient": {recipient}})
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &status))
+	assert.Equal(t, "unknown client: nonexistent", status.Message)
+
+	res = export("client1", url.Values{"recipient": {"bm90IGEga2V5"}})
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = export("client1", url.Values{"source": {"tape"}, "recipient": {recipient}})
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
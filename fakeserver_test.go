@@ -0,0 +1,74 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/square/keysync/keywhiztest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyncAgainstFakeKeywhiz(t *testing.T) {
+	tlsConfig, err := keywhiztest.TLSConfig(testCaFile, testCaFile, "fixtures/CA/cacert.crt")
+	require.Nil(t, err)
+	fake := keywhiztest.New(
+		keywhiztest.Secret{Name: "one", Content: []byte("first")},
+		keywhiztest.Secret{Name: "two", Content: []byte("second")},
+		keywhiztest.Secret{Name: "hidden", Content: []byte("not for client1")},
+	)
+	fake.Allow("client1", "one", "two")
+	server := fake.StartTLS(tlsConfig)
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	require.Nil(t, err)
+	clientConfig := defaultClientConfig()
+	clientConfig.MaxRetries = 3
+	client, err := NewClient(clientConfig, testCaFile, serverURL, testLogger(), metricsForTest())
+	require.Nil(t, err)
+	collection := NewMemoryOutputCollection()
+	output, err := collection.NewOutput(testClientConfig("client1"), testLogger())
+	require.Nil(t, err)
+	entry := &syncerEntry{client, ClientConfig{}, output, map[string]secretState{}}
+
+	updated, err := entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Added: 2}, updated)
+	_, ok := collection.Secret("client1", "hidden")
+	assert.False(t, ok)
+
+	// A change between polls, with the listing failing once first.
+	fake.Set(keywhiztest.Secret{Name: "one", Content: []byte("edited")})
+	fake.Inject(keywhiztest.Fault{Path: "/secrets", Status: http.StatusServiceUnavailable, Times: 1})
+	updated, err = entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Changed: 1}, updated)
+	secret, ok := collection.Secret("client1", "one")
+	require.True(t, ok)
+	assert.EqualValues(t, "edited", secret.Content)
+
+	// Deleted after it was listed but before it was fetched.
+	fake.Set(keywhiztest.Secret{Name: "two", Content: []byte("edited")})
+	fake.DeleteAfterList("two")
+	updated, err = entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Deleted: 1}, updated)
+	_, ok = collection.Secret("client1", "two")
+	assert.False(t, ok)
+}
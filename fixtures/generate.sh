@@ -13,4 +13,7 @@ for client in client1 client2 client3 client4; do
      certstrap --depot-path clients sign --years 30 --CA ../CA/cacert ${client}
      rm -f clients/${client}.csr
      git add clients/${client}.crt clients/${client}.key
-done
\ No newline at end of file
+done
+# Encrypt client1's key with the passphrase in keypass.txt, as PKCS#8 and as legacy encrypted PEM
+openssl pkcs8 -topk8 -in clients/client1.key -v2 aes-256-cbc -v2prf hmacWithSHA256 -passout file:keypass.txt -out clients/client1-pkcs8.key
+openssl rsa -in clients/client1.key -aes128 -traditional -passout file:keypass.txt -out clients/client1-legacy.key
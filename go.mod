@@ -10,15 +10,15 @@ require (
 	github.com/getsentry/raven-go v0.2.0
 	github.com/gorilla/mux v1.8.0
 	github.com/jpillora/backoff v0.0.0-20180909062703-3050d21c67d7
-	github.com/kr/pretty v0.1.0 // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/rcrowley/go-metrics v0.0.0-20181016184325-3113b8401b8a
 	github.com/sirupsen/logrus v1.7.0
+	github.com/spiffe/go-spiffe/v2 v2.1.6
 	github.com/square/go-sq-metrics v0.0.0-20170531223841-ae72f332d0d9
-	github.com/stretchr/testify v1.7.2
-	golang.org/x/crypto v0.0.0-20190829043050-9756ffdc2472
-	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad
+	github.com/stretchr/testify v1.8.2
+	golang.org/x/crypto v0.6.0
+	golang.org/x/sys v0.5.0
+	google.golang.org/grpc v1.53.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
-	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/yaml.v2 v2.4.0
 )
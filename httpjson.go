@@ -0,0 +1,457 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// HTTPConfig describes a JSON-over-HTTP secret server, for a client with backend: http.  List and Get are
+// text/template URLs relative to URL.  List is given {{.Page}} and {{.Cursor}}, and Get is given {{.Name}}.  The
+// template functions pathescape and queryescape escape a value for a path segment or query parameter.
+type HTTPConfig struct {
+	URL             string         `yaml:"url"`              // Mandatory: The server, such as https://secrets.example.com:8443
+	List            string         `yaml:"list"`             // Mandatory: Lists secrets, such as /v1/secrets?page={{.Page}}
+	Get             string         `yaml:"get"`              // Mandatory: Gets one secret, such as /v1/secrets/{{pathescape .Name}}
+	Items           string         `yaml:"items"`            // Where the secrets are in a list response.  Defaults to the whole response.
+	Item            string         `yaml:"item"`             // Where the secret is in a get response.  Defaults to the whole response.
+	Fields          HTTPFields     `yaml:"fields"`           // Where each of a secret's fields are
+	ContentEncoding string         `yaml:"content_encoding"` // "base64" if contents are base64-encoded, unless a secret's encoding field says otherwise
+	Pagination      HTTPPagination `yaml:"pagination"`
+}
+
+// HTTPFields are the paths to a secret's fields, within each item.  A path is a series of object keys and array
+// indexes, such as "metadata.mode" or "$.versions[0].value".
+type HTTPFields struct {
+	Name     string `yaml:"name"`     // Mandatory
+	Content  string `yaml:"content"`  // Mandatory
+	Encoding string `yaml:"encoding"` // "base64" for a secret with base64-encoded contents
+	Checksum string `yaml:"checksum"` // Anything that changes with the contents, such as a version.  Defaults to a hash of the contents.
+	Mode     string `yaml:"mode"`
+	Owner    string `yaml:"owner"`
+	Group    string `yaml:"group"`
+	Filename string `yaml:"filename"`
+}
+
+// HTTPPagination says how to fetch more than one page of a listing.  With neither set, a listing is one request.
+type HTTPPagination struct {
+	Cursor   string `yaml:"cursor"`    // Where the next page's {{.Cursor}} is in a list response.  A missing or empty cursor is the last page.
+	Pages    bool   `yaml:"pages"`     // Request {{.Page}} 1, 2, 3... until a page has no secrets
+	MaxPages int    `yaml:"max_pages"` // Give up on a listing longer than this.  Defaults to 1000.
+}
+
+func (h *HTTPConfig) setDefaults() {
+	if h.Pagination.MaxPages == 0 {
+		h.Pagination.MaxPages = 1000
+	}
+}
+
+func (h HTTPConfig) validate() error {
+	if h.URL == "" || h.List == "" || h.Get == "" {
+		return errors.New("http backend needs http.url, http.list and http.get")
+	}
+	if _, err := url.Parse(h.URL); err != nil {
+		return fmt.Errorf("bad http.url '%s': %v", h.URL, err)
+	}
+	if h.Fields.Name == "" || h.Fields.Content == "" {
+		return errors.New("http backend needs http.fields.name and http.fields.content")
+	}
+	if h.ContentEncoding != "" && h.ContentEncoding != "base64" {
+		return fmt.Errorf("unknown http.content_encoding '%s'", h.ContentEncoding)
+	}
+	if h.Pagination.Cursor != "" && h.Pagination.Pages {
+		return errors.New("http.pagination can use a cursor or pages, not both")
+	}
+	if _, _, err := h.templates(); err != nil {
+		return err
+	}
+	return nil
+}
+
+var httpTemplateFuncs = template.FuncMap{
+	"pathescape":  url.PathEscape,
+	"queryescape": url.QueryEscape,
+}
+
+func (h HTTPConfig) templates() (list, get *template.Template, err error) {
+	if list, err = template.New("list").Funcs(httpTemplateFuncs).Parse(h.List); err != nil {
+		return nil, nil, fmt.Errorf("bad http.list: %v", err)
+	}
+	if get, err = template.New("get").Funcs(httpTemplateFuncs).Parse(h.Get); err != nil {
+		return nil, nil, fmt.Errorf("bad http.get: %v", err)
+	}
+	return list, get, nil
+}
+
+// httpTemplateData is what's available to the URL templates.
+type httpTemplateData struct {
+	Name   string
+	Page   int
+	Cursor string
+}
+
+// HTTPJSONClient reads secrets from a server with a JSON API other than Keywhiz's, as described by an HTTPConfig.
+type HTTPJSONClient struct {
+	// The server is reached with a Keywhiz client's TLS settings, retries and backoff.
+	transport *KeywhizHTTPClient
+	config    HTTPConfig
+	list, get *template.Template
+	mapping   SecretMapping
+	logger    *logrus.Entry
+}
+
+// NewHTTPJSONClient returns a client for the server in cfg.HTTP.
+func NewHTTPJSONClient(cfg *ClientConfig, caFile string, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) (Client, error) {
+	config := cfg.HTTP
+	config.setDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	list, get, err := config.templates()
+	if err != nil {
+		return nil, err
+	}
+	baseURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := NewClientWithServers(cfg, caFile, singleServerPool(baseURL, metricsHandle), logger, metricsHandle)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPJSONClient{
+		transport: transport.(*KeywhizHTTPClient),
+		config:    config,
+		list:      list,
+		get:       get,
+		mapping:   cfg.SecretMapping,
+		logger:    logger.WithField("logger", "http_json_client"),
+	}, nil
+}
+
+// httpStatusError is returned for a response other than 200.
+type httpStatusError struct {
+	StatusCode int
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("server responded %d", e.StatusCode)
+}
+
+// fetch GETs the URL from a template, and decodes the JSON response.
+func (c *HTTPJSONClient) fetch(ctx context.Context, tmpl *template.Template, data httpTemplateData) (interface{}, error) {
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, fmt.Errorf("expanding %s url: %v", tmpl.Name(), err)
+	}
+	ref, err := url.Parse(rendered.String())
+	if err != nil {
+		return nil, fmt.Errorf("bad %s url '%s': %v", tmpl.Name(), rendered.String(), err)
+	}
+
+	now := time.Now()
+	resp, err := c.transport.doWithRetry(ctx, "GET", ref.Path, func(serverURL *url.URL) (*http.Request, error) {
+		target := *serverURL
+		target.Path = path.Join(serverURL.Path, ref.Path)
+		if ref.RawPath != "" {
+			// Keep escaped slashes in names, such as from pathescape.
+			target.RawPath = path.Join(serverURL.EscapedPath(), ref.RawPath)
+		}
+		target.RawQuery = ref.RawQuery
+		return http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	c.logger.Infof("GET %s %d %v", rendered.String(), resp.StatusCode, time.Since(now))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpStatusError{resp.StatusCode}
+	}
+	return decodeJSON(body)
+}
+
+// decodeJSON decodes into generic values, keeping numbers as written so a numeric version is a usable checksum.
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("decoding response: %v", err)
+	}
+	return value, nil
+}
+
+// lookupJSON follows a path of object keys and array indexes, such as "$.data.items[0].name", into a decoded JSON
+// value.  An empty path, or "$", is the value itself.
+func lookupJSON(value interface{}, jsonPath string) (interface{}, bool) {
+	jsonPath = strings.TrimPrefix(strings.TrimPrefix(jsonPath, "$"), ".")
+	if jsonPath == "" {
+		return value, true
+	}
+	// "a.b[1][2]" is walked as the keys and indexes a, b, [1], [2].
+	for _, part := range strings.Split(strings.Replace(jsonPath, "[", ".[", -1), ".") {
+		if part == "" {
+			continue
+		}
+		if strings.HasPrefix(part, "[") && strings.HasSuffix(part, "]") {
+			index, err := strconv.Atoi(part[1 : len(part)-1])
+			array, ok := value.([]interface{})
+			if err != nil || !ok || index < 0 || index >= len(array) {
+				return nil, false
+			}
+			value = array[index]
+			continue
+		}
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// stringField returns the field at a path as a string.  Missing fields and nulls are empty.
+func stringField(item interface{}, jsonPath string) (string, error) {
+	if jsonPath == "" {
+		return "", nil
+	}
+	value, ok := lookupJSON(item, jsonPath)
+	if !ok || value == nil {
+		return "", nil
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("field %s is not a string or number", jsonPath)
+}
+
+// secret builds a Secret from an item of a response, with its contents if withContent is set.
+func (c *HTTPJSONClient) secret(item interface{}, withContent bool) (*Secret, error) {
+	fields := c.config.Fields
+	var secret Secret
+	var value, encoding, filename string
+	var err error
+	for _, field := range []struct {
+		path string
+		dest *string
+	}{
+		{fields.Name, &secret.Name},
+		{fields.Content, &value},
+		{fields.Encoding, &encoding},
+		{fields.Checksum, &secret.Checksum},
+		{fields.Mode, &secret.Mode},
+		{fields.Owner, &secret.Owner},
+		{fields.Group, &secret.Group},
+		{fields.Filename, &filename},
+	} {
+		if *field.dest, err = stringField(item, field.path); err != nil {
+			return nil, err
+		}
+	}
+	if secret.Name == "" {
+		return nil, fmt.Errorf("secret has no %s", fields.Name)
+	}
+	if filename != "" {
+		secret.FilenameOverride = &filename
+	}
+
+	if encoding == "" {
+		encoding = c.config.ContentEncoding
+	}
+	contents := []byte(value)
+	if encoding == "base64" {
+		if contents, err = base64.StdEncoding.DecodeString(value); err != nil {
+			return nil, fmt.Errorf("secret %v is not valid base64: %v", secret.Name, err)
+		}
+	}
+	if secret.Checksum == "" && len(contents) > 0 {
+		// Without a checksum, changes are spotted by hashing the contents.
+		sum := sha256.Sum256(contents)
+		secret.Checksum = hex.EncodeToString(sum[:])
+	}
+	if withContent {
+		secret.Content = contents
+		secret.Length = uint64(len(contents))
+	}
+	return &secret, nil
+}
+
+// Secret returns a secret, with its contents.
+func (c *HTTPJSONClient) Secret(name string) (*Secret, error) {
+	return c.SecretContext(context.Background(), name)
+}
+
+// SecretContext is Secret, returning early if ctx is done.
+func (c *HTTPJSONClient) SecretContext(ctx context.Context, name string) (*Secret, error) {
+	secret, err := c.readSecret(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !c.mapping.apply(secret) {
+		return nil, fmt.Errorf("secret %v is excluded by client config", name)
+	}
+	return secret, nil
+}
+
+func (c *HTTPJSONClient) readSecret(ctx context.Context, name string) (*Secret, error) {
+	response, err := c.fetch(ctx, c.get, httpTemplateData{Name: name})
+	var statusErr httpStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusNotFound:
+			c.logger.Warnf("Secret %v not found", name)
+			return nil, SecretDeleted{}
+		case http.StatusForbidden:
+			c.logger.Warnf("Secret %v is forbidden to this client", name)
+			return nil, SecretForbidden{}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	item, ok := lookupJSON(response, c.config.Item)
+	if !ok {
+		return nil, fmt.Errorf("no %s in response for secret %v", c.config.Item, name)
+	}
+	return c.secret(item, true)
+}
+
+// SecretList returns every secret this client can see, without their contents.
+func (c *HTTPJSONClient) SecretList() (map[string]Secret, error) {
+	return c.SecretListContext(context.Background())
+}
+
+// SecretListContext lists secrets, following pagination.  If list items have contents but no checksum field, a hash
+// of the contents is used as their checksum; if they have neither, the listed checksum never matches the one synced,
+// so every such secret is fetched again on each sync.
+func (c *HTTPJSONClient) SecretListContext(ctx context.Context) (map[string]Secret, error) {
+	secrets, err := c.listSecrets(ctx)
+	if err != nil {
+		c.transport.failCountInc()
+		return nil, fmt.Errorf("error listing secrets: %w", err)
+	}
+	c.transport.markSuccess()
+	return secretsByFilename(secrets, &c.mapping)
+}
+
+func (c *HTTPJSONClient) listSecrets(ctx context.Context) ([]Secret, error) {
+	pagination := c.config.Pagination
+	var secrets []Secret
+	data := httpTemplateData{Page: 1}
+	for ; data.Page <= pagination.MaxPages; data.Page++ {
+		response, err := c.fetch(ctx, c.list, data)
+		if err != nil {
+			return nil, err
+		}
+		value, ok := lookupJSON(response, c.config.Items)
+		items, isArray := value.([]interface{})
+		if !ok || (value != nil && !isArray) {
+			return nil, fmt.Errorf("no list of secrets at %s in page %d", c.config.Items, data.Page)
+		}
+		for _, item := range items {
+			secret, err := c.secret(item, false)
+			if err != nil {
+				return nil, fmt.Errorf("page %d: %v", data.Page, err)
+			}
+			secrets = append(secrets, *secret)
+		}
+
+		switch {
+		case pagination.Cursor != "":
+			if data.Cursor, err = stringField(response, pagination.Cursor); err != nil {
+				return nil, err
+			}
+			if data.Cursor == "" {
+				return secrets, nil
+			}
+		case pagination.Pages:
+			if len(items) == 0 {
+				return secrets, nil
+			}
+		default:
+			return secrets, nil
+		}
+	}
+	return nil, fmt.Errorf("listing has more than %d pages", pagination.MaxPages)
+}
+
+// SecretListWithContents returns the given secrets with their contents, keyed by filename.
+func (c *HTTPJSONClient) SecretListWithContents(secrets []string) (map[string]Secret, error) {
+	return c.SecretListWithContentsContext(context.Background(), secrets)
+}
+
+// SecretListWithContentsContext gets each secret in turn.  Like Keywhiz, it fails if any secret can't be read.
+func (c *HTTPJSONClient) SecretListWithContentsContext(ctx context.Context, secrets []string) (map[string]Secret, error) {
+	list, err := readEach(ctx, secrets, c.readSecret)
+	if err != nil {
+		c.transport.failCountInc()
+		return nil, err
+	}
+	c.transport.markSuccess()
+	return secretsByFilename(list, &c.mapping)
+}
+
+// Logger returns the logger for this client.
+func (c *HTTPJSONClient) Logger() *logrus.Entry {
+	return c.logger
+}
+
+// RebuildClient picks up a changed client certificate or CA.
+func (c *HTTPJSONClient) RebuildClient() error {
+	return c.transport.RebuildClient()
+}
+
+// Close releases anything the client holds open, such as a workload API stream.
+func (c *HTTPJSONClient) Close() error {
+	return c.transport.Close()
+}
+
+// certNotAfter returns the expiry of the client certificate currently in use.
+func (c *HTTPJSONClient) certNotAfter() time.Time {
+	return c.transport.certNotAfter()
+}
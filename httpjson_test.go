@@ -0,0 +1,284 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type jsonStubSecret struct {
+	value   string
+	version int
+	mode    string
+}
+
+// jsonStub is a secret server with its own JSON schema: listings are paged by cursor or page number, two at a
+// time, and values are base64-encoded.
+type jsonStub struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	secrets  map[string]*jsonStubSecret
+	denied   map[string]bool
+	requests []string
+}
+
+func newJSONStub() *jsonStub {
+	s := &jsonStub{secrets: map[string]*jsonStubSecret{}, denied: map[string]bool{}}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.serve))
+	s.TLS = testCerts(testCaFile)
+	s.TLS.ClientAuth = tls.RequireAnyClientCert
+	s.StartTLS()
+	return s
+}
+
+func (s *jsonStub) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+
+	meta := func(secret *jsonStubSecret) map[string]interface{} {
+		return map[string]interface{}{"version": secret.version, "mode": secret.mode}
+	}
+	switch {
+	case r.URL.Path == "/api/secrets":
+		var names []string
+		for name := range s.secrets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		start := 0
+		if cursor := r.URL.Query().Get("after"); cursor != "" {
+			start = sort.SearchStrings(names, cursor) + 1
+		}
+		if page := r.URL.Query().Get("page"); page != "" {
+			n, _ := strconv.Atoi(page)
+			start = (n - 1) * 2
+		}
+		if start > len(names) {
+			start = len(names)
+		}
+		end := start + 2
+		if end > len(names) {
+			end = len(names)
+		}
+		items := []interface{}{}
+		for _, name := range names[start:end] {
+			items = append(items, map[string]interface{}{"id": name, "meta": meta(s.secrets[name])})
+		}
+		response := map[string]interface{}{"result": map[string]interface{}{"items": items}}
+		if end < len(names) {
+			response["next"] = names[end-1]
+		}
+		json.NewEncoder(w).Encode(response)
+
+	case strings.HasPrefix(r.URL.EscapedPath(), "/api/secrets/"):
+		name, _ := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/api/secrets/"))
+		secret, ok := s.secrets[name]
+		if s.denied[name] {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"secret": map[string]interface{}{
+			"id":    name,
+			"value": base64.StdEncoding.EncodeToString([]byte(secret.value)),
+			"meta":  meta(secret),
+		}})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func jsonStubConfig(address string) HTTPConfig {
+	return HTTPConfig{
+		URL:   address,
+		List:  "/api/secrets{{if .Cursor}}?after={{queryescape .Cursor}}{{end}}",
+		Get:   "/api/secrets/{{pathescape .Name}}",
+		Items: "result.items",
+		Item:  "secret",
+		Fields: HTTPFields{
+			Name:     "id",
+			Content:  "value",
+			Checksum: "meta.version",
+			Mode:     "$.meta.mode",
+		},
+		ContentEncoding: "base64",
+		Pagination:      HTTPPagination{Cursor: "next"},
+	}
+}
+
+func newHTTPJSONClientForTest(t *testing.T, config HTTPConfig) *HTTPJSONClient {
+	cfg := defaultClientConfig()
+	cfg.Backend = BackendHTTP
+	cfg.HTTP = config
+	client, err := NewHTTPJSONClient(cfg, testCaFile, logrus.NewEntry(logrus.New()), metricsForTest())
+	require.Nil(t, err)
+	return client.(*HTTPJSONClient)
+}
+
+func TestLookupJSON(t *testing.T) {
+	value, err := decodeJSON([]byte(`{"a": {"b": [{"c": 1}, {"c": "two"}]}, "d": null}`))
+	require.Nil(t, err)
+
+	for jsonPath, expected := range map[string]interface{}{
+		"a.b[1].c":   "two",
+		"$.a.b[0].c": json.Number("1"),
+		"d":          nil,
+	} {
+		found, ok := lookupJSON(value, jsonPath)
+		assert.True(t, ok, jsonPath)
+		assert.Equal(t, expected, found, jsonPath)
+	}
+	for _, jsonPath := range []string{"a.x", "a.b[2]", "a.b.c", "a[0]"} {
+		_, ok := lookupJSON(value, jsonPath)
+		assert.False(t, ok, jsonPath)
+	}
+	root, ok := lookupJSON(value, "$")
+	assert.True(t, ok)
+	assert.Equal(t, value, root)
+}
+
+func TestHTTPJSONClientListsWithCursor(t *testing.T) {
+	stub := newJSONStub()
+	defer stub.Close()
+	stub.secrets["api_key"] = &jsonStubSecret{value: "k3y", version: 3, mode: "0400"}
+	stub.secrets["db_password"] = &jsonStubSecret{value: "hunter2", version: 1}
+	stub.secrets["tls.key"] = &jsonStubSecret{value: "key", version: 7}
+
+	client := newHTTPJSONClientForTest(t, jsonStubConfig(stub.URL))
+	list, err := client.SecretList()
+	require.Nil(t, err)
+	require.Len(t, list, 3)
+	assert.Equal(t, "3", list["api_key"].Checksum)
+	assert.Equal(t, "0400", list["api_key"].Mode)
+	assert.Empty(t, list["api_key"].Content)
+	assert.Equal(t, []string{"/api/secrets", "/api/secrets?after=db_password"}, stub.requests)
+
+	secret, err := client.Secret("db_password")
+	require.Nil(t, err)
+	assert.EqualValues(t, "hunter2", secret.Content)
+	assert.Equal(t, "1", secret.Checksum)
+
+	stub.denied["api_key"] = true
+	_, err = client.Secret("api_key")
+	assert.IsType(t, SecretForbidden{}, err)
+	_, err = client.Secret("missing")
+	assert.IsType(t, SecretDeleted{}, err)
+	_, err = client.SecretListWithContents([]string{"db_password", "missing"})
+	assert.Equal(t, BatchError{StatusCode: 404, Message: "secret missing not found"}, err)
+}
+
+func TestHTTPJSONClientPages(t *testing.T) {
+	stub := newJSONStub()
+	defer stub.Close()
+	for _, name := range []string{"a", "b", "c"} {
+		stub.secrets[name] = &jsonStubSecret{value: name}
+	}
+
+	config := jsonStubConfig(stub.URL)
+	config.List = "/api/secrets?page={{.Page}}"
+	config.Fields.Checksum = ""
+	config.Pagination = HTTPPagination{Pages: true}
+	client := newHTTPJSONClientForTest(t, config)
+	list, err := client.SecretList()
+	require.Nil(t, err)
+	assert.Len(t, list, 3)
+	assert.Equal(t, []string{"/api/secrets?page=1", "/api/secrets?page=2", "/api/secrets?page=3"}, stub.requests)
+
+	// Without a checksum or contents in the listing, there's nothing to detect changes with.
+	assert.Empty(t, list["a"].Checksum)
+	// But a fetched secret gets a hash of its contents.
+	secret, err := client.Secret("a")
+	require.Nil(t, err)
+	assert.Len(t, secret.Checksum, 64)
+
+	config.Pagination.MaxPages = 2
+	client = newHTTPJSONClientForTest(t, config)
+	_, err = client.SecretList()
+	assert.EqualError(t, err, "error listing secrets: listing has more than 2 pages")
+}
+
+func TestHTTPJSONClientEscapesNames(t *testing.T) {
+	stub := newJSONStub()
+	defer stub.Close()
+	stub.secrets["team/db password"] = &jsonStubSecret{value: "hunter2", version: 1}
+
+	client := newHTTPJSONClientForTest(t, jsonStubConfig(stub.URL))
+	secret, err := client.Secret("team/db password")
+	require.Nil(t, err)
+	assert.EqualValues(t, "hunter2", secret.Content)
+	assert.Equal(t, "/api/secrets/team%2Fdb%20password", stub.requests[0])
+}
+
+func TestHTTPJSONClientSyncs(t *testing.T) {
+	stub := newJSONStub()
+	defer stub.Close()
+	for _, name := range []string{"one", "two", "three"} {
+		stub.secrets[name] = &jsonStubSecret{value: name, version: 1}
+	}
+
+	client := newHTTPJSONClientForTest(t, jsonStubConfig(stub.URL))
+	output := &InMemoryOutput{Secrets: map[string]Secret{}, logger: logrus.NewEntry(logrus.New())}
+	entry := &syncerEntry{client, ClientConfig{}, output, map[string]secretState{}}
+	updated, err := entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Added: 3}, updated)
+	assert.EqualValues(t, "two", output.Secrets["two"].Content)
+
+	delete(stub.secrets, "two")
+	updated, err = entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Deleted: 1}, updated)
+}
+
+func TestHTTPConfigValidation(t *testing.T) {
+	cfg := &Config{SecretsDir: "/tmp/keysync-secrets"}
+	client := ClientConfig{Key: clientKey, Backend: BackendHTTP}
+	assert.EqualError(t, client.validate(cfg), "http backend needs http.url, http.list and http.get")
+
+	client.HTTP = jsonStubConfig("https://secrets.example.com")
+	assert.Nil(t, client.validate(cfg))
+
+	client.HTTP.Get = "/api/secrets/{{.Name"
+	assert.Error(t, client.validate(cfg))
+
+	client.HTTP = jsonStubConfig("https://secrets.example.com")
+	client.HTTP.Pagination.Pages = true
+	assert.EqualError(t, client.validate(cfg), "http.pagination can use a cursor or pages, not both")
+
+	client.HTTP = jsonStubConfig("https://secrets.example.com")
+	client.HTTP.ContentEncoding = "hex"
+	assert.EqualError(t, client.validate(cfg), "unknown http.content_encoding 'hex'")
+}
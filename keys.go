@@ -0,0 +1,260 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// KeyPassphrase says where to read the passphrase for an encrypted private key.  Exactly one source may be set.
+type KeyPassphrase struct {
+	File string `yaml:"file"` // Read from this file, without a trailing newline
+	Env  string `yaml:"env"`  // Read from this environment variable
+	FD   *int   `yaml:"fd"`   // Read from this inherited file descriptor, such as a pipe from a secret manager
+}
+
+// fdPassphrases caches passphrases read from file descriptors, which can only be read once.
+var fdPassphrases = struct {
+	sync.Mutex
+	byFD map[int][]byte
+}{byFD: map[int][]byte{}}
+
+func (p KeyPassphrase) validate() error {
+	sources := 0
+	for _, set := range []bool{p.File != "", p.Env != "", p.FD != nil} {
+		if set {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return errors.New("only one of file, env and fd may be set for key_passphrase")
+	}
+	return nil
+}
+
+// read returns the passphrase.
+func (p KeyPassphrase) read() ([]byte, error) {
+	switch {
+	case p.File != "":
+		data, err := ioutil.ReadFile(p.File)
+		if err != nil {
+			return nil, fmt.Errorf("reading key passphrase: %v", err)
+		}
+		return bytes.TrimSuffix(bytes.TrimSuffix(data, []byte("\n")), []byte("\r")), nil
+	case p.Env != "":
+		passphrase, ok := os.LookupEnv(p.Env)
+		if !ok {
+			return nil, fmt.Errorf("key passphrase environment variable %s is not set", p.Env)
+		}
+		return []byte(passphrase), nil
+	case p.FD != nil:
+		fdPassphrases.Lock()
+		defer fdPassphrases.Unlock()
+		if passphrase, ok := fdPassphrases.byFD[*p.FD]; ok {
+			return passphrase, nil
+		}
+		file := os.NewFile(uintptr(*p.FD), "key-passphrase")
+		if file == nil {
+			return nil, fmt.Errorf("invalid key passphrase file descriptor %d", *p.FD)
+		}
+		data, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading key passphrase from fd %d: %v", *p.FD, err)
+		}
+		passphrase := bytes.TrimSuffix(data, []byte("\n"))
+		fdPassphrases.byFD[*p.FD] = passphrase
+		return passphrase, nil
+	}
+	return nil, errors.New("key is encrypted, but no key_passphrase is configured")
+}
+
+// LoadX509KeyPair is tls.LoadX509KeyPair, also accepting a key encrypted as PKCS#8 or legacy encrypted PEM.
+// The decrypted key is only held in memory.
+func LoadX509KeyPair(certFile, keyFile string, passphrase KeyPassphrase) (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	rest := keyPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			// No encrypted key, so let the tls package handle it as usual.
+			return tls.X509KeyPair(certPEM, keyPEM)
+		}
+		if block.Type != "ENCRYPTED PRIVATE KEY" && !x509.IsEncryptedPEMBlock(block) {
+			continue
+		}
+
+		pass, err := passphrase.read()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		decrypted, err := decryptPEMBlock(block, pass)
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("decrypting key %s: %v", keyFile, err)
+		}
+		return tls.X509KeyPair(certPEM, pem.EncodeToMemory(decrypted))
+	}
+}
+
+// decryptPEMBlock returns a decrypted copy of a PKCS#8 or legacy encrypted PEM block.
+func decryptPEMBlock(block *pem.Block, passphrase []byte) (*pem.Block, error) {
+	if x509.IsEncryptedPEMBlock(block) {
+		// Legacy PEM encryption is deprecated as insecure, but keys encrypted that way are still common.
+		der, err := x509.DecryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: block.Type, Bytes: der}, nil
+	}
+	der, err := decryptPKCS8(block.Bytes, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+}
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+)
+
+// ASN.1 structures from RFC 5208 and RFC 8018.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkixAlgorithm
+	EncryptedData []byte
+}
+
+type pkixAlgorithm struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue `asn1:"optional"`
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkixAlgorithm
+	EncryptionScheme  pkixAlgorithm
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int           `asn1:"optional"`
+	PRF            pkixAlgorithm `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts an EncryptedPrivateKeyInfo using PBES2, with PBKDF2 and AES-CBC or 3DES-CBC.  These are what
+// OpenSSL produces by default.  It returns a PKCS#8 PrivateKeyInfo.
+func decryptPKCS8(der, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("parsing encrypted PKCS#8: %v", err)
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported PKCS#8 encryption %v, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("parsing PBES2 parameters: %v", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation function %v", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("parsing PBKDF2 parameters: %v", err)
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil, kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("unsupported PBKDF2 PRF %v", kdf.PRF.Algorithm)
+	}
+
+	var keyLength int
+	var newCipher func([]byte) (cipher.Block, error)
+	scheme := params.EncryptionScheme.Algorithm
+	switch {
+	case scheme.Equal(oidAES128CBC):
+		keyLength, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAES192CBC):
+		keyLength, newCipher = 24, aes.NewCipher
+	case scheme.Equal(oidAES256CBC):
+		keyLength, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDESEDE3CBC):
+		keyLength, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("unsupported PKCS#8 cipher %v", scheme)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("parsing cipher IV: %v", err)
+	}
+
+	block, err := newCipher(pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keyLength, prf))
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed encrypted PKCS#8 data")
+	}
+	plaintext := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, info.EncryptedData)
+
+	// Check and strip the PKCS#7 padding.  Bad padding almost always means a wrong passphrase.
+	padding := int(plaintext[len(plaintext)-1])
+	if padding == 0 || padding > block.BlockSize() || !bytes.Equal(plaintext[len(plaintext)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, x509.IncorrectPasswordError
+	}
+	plaintext = plaintext[:len(plaintext)-padding]
+	if _, err := x509.ParsePKCS8PrivateKey(plaintext); err != nil {
+		return nil, x509.IncorrectPasswordError
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadX509KeyPairEncrypted(t *testing.T) {
+	plain, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	require.Nil(t, err)
+
+	for _, keyFile := range []string{"fixtures/clients/client1-pkcs8.key", "fixtures/clients/client1-legacy.key"} {
+		keyPair, err := LoadX509KeyPair(clientCert, keyFile, KeyPassphrase{File: "fixtures/keypass.txt"})
+		require.Nil(t, err, keyFile)
+		assert.True(t, keyPair.PrivateKey.(*rsa.PrivateKey).Equal(plain.PrivateKey), keyFile)
+
+		_, err = LoadX509KeyPair(clientCert, keyFile, KeyPassphrase{})
+		assert.EqualError(t, err, "key is encrypted, but no key_passphrase is configured")
+
+		os.Setenv("KEYSYNC_TEST_PASSPHRASE", "wrong")
+		_, err = LoadX509KeyPair(clientCert, keyFile, KeyPassphrase{Env: "KEYSYNC_TEST_PASSPHRASE"})
+		assert.NotNil(t, err, keyFile)
+	}
+
+	os.Setenv("KEYSYNC_TEST_PASSPHRASE", "correct horse battery staple")
+	defer os.Unsetenv("KEYSYNC_TEST_PASSPHRASE")
+	_, err = LoadX509KeyPair(clientCert, "fixtures/clients/client1-pkcs8.key", KeyPassphrase{Env: "KEYSYNC_TEST_PASSPHRASE"})
+	assert.Nil(t, err)
+
+	// Unencrypted keys don't need a passphrase.
+	keyPair, err := LoadX509KeyPair(clientCert, clientKey, KeyPassphrase{})
+	require.Nil(t, err)
+	assert.Equal(t, plain.Certificate, keyPair.Certificate)
+}
+
+func TestKeyPassphraseFD(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.Nil(t, err)
+	defer r.Close()
+	_, err = w.Write([]byte("correct horse battery staple\n"))
+	require.Nil(t, err)
+	w.Close()
+
+	fd := int(r.Fd())
+	passphrase := KeyPassphrase{FD: &fd}
+	_, err = LoadX509KeyPair(clientCert, "fixtures/clients/client1-pkcs8.key", passphrase)
+	require.Nil(t, err)
+
+	// The pipe is drained, so reloading the key relies on the passphrase being kept.
+	_, err = LoadX509KeyPair(clientCert, "fixtures/clients/client1-legacy.key", passphrase)
+	require.Nil(t, err)
+}
+
+func TestKeyPassphraseValidate(t *testing.T) {
+	fd := 3
+	assert.Nil(t, KeyPassphrase{}.validate())
+	assert.Nil(t, KeyPassphrase{FD: &fd}.validate())
+	assert.NotNil(t, KeyPassphrase{File: "pass", Env: "PASS"}.validate())
+	assert.NotNil(t, KeyPassphrase{Env: "PASS", FD: &fd}.validate())
+}
+
+func TestClientEncryptedKey(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", server)
+	require.Nil(t, err)
+
+	cfg := defaultClientConfig()
+	cfg.Key = "fixtures/clients/client1-pkcs8.key"
+	cfg.KeyPassphrase = KeyPassphrase{File: "fixtures/keypass.txt"}
+	entry, err := syncer.buildClient("encrypted", *cfg, metricsForTest())
+	require.Nil(t, err)
+	_, err = entry.Client.SecretList()
+	assert.Nil(t, err)
+
+	cfg.KeyPassphrase = KeyPassphrase{}
+	_, err = syncer.buildClient("encrypted", *cfg, metricsForTest())
+	assert.NotNil(t, err)
+}
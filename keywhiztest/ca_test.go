@@ -0,0 +1,51 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhiztest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCA(t *testing.T) {
+	ca, err := NewCA("test CA")
+	require.Nil(t, err)
+
+	cert, err := ca.Issue(&x509.Certificate{SerialNumber: big.NewInt(7), Subject: pkix.Name{CommonName: "client"}})
+	require.Nil(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(ca.CertPEM()))
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	assert.Nil(t, err)
+
+	certPEM, keyPEM, err := EncodeKeyPair(cert)
+	require.Nil(t, err)
+	_, err = tls.X509KeyPair(certPEM, keyPEM)
+	assert.Nil(t, err)
+
+	crlPEM, err := ca.CRL(time.Now().Add(time.Hour), 7)
+	require.Nil(t, err)
+	block, _ := pem.Decode(crlPEM)
+	require.NotNil(t, block)
+	assert.Equal(t, "X509 CRL", block.Type)
+}
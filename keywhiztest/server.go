@@ -0,0 +1,402 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keywhiztest provides a fake Keywhiz server, for testing keysync and programs that embed it.
+//
+// The fake serves the endpoints keysync uses: GET /secrets, GET /secret/{name}, POST /batchsecret and GET
+// /_status.  Clients are identified by the common name of their certificate, and may be limited to some secrets.
+// Secrets can be changed between polls, and faults such as latency, errors and truncated responses injected.
+// CA issues certificates and CRLs for tests that need more than the fixtures.
+//
+// It doesn't import keysync, so keysync's own tests can use it.
+package keywhiztest
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Secret is a secret held by the fake server.
+type Secret struct {
+	Name      string
+	Content   []byte
+	Checksum  string // Defaults to a hash of the contents
+	Filename  string // Optional: Overrides the name as the filename, such as to make duplicates
+	Mode      string
+	Owner     string
+	Group     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Fault changes how the server responds to matching requests.
+type Fault struct {
+	Path     string        // Requests whose path starts with this, such as "/batchsecret".  Empty for all requests.
+	Latency  time.Duration // Wait this long before responding
+	Status   int           // Respond with this status and no body, such as 503
+	Truncate int           // Cut the response body off after this many bytes
+	Times    int           // Only for this many requests.  Zero for every request.
+}
+
+// Request is a request the server has handled, for tests to check.
+type Request struct {
+	Client string // The common name of the client certificate, if any
+	Method string
+	Path   string
+	Status int
+}
+
+// Server is a fake Keywhiz.  It's an http.Handler, so it can be served however a test or program likes;
+// StartTLS serves it on an httptest.Server.  It's safe to use from several goroutines.
+type Server struct {
+	mu                sync.Mutex
+	secrets           map[string]Secret
+	acl               map[string]map[string]bool // Client to the secrets it may read; clients not here read all
+	faults            []*Fault
+	deleteAfterList   []string
+	requests          []Request
+	requireClientCert bool
+}
+
+// New returns a fake server holding the given secrets.
+func New(secrets ...Secret) *Server {
+	s := &Server{secrets: map[string]Secret{}, acl: map[string]map[string]bool{}}
+	for _, secret := range secrets {
+		s.Set(secret)
+	}
+	return s
+}
+
+// RequireClientCert rejects requests without a client certificate with a 401, even if TLS allowed them.
+func (s *Server) RequireClientCert(require bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requireClientCert = require
+}
+
+// Set adds or replaces a secret.  A replaced secret keeps its creation time, and gets a new checksum if its
+// contents changed and no checksum was given.
+func (s *Server) Set(secret Secret) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	if secret.Checksum == "" {
+		sum := sha256.Sum256(secret.Content)
+		secret.Checksum = hex.EncodeToString(sum[:])
+	}
+	if secret.CreatedAt.IsZero() {
+		secret.CreatedAt = now
+		if previous, ok := s.secrets[secret.Name]; ok {
+			secret.CreatedAt = previous.CreatedAt
+		}
+	}
+	if secret.UpdatedAt.IsZero() {
+		secret.UpdatedAt = now
+	}
+	s.secrets[secret.Name] = secret
+}
+
+// Delete removes secrets.
+func (s *Server) Delete(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range names {
+		delete(s.secrets, name)
+	}
+}
+
+// DeleteAfterList deletes secrets once the next listing has been served, so they're listed but gone by the time
+// their contents are requested.
+func (s *Server) DeleteAfterList(names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteAfterList = append(s.deleteAfterList, names...)
+}
+
+// Allow limits a client, by certificate common name, to the given secrets in addition to any already allowed.
+// A client that's never been passed to Allow may read every secret.  Secrets a client may not read aren't
+// listed, and requesting them is forbidden.
+func (s *Server) Allow(client string, names ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.acl[client] == nil {
+		s.acl[client] = map[string]bool{}
+	}
+	for _, name := range names {
+		s.acl[client][name] = true
+	}
+}
+
+// Inject adds a fault.  The first matching fault applies to each request.
+func (s *Server) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := fault
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns the requests handled so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// StartTLS serves the fake on a new httptest.Server with the given TLS config, which should have a certificate
+// for 127.0.0.1.  The caller should Close the returned server.
+func (s *Server) StartTLS(config *tls.Config) *httptest.Server {
+	server := httptest.NewUnstartedServer(s)
+	server.TLS = config
+	server.StartTLS()
+	return server
+}
+
+// TLSConfig returns a config serving the given certificate, which requires clients to present a certificate
+// signed by a CA in clientCAFile.
+func TLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s", clientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+// ServeHTTP handles a request as Keywhiz would.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	client := ""
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		client = r.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	fault := s.takeFault(r.URL.Path)
+	if fault != nil && fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	var status int
+	var body []byte
+	switch {
+	case fault != nil && fault.Status != 0:
+		status = fault.Status
+	default:
+		status, body = s.respond(client, r)
+	}
+	if fault != nil && fault.Truncate > 0 && fault.Truncate < len(body) {
+		body = body[:fault.Truncate]
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Client: client, Method: r.Method, Path: r.URL.Path, Status: status})
+	s.mu.Unlock()
+
+	if body != nil {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// takeFault returns the first fault matching path, counting it as used.
+func (s *Server) takeFault(path string) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, fault := range s.faults {
+		if !strings.HasPrefix(path, fault.Path) {
+			continue
+		}
+		matched := *fault
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			}
+		}
+		return &matched
+	}
+	return nil
+}
+
+func (s *Server) respond(client string, r *http.Request) (int, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.requireClientCert && client == "" {
+		return http.StatusUnauthorized, nil
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/_status":
+		return http.StatusOK, []byte(`{"status":"ok"}`)
+
+	case r.Method == "GET" && r.URL.Path == "/secrets":
+		var listed []jsonSecret
+		for _, name := range s.sortedNames() {
+			if s.allowed(client, name) {
+				listed = append(listed, toJSON(s.secrets[name], false))
+			}
+		}
+		for _, name := range s.deleteAfterList {
+			delete(s.secrets, name)
+		}
+		s.deleteAfterList = nil
+		return jsonResponse(listed)
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/secret/"):
+		name := strings.TrimPrefix(r.URL.Path, "/secret/")
+		secret, ok := s.secrets[name]
+		switch {
+		case !ok:
+			return http.StatusNotFound, []byte("Secret not found")
+		case !s.allowed(client, name):
+			return http.StatusForbidden, []byte("Access denied")
+		}
+		return jsonResponse(toJSON(secret, true))
+
+	case r.Method == "POST" && r.URL.Path == "/batchsecret":
+		var request struct {
+			Secrets []string `json:"secrets"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			return http.StatusBadRequest, []byte(err.Error())
+		}
+		// As Keywhiz does, the whole batch fails if any secret can't be read.
+		batch := []jsonSecret{}
+		for _, name := range request.Secrets {
+			secret, ok := s.secrets[name]
+			switch {
+			case !ok:
+				return http.StatusNotFound, []byte(fmt.Sprintf("Secret %s not found", name))
+			case !s.allowed(client, name):
+				return http.StatusForbidden, []byte(fmt.Sprintf("Access denied to %s", name))
+			}
+			batch = append(batch, toJSON(secret, true))
+		}
+		return jsonResponse(batch)
+	}
+	return http.StatusNotFound, nil
+}
+
+func (s *Server) sortedNames() []string {
+	var names []string
+	for name := range s.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) allowed(client, name string) bool {
+	allowed, restricted := s.acl[client]
+	return !restricted || allowed[name]
+}
+
+// jsonSecret is a secret as Keywhiz sends it.  Listings leave out the contents.
+type jsonSecret struct {
+	Name      string    `json:"name"`
+	Content   []byte    `json:"secret"`
+	Length    int       `json:"secretLength"`
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"creationDate"`
+	UpdatedAt time.Time `json:"updateDate"`
+	Filename  string    `json:"filename,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	Owner     string    `json:"owner,omitempty"`
+	Group     string    `json:"group,omitempty"`
+}
+
+func toJSON(secret Secret, withContent bool) jsonSecret {
+	j := jsonSecret{
+		Name:      secret.Name,
+		Length:    len(secret.Content),
+		Checksum:  secret.Checksum,
+		CreatedAt: secret.CreatedAt,
+		UpdatedAt: secret.UpdatedAt,
+		Filename:  secret.Filename,
+		Mode:      secret.Mode,
+		Owner:     secret.Owner,
+		Group:     secret.Group,
+		Content:   []byte{},
+	}
+	if withContent {
+		j.Content = secret.Content
+	}
+	return j
+}
+
+func jsonResponse(value interface{}) (int, []byte) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	return http.StatusOK, data
+}
+
+// LoadSecrets adds secrets from a JSON list in Keywhiz's format, such as an exported bundle.
+func (s *Server) LoadSecrets(data []byte) error {
+	var secrets []jsonSecret
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return fmt.Errorf("parsing secrets: %v", err)
+	}
+	for _, j := range secrets {
+		if j.Name == "" {
+			return errors.New("parsing secrets: secret with no name")
+		}
+		s.Set(Secret{
+			Name:      j.Name,
+			Content:   j.Content,
+			Checksum:  j.Checksum,
+			Filename:  j.Filename,
+			Mode:      j.Mode,
+			Owner:     j.Owner,
+			Group:     j.Group,
+			CreatedAt: j.CreatedAt,
+			UpdatedAt: j.UpdatedAt,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keywhiztest
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serve(server *Server, client, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	if client != "" {
+		cert := &x509.Certificate{}
+		cert.Subject.CommonName = client
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func names(t *testing.T, body []byte) []string {
+	var secrets []jsonSecret
+	require.Nil(t, json.Unmarshal(body, &secrets))
+	var names []string
+	for _, secret := range secrets {
+		names = append(names, secret.Name)
+	}
+	return names
+}
+
+func TestServerEndpoints(t *testing.T) {
+	server := New(Secret{Name: "one", Content: []byte("1"), Mode: "0400"}, Secret{Name: "two", Content: []byte("2")})
+
+	res := serve(server, "", "GET", "/_status", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	res = serve(server, "", "GET", "/secrets", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, []string{"one", "two"}, names(t, res.Body.Bytes()))
+	assert.NotContains(t, res.Body.String(), `"secret":"MQ=="`, "Listings have no contents")
+
+	res = serve(server, "", "GET", "/secret/one", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	var secret jsonSecret
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &secret))
+	assert.Equal(t, "1", string(secret.Content))
+	assert.Equal(t, "0400", secret.Mode)
+	assert.NotEmpty(t, secret.Checksum)
+
+	res = serve(server, "", "POST", "/batchsecret", `{"secrets":["one","two"]}`)
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, []string{"one", "two"}, names(t, res.Body.Bytes()))
+
+	assert.Equal(t, http.StatusNotFound, serve(server, "", "GET", "/secret/three", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(server, "", "POST", "/batchsecret", `{"secrets":["one","three"]}`).Code)
+}
+
+func TestServerACL(t *testing.T) {
+	server := New(Secret{Name: "one"}, Secret{Name: "two"})
+	server.Allow("client1", "one")
+
+	assert.Equal(t, []string{"one"}, names(t, serve(server, "client1", "GET", "/secrets", "").Body.Bytes()))
+	assert.Equal(t, http.StatusForbidden, serve(server, "client1", "GET", "/secret/two", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(server, "client1", "POST", "/batchsecret", `{"secrets":["two"]}`).Code)
+	assert.Equal(t, []string{"one", "two"}, names(t, serve(server, "client2", "GET", "/secrets", "").Body.Bytes()))
+
+	server.RequireClientCert(true)
+	assert.Equal(t, http.StatusUnauthorized, serve(server, "", "GET", "/secrets", "").Code)
+
+	requests := server.Requests()
+	require.Len(t, requests, 5)
+	assert.Equal(t, Request{Client: "client1", Method: "GET", Path: "/secret/two", Status: http.StatusForbidden}, requests[1])
+}
+
+func TestServerMutations(t *testing.T) {
+	server := New(Secret{Name: "one", Content: []byte("1")})
+	res := serve(server, "", "GET", "/secret/one", "")
+	var before jsonSecret
+	require.Nil(t, json.Unmarshal(res.Body.Bytes(), &before))
+
+	server.Set(Secret{Name: "one", Content: []byte("changed")})
+	server.Set(Secret{Name: "dup", Filename: "one"})
+	var after jsonSecret
+	require.Nil(t, json.Unmarshal(serve(server, "", "GET", "/secret/one", "").Body.Bytes(), &after))
+	assert.NotEqual(t, before.Checksum, after.Checksum)
+	assert.Equal(t, before.CreatedAt, after.CreatedAt)
+	assert.Contains(t, serve(server, "", "GET", "/secrets", "").Body.String(), `"filename":"one"`)
+
+	server.Delete("dup")
+	server.DeleteAfterList("one")
+	assert.Equal(t, []string{"one"}, names(t, serve(server, "", "GET", "/secrets", "").Body.Bytes()))
+	assert.Equal(t, http.StatusNotFound, serve(server, "", "GET", "/secret/one", "").Code)
+}
+
+func TestServerFaults(t *testing.T) {
+	server := New(Secret{Name: "one", Content: []byte("1")})
+
+	server.Inject(Fault{Path: "/secrets", Status: http.StatusServiceUnavailable, Times: 1})
+	assert.Equal(t, http.StatusServiceUnavailable, serve(server, "", "GET", "/secrets", "").Code)
+	assert.Equal(t, http.StatusOK, serve(server, "", "GET", "/secrets", "").Code, "Only once")
+
+	server.Inject(Fault{Path: "/secret/", Truncate: 5})
+	res := serve(server, "", "GET", "/secret/one", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, 5, res.Body.Len())
+	server.ClearFaults()
+
+	server.Inject(Fault{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	serve(server, "", "GET", "/_status", "")
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestServerTLS(t *testing.T) {
+	config, err := TLSConfig("../fixtures/CA/localhost.crt", "../fixtures/CA/localhost.crt", "../fixtures/CA/cacert.crt")
+	require.Nil(t, err)
+	server := New(Secret{Name: "one"})
+	server.Allow("client1", "one")
+	ts := server.StartTLS(config)
+	defer ts.Close()
+
+	cert, err := tls.LoadX509KeyPair("../fixtures/clients/client1.crt", "../fixtures/clients/client1.key")
+	require.Nil(t, err)
+	caPEM, err := ioutil.ReadFile("../fixtures/CA/localhost.crt")
+	require.Nil(t, err)
+	roots := x509.NewCertPool()
+	require.True(t, roots.AppendCertsFromPEM(caPEM))
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      roots,
+	}}}
+
+	res, err := client.Get(ts.URL + "/secrets")
+	require.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "client1", server.Requests()[0].Client)
+
+	// Without a client certificate, the handshake fails.
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	_, err = anonymous.Get(ts.URL + "/secrets")
+	assert.NotNil(t, err)
+}
+
+func TestLoadSecrets(t *testing.T) {
+	data, err := ioutil.ReadFile("../fixtures/exportedSecretsBackupBundle.json")
+	require.Nil(t, err)
+	server := New()
+	require.Nil(t, server.LoadSecrets(data))
+	assert.Equal(t, []string{"General_Password", "Hacking_Password"}, names(t, serve(server, "", "GET", "/secrets", "").Body.Bytes()))
+
+	assert.NotNil(t, server.LoadSecrets([]byte(`[{"secret":"MQ=="}]`)))
+}
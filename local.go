@@ -0,0 +1,309 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/square/keysync/backup"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// LocalConfig is where a client with backend: local reads its secrets.
+type LocalConfig struct {
+	Path     string `yaml:"path"`     // Mandatory: Each file in this directory tree is a secret
+	Metadata string `yaml:"metadata"` // Optional: A yaml file of mode, owner, group and filename by secret name
+}
+
+// BundleConfig is where a client with backend: bundle reads its secrets.
+type BundleConfig struct {
+	Path       string `yaml:"path"`        // Mandatory: A bundle of secrets, sealed with backup.Seal
+	PrivateKey string `yaml:"private_key"` // Mandatory: The private key it's sealed to, from keyunwrap generate
+}
+
+// localMetadata is an entry in a LocalConfig's metadata file.
+type localMetadata struct {
+	Mode     string `yaml:"mode"`
+	Owner    string `yaml:"owner"`
+	Group    string `yaml:"group"`
+	Filename string `yaml:"filename"`
+}
+
+// snapshotClient is a Client for secrets that are loaded all at once, such as from local files.  The secrets are
+// reloaded on each listing, so a poll picks up edits, and those without a checksum get one from their contents so
+// changes are re-synced.
+type snapshotClient struct {
+	load    func() ([]Secret, error)
+	mapping SecretMapping
+	logger  *logrus.Entry
+
+	mu      sync.Mutex
+	secrets map[string]Secret // By name, from the latest load
+}
+
+// NewLocalClient returns a client that reads secrets from a directory tree.  A secret is named by its path relative
+// to the directory, and nested secrets default to a filename with the slashes replaced by underscores.  Hidden files
+// are skipped.
+func NewLocalClient(cfg LocalConfig, mapping SecretMapping, logger *logrus.Entry) (Client, error) {
+	client := &snapshotClient{
+		load:    func() ([]Secret, error) { return loadLocalSecrets(cfg) },
+		mapping: mapping,
+		logger:  logger.WithField("logger", "local_client"),
+	}
+	if err := client.reload(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// NewBundleClient returns a client that reads secrets from a sealed bundle, in the same JSON format as a
+// BackupBundleClient reads.
+func NewBundleClient(cfg BundleConfig, mapping SecretMapping, logger *logrus.Entry) (Client, error) {
+	var stamp fileStamp
+	var previous []Secret
+	client := &snapshotClient{
+		mapping: mapping,
+		logger:  logger.WithField("logger", "bundle_client"),
+	}
+	client.load = func() ([]Secret, error) {
+		// Decrypting is only worth doing if the bundle has changed.
+		current, err := statFile(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil && current == stamp {
+			return previous, nil
+		}
+		secrets, err := loadBundleSecrets(cfg)
+		if err != nil {
+			return nil, err
+		}
+		stamp, previous = current, secrets
+		return secrets, nil
+	}
+	if err := client.reload(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func loadLocalSecrets(cfg LocalConfig) ([]Secret, error) {
+	metadata := map[string]localMetadata{}
+	if cfg.Metadata != "" {
+		data, err := ioutil.ReadFile(cfg.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("reading secret metadata: %v", err)
+		}
+		if err := yaml.Unmarshal(data, &metadata); err != nil {
+			return nil, fmt.Errorf("parsing secret metadata %s: %v", cfg.Metadata, err)
+		}
+	}
+
+	var secrets []Secret
+	err := filepath.Walk(cfg.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != cfg.Path && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Stat again to follow symlinks to files.
+		if info, err = os.Stat(path); err != nil || !info.Mode().IsRegular() || path == filepath.Clean(cfg.Metadata) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(cfg.Path, path)
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		secret := Secret{
+			Name:      name,
+			Content:   contents,
+			Length:    uint64(len(contents)),
+			UpdatedAt: info.ModTime(),
+		}
+		if meta, ok := metadata[name]; ok {
+			secret.Mode, secret.Owner, secret.Group = meta.Mode, meta.Owner, meta.Group
+			if meta.Filename != "" {
+				secret.FilenameOverride = &meta.Filename
+			}
+		}
+		if secret.FilenameOverride == nil && strings.Contains(name, "/") {
+			filename := strings.Replace(name, "/", "_", -1)
+			secret.FilenameOverride = &filename
+		}
+		secrets = append(secrets, secret)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("reading secrets from %s: %v", cfg.Path, err)
+	}
+	return secrets, nil
+}
+
+func loadBundleSecrets(cfg BundleConfig) ([]Secret, error) {
+	privateKey, err := ioutil.ReadFile(cfg.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("reading bundle private key: %v", err)
+	}
+	sealed, err := ioutil.ReadFile(cfg.Path)
+	if err != nil {
+		return nil, fmt.Errorf("reading bundle: %v", err)
+	}
+	data, err := backup.Open(sealed, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("opening bundle %s: %v", cfg.Path, err)
+	}
+	secrets, err := ParseSecretList(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing bundle %s: %v", cfg.Path, err)
+	}
+	return secrets, nil
+}
+
+// reload loads the secrets again.  If that fails, the previous secrets are kept.
+func (c *snapshotClient) reload() error {
+	list, err := c.load()
+	if err != nil {
+		return err
+	}
+	secrets := map[string]Secret{}
+	for _, secret := range list {
+		if secret.Checksum == "" {
+			sum := sha256.Sum256(secret.Content)
+			secret.Checksum = hex.EncodeToString(sum[:])
+		}
+		secrets[secret.Name] = secret
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.secrets = secrets
+	return nil
+}
+
+// Secret returns the named secret from the latest snapshot.
+func (c *snapshotClient) Secret(name string) (*Secret, error) {
+	return c.SecretContext(context.Background(), name)
+}
+
+// SecretContext returns the named secret from the latest snapshot.  The context is only checked before starting.
+func (c *snapshotClient) SecretContext(ctx context.Context, name string) (*Secret, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	secret, ok := c.secrets[name]
+	c.mu.Unlock()
+	if !ok {
+		return nil, SecretDeleted{}
+	}
+	if !c.mapping.apply(&secret) {
+		return nil, fmt.Errorf("secret %v is excluded by client config", name)
+	}
+	return &secret, nil
+}
+
+// SecretList reloads the secrets, and returns them keyed by filename without their contents.
+func (c *snapshotClient) SecretList() (map[string]Secret, error) {
+	return c.SecretListContext(context.Background())
+}
+
+// SecretListContext is SecretList, checking the context before starting.
+func (c *snapshotClient) SecretListContext(ctx context.Context) (map[string]Secret, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	var list []Secret
+	for _, secret := range c.secrets {
+		secret.Content = nil
+		list = append(list, secret)
+	}
+	c.mu.Unlock()
+	return secretsByFilename(list, &c.mapping)
+}
+
+// SecretListWithContents returns the given secrets from the latest snapshot, keyed by filename.
+func (c *snapshotClient) SecretListWithContents(secrets []string) (map[string]Secret, error) {
+	return c.SecretListWithContentsContext(context.Background(), secrets)
+}
+
+// SecretListWithContentsContext is SecretListWithContents.  Like Keywhiz, it fails with a BatchError if any of the
+// secrets is missing.
+func (c *snapshotClient) SecretListWithContentsContext(ctx context.Context, secrets []string) (map[string]Secret, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	var list []Secret
+	for _, name := range secrets {
+		secret, ok := c.secrets[name]
+		if !ok {
+			c.mu.Unlock()
+			return nil, BatchError{StatusCode: http.StatusNotFound, Message: fmt.Sprintf("secret %s not found", name)}
+		}
+		list = append(list, secret)
+	}
+	c.mu.Unlock()
+	return secretsByFilename(list, &c.mapping)
+}
+
+// Logger returns the logger for this client.
+func (c *snapshotClient) Logger() *logrus.Entry {
+	return c.logger
+}
+
+// RebuildClient is a no-op, as secrets are reloaded when listed.
+func (c *snapshotClient) RebuildClient() error {
+	return nil
+}
+
+func (cfg LocalConfig) validate() error {
+	if cfg.Path == "" {
+		return errors.New("local backend needs local.path")
+	}
+	return nil
+}
+
+func (cfg BundleConfig) validate() error {
+	if cfg.Path == "" || cfg.PrivateKey == "" {
+		return errors.New("bundle backend needs bundle.path and bundle.private_key")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/square/keysync/backup"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func writeLocalFile(t *testing.T, path, contents string) {
+	require.Nil(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.Nil(t, ioutil.WriteFile(path, []byte(contents), 0600))
+}
+
+func TestLocalClientReadsDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-local")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeLocalFile(t, filepath.Join(dir, "secrets", "db_password"), "hunter2")
+	writeLocalFile(t, filepath.Join(dir, "secrets", "tls", "server.key"), "key")
+	writeLocalFile(t, filepath.Join(dir, "secrets", ".hidden"), "skipped")
+	writeLocalFile(t, filepath.Join(dir, "secrets", "metadata.yaml"), "db_password:\n  mode: \"0440\"\n  filename: db.txt\n")
+
+	cfg := LocalConfig{Path: filepath.Join(dir, "secrets"), Metadata: filepath.Join(dir, "secrets", "metadata.yaml")}
+	client, err := NewLocalClient(cfg, SecretMapping{}, logrus.NewEntry(logrus.New()))
+	require.Nil(t, err)
+
+	list, err := client.SecretList()
+	require.Nil(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "0440", list["db.txt"].Mode)
+	assert.Empty(t, list["db.txt"].Content)
+	assert.NotEmpty(t, list["db.txt"].Checksum)
+	assert.Equal(t, "tls/server.key", list["tls_server.key"].Name)
+
+	secret, err := client.Secret("db_password")
+	require.Nil(t, err)
+	assert.EqualValues(t, "hunter2", secret.Content)
+
+	_, err = client.Secret("missing")
+	assert.IsType(t, SecretDeleted{}, err)
+	_, err = client.SecretListWithContents([]string{"db_password", "missing"})
+	assert.Equal(t, BatchError{StatusCode: 404, Message: "secret missing not found"}, err)
+}
+
+func TestLocalClientSyncsChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-local")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	writeLocalFile(t, filepath.Join(dir, "one"), "first")
+	writeLocalFile(t, filepath.Join(dir, "two"), "second")
+
+	client, err := NewLocalClient(LocalConfig{Path: dir}, SecretMapping{}, logrus.NewEntry(logrus.New()))
+	require.Nil(t, err)
+	// Unlike InMemoryOutput, a MemoryOutput compares checksums.
+	collection := NewMemoryOutputCollection()
+	output, err := collection.NewOutput(testClientConfig("local"), testLogger())
+	require.Nil(t, err)
+	entry := &syncerEntry{client, ClientConfig{}, output, map[string]secretState{}}
+	updated, err := entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Added: 2}, updated)
+
+	writeLocalFile(t, filepath.Join(dir, "one"), "edited")
+	require.Nil(t, os.Remove(filepath.Join(dir, "two")))
+	updated, err = entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Changed: 1, Deleted: 1}, updated)
+	secret, ok := collection.Secret("local", "one")
+	require.True(t, ok)
+	assert.EqualValues(t, "edited", secret.Content)
+	_, ok = collection.Secret("local", "two")
+	assert.False(t, ok)
+}
+
+func TestBundleClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-bundle")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	pubkey, privkey, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	keyFile := filepath.Join(dir, "private.key")
+	require.Nil(t, ioutil.WriteFile(keyFile, privkey[:], 0600))
+
+	bundleFile := filepath.Join(dir, "bundle.sealed")
+	writeBundle := func(contents string, modTime time.Time) {
+		sealed, err := backup.Seal(fixture(contents), pubkey)
+		require.Nil(t, err)
+		require.Nil(t, ioutil.WriteFile(bundleFile, sealed, 0600))
+		require.Nil(t, os.Chtimes(bundleFile, modTime, modTime))
+	}
+	writeBundle("secrets.json", time.Now().Add(-time.Hour))
+
+	client, err := NewBundleClient(BundleConfig{Path: bundleFile, PrivateKey: keyFile}, SecretMapping{}, logrus.NewEntry(logrus.New()))
+	require.Nil(t, err)
+	list, err := client.SecretList()
+	require.Nil(t, err)
+	assert.Len(t, list, 2)
+	checksum := list["Nobody_PgPass"].Checksum
+
+	// A new bundle is picked up on the next listing.
+	writeBundle("secretsWithoutContent.json", time.Now())
+	list, err = client.SecretList()
+	require.Nil(t, err)
+	assert.Len(t, list, 2)
+	assert.NotEqual(t, checksum, list["Nobody_PgPass"].Checksum)
+
+	// A bundle that can't be opened is an error, rather than deleting everything.
+	require.Nil(t, ioutil.WriteFile(bundleFile, []byte("garbage"), 0600))
+	_, err = client.SecretList()
+	assert.Error(t, err)
+}
+
+func TestLocalConfigValidation(t *testing.T) {
+	cfg := &Config{SecretsDir: "/tmp/keysync-secrets"}
+	client := ClientConfig{Backend: BackendLocal}
+	assert.EqualError(t, client.validate(cfg), "local backend needs local.path")
+	client.Local.Path = "/etc/secrets"
+	assert.Nil(t, client.validate(cfg))
+
+	client = ClientConfig{Backend: BackendBundle, Bundle: BundleConfig{Path: "bundle.sealed"}}
+	assert.EqualError(t, client.validate(cfg), "bundle backend needs bundle.path and bundle.private_key")
+	client.Bundle.PrivateKey = "private.key"
+	assert.Nil(t, client.validate(cfg))
+
+	client = ClientConfig{}
+	assert.EqualError(t, client.validate(cfg), "no key in config")
+}
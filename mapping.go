@@ -0,0 +1,168 @@
+// Copyright 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	pkgerr "github.com/pkg/errors"
+)
+
+// SecretMapping selects which of a client's secrets are synced, and what they're called on disk.
+// Include and Exclude are glob patterns (as in filepath.Match) on Keywhiz secret names.
+// Rename, Aliases and SecretACLs are keyed by Keywhiz secret name.
+type SecretMapping struct {
+	Include []string            `yaml:"include"` // Optional: Only sync secrets matching one of these patterns. Defaults to all.
+	Exclude []string            `yaml:"exclude"` // Optional: Never sync secrets matching one of these patterns.
+	Rename  map[string]string   `yaml:"rename"`  // Optional: Write the named secret to this filename instead.
+	Aliases map[string][]string `yaml:"aliases"` // Optional: Extra filenames symlinked to the named secret.
+	// Optional: ACL entries like "user:alice:r" or "group:ops:r", granting read access to every secret,
+	// or by secret name to individual secrets.
+	ACL        []string            `yaml:"acl"`
+	SecretACLs map[string][]string `yaml:"secret_acls"`
+}
+
+// validate checks that patterns are well-formed and that no rename or alias could escape the client directory.
+func (m *SecretMapping) validate() error {
+	for _, pattern := range append(append([]string{}, m.Include...), m.Exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid secret pattern '%s': %v", pattern, err)
+		}
+	}
+	for name, filename := range m.Rename {
+		if !validFilename(filename) {
+			return fmt.Errorf("invalid rename of secret %s to '%s'", name, filename)
+		}
+	}
+	for _, entry := range m.ACL {
+		if _, _, err := parseACLEntry(entry); err != nil {
+			return err
+		}
+	}
+	for _, entries := range m.SecretACLs {
+		for _, entry := range entries {
+			if _, _, err := parseACLEntry(entry); err != nil {
+				return err
+			}
+		}
+	}
+	for name, aliases := range m.Aliases {
+		for _, alias := range aliases {
+			if !validFilename(alias) {
+				return fmt.Errorf("invalid alias of secret %s: '%s'", name, alias)
+			}
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the secret name passes the include and exclude filters.
+func (m *SecretMapping) Matches(name string) bool {
+	if len(m.Include) > 0 && !matchesAny(m.Include, name) {
+		return false
+	}
+	return !matchesAny(m.Exclude, name)
+}
+
+// apply renames, aliases and sets ACLs on a secret in-place.  It returns false if the secret is filtered out.
+func (m *SecretMapping) apply(secret *Secret) bool {
+	if m == nil {
+		return true
+	}
+	if !m.Matches(secret.Name) {
+		return false
+	}
+	if filename, ok := m.Rename[secret.Name]; ok {
+		secret.FilenameOverride = &filename
+	}
+	secret.Aliases = m.Aliases[secret.Name]
+	if len(m.ACL) > 0 || len(m.SecretACLs[secret.Name]) > 0 {
+		secret.ACL = append(append([]string{}, m.ACL...), m.SecretACLs[secret.Name]...)
+	}
+	return true
+}
+
+// secretsByFilename applies the mapping to a list of secrets, returning them keyed by filename.
+// It's an error for two secrets to end up with the same filename or alias.
+func secretsByFilename(secretList []Secret, mapping *SecretMapping) (map[string]Secret, error) {
+	secretMap := map[string]Secret{}
+	index := newFilenameIndex(mapping)
+	for _, secret := range secretList {
+		filename, ok, err := index.add(&secret)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			secretMap[filename] = secret
+		}
+	}
+	return secretMap, nil
+}
+
+// DuplicateFilename is returned when two secrets map to the same filename or alias.
+type DuplicateFilename struct {
+	Filename, First, Second string
+}
+
+func (e DuplicateFilename) Error() string {
+	return fmt.Sprintf("duplicate filename detected: %s on secrets %s and %s", e.Filename, e.First, e.Second)
+}
+
+// filenameIndex applies the mapping to secrets one at a time, as they're decoded, remembering which secret owns
+// each filename and alias so far.
+type filenameIndex struct {
+	mapping *SecretMapping
+	owners  map[string]string
+}
+
+func newFilenameIndex(mapping *SecretMapping) *filenameIndex {
+	return &filenameIndex{mapping: mapping, owners: map[string]string{}}
+}
+
+// add applies the mapping to the secret in-place, and returns its filename.  It returns false if the secret is
+// filtered out, and an error if its filename or an alias was already taken.
+func (idx *filenameIndex) add(secret *Secret) (string, bool, error) {
+	if !idx.mapping.apply(secret) {
+		return "", false, nil
+	}
+	filename, err := secret.Filename()
+	if err != nil {
+		return "", false, pkgerr.Wrap(err, "unable to get secret's filename")
+	}
+	for _, name := range append([]string{filename}, secret.Aliases...) {
+		if duplicate, ok := idx.owners[name]; ok {
+			// This is not supported by Keysync. This stops syncing until the data inconsistency is fixed.
+			return "", false, DuplicateFilename{Filename: name, First: duplicate, Second: secret.Name}
+		}
+		idx.owners[name] = secret.Name
+	}
+	return filename, true, nil
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		// Patterns are checked in validate, so errors are impossible here.
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validFilename returns true if name can only refer to a file directly inside the client directory.
+func validFilename(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsRune(name, filepath.Separator)
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestSecretMappingFromYaml(t *testing.T) {
+	data := []byte(`
+key: client1.key
+include: ["General_*", "Nobody_PgPass"]
+exclude: ["*..old"]
+rename:
+  Nobody_PgPass: pgpass
+aliases:
+  Nobody_PgPass: [".pgpass"]
+`)
+	var cfg ClientConfig
+	require.NoError(t, yaml.Unmarshal(data, &cfg))
+	require.NoError(t, cfg.validate(&Config{}))
+
+	assert.Equal(t, []string{"General_*", "Nobody_PgPass"}, cfg.Include)
+	assert.Equal(t, []string{"*..old"}, cfg.Exclude)
+	assert.Equal(t, "pgpass", cfg.Rename["Nobody_PgPass"])
+	assert.Equal(t, []string{".pgpass"}, cfg.Aliases["Nobody_PgPass"])
+}
+
+func TestSecretMappingValidate(t *testing.T) {
+	assert.Error(t, (&SecretMapping{Include: []string{"["}}).validate())
+	assert.Error(t, (&SecretMapping{Rename: map[string]string{"a": "../a"}}).validate())
+	assert.Error(t, (&SecretMapping{Rename: map[string]string{"a": ".."}}).validate())
+	assert.Error(t, (&SecretMapping{Aliases: map[string][]string{"a": {"x/y"}}}).validate())
+	assert.NoError(t, (&SecretMapping{}).validate())
+}
+
+func TestSecretMappingMatches(t *testing.T) {
+	m := SecretMapping{Include: []string{"General_*"}, Exclude: []string{"*_Old"}}
+	assert.True(t, m.Matches("General_Password"))
+	assert.False(t, m.Matches("General_Password_Old"))
+	assert.False(t, m.Matches("Nobody_PgPass"))
+
+	// No include patterns means everything is included
+	m = SecretMapping{Exclude: []string{"Nobody_*"}}
+	assert.True(t, m.Matches("General_Password"))
+	assert.False(t, m.Matches("Nobody_PgPass"))
+}
+
+func TestSecretsByFilename(t *testing.T) {
+	override := "override"
+	secrets := []Secret{
+		{Name: "General_Password"},
+		{Name: "Nobody_PgPass"},
+		{Name: "Excluded"},
+		{Name: "Overridden", FilenameOverride: &override},
+	}
+	mapping := SecretMapping{
+		Exclude: []string{"Excluded"},
+		Rename:  map[string]string{"Nobody_PgPass": "pgpass", "Overridden": "renamed"},
+		Aliases: map[string][]string{"Nobody_PgPass": {".pgpass"}},
+	}
+
+	byFilename, err := secretsByFilename(secrets, &mapping)
+	require.NoError(t, err)
+	assert.Len(t, byFilename, 3)
+	assert.Equal(t, "General_Password", byFilename["General_Password"].Name)
+	assert.Equal(t, "Nobody_PgPass", byFilename["pgpass"].Name)
+	assert.Equal(t, []string{".pgpass"}, byFilename["pgpass"].Aliases)
+	// Renames take precedence over the server's filename
+	assert.Equal(t, "Overridden", byFilename["renamed"].Name)
+
+	// Duplicates are detected after renaming
+	mapping = SecretMapping{Rename: map[string]string{"Nobody_PgPass": "General_Password"}}
+	_, err = secretsByFilename(secrets[:2], &mapping)
+	assert.EqualError(t, err, "duplicate filename detected: General_Password on secrets General_Password and Nobody_PgPass")
+
+	// Aliases can't collide with filenames either
+	mapping = SecretMapping{Aliases: map[string][]string{"Nobody_PgPass": {"General_Password"}}}
+	_, err = secretsByFilename(secrets[:2], &mapping)
+	assert.Error(t, err)
+}
@@ -0,0 +1,305 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/square/keysync/output"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ChangeType describes what happened to a secret held in a MemoryOutputCollection.
+type ChangeType int
+
+const (
+	SecretAdded ChangeType = iota
+	SecretChanged
+	SecretRemoved
+)
+
+// Change is passed to callbacks registered with MemoryOutputCollection.Notify.
+type Change struct {
+	Client   string // The client's DirName
+	Filename string
+	Type     ChangeType
+}
+
+// MemoryOutputCollection keeps secrets in memory instead of writing them to a filesystem.  It's intended for
+// Go programs that embed keysync as a library: pass it to NewSyncer, run the syncer, and read secrets through
+// Secret and Secrets.  All methods are safe for concurrent use with a running Syncer.
+//
+//	secrets := keysync.NewMemoryOutputCollection()
+//	syncer, err := keysync.NewSyncer(config, secrets, logger, metricsHandle)
+//	...
+//	go syncer.Run()
+//	secret, ok := secrets.Secret("client", "filename")
+type MemoryOutputCollection struct {
+	mu        sync.RWMutex
+	outputs   map[string]*MemoryOutput
+	callbacks []func(Change)
+}
+
+var _ OutputCollection = &MemoryOutputCollection{}
+
+// NewMemoryOutputCollection returns an empty collection.
+func NewMemoryOutputCollection() *MemoryOutputCollection {
+	return &MemoryOutputCollection{outputs: map[string]*MemoryOutput{}}
+}
+
+// Notify registers a callback, which is called after every change to a secret.  Callbacks are called
+// synchronously from the syncer, so they shouldn't block.  Read the new value with Secret.
+func (c *MemoryOutputCollection) Notify(callback func(Change)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.callbacks = append(c.callbacks, callback)
+}
+
+// NewOutput returns the output for a client, creating it if it doesn't already exist.
+func (c *MemoryOutputCollection) NewOutput(clientConfig ClientConfig, logger *logrus.Entry) (Output, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := clientConfig.DirName
+	if existing, present := c.outputs[name]; present {
+		return existing, nil
+	}
+	out := &MemoryOutput{
+		collection: c,
+		client:     name,
+		secrets:    map[string]Secret{},
+		Logger:     logger,
+	}
+	c.outputs[name] = out
+	return out, nil
+}
+
+// Cleanup removes secrets for clients not in known.
+func (c *MemoryOutputCollection) Cleanup(known map[string]struct{}, logger *logrus.Entry) (uint, []error) {
+	var deleted uint
+	for _, name := range c.Clients() {
+		if _, present := known[name]; present {
+			continue
+		}
+		logger.WithField("name", name).Info("Deleting unknown client")
+		c.mu.RLock()
+		out := c.outputs[name]
+		c.mu.RUnlock()
+		removed, _ := out.RemoveAll()
+		deleted += removed
+	}
+	return deleted, nil
+}
+
+// Clients returns the sorted names of all clients with an output.
+func (c *MemoryOutputCollection) Clients() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var names []string
+	for name := range c.outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Secret returns a copy of a client's secret.  The filename may also be one of the secret's aliases.
+func (c *MemoryOutputCollection) Secret(client, filename string) (*Secret, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out, ok := c.outputs[client]
+	if !ok {
+		return nil, false
+	}
+	secret, ok := out.lookup(filename)
+	if !ok {
+		return nil, false
+	}
+	return &secret, true
+}
+
+// Secrets returns a copy of all of a client's secrets, keyed by filename.
+func (c *MemoryOutputCollection) Secrets(client string) map[string]Secret {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	secrets := map[string]Secret{}
+	if out, ok := c.outputs[client]; ok {
+		for filename, secret := range out.secrets {
+			secrets[filename] = copySecret(secret)
+		}
+	}
+	return secrets
+}
+
+// notify calls callbacks.  It must be called without holding the lock, so callbacks can read secrets.
+func (c *MemoryOutputCollection) notify(changes ...Change) {
+	c.mu.RLock()
+	callbacks := c.callbacks
+	c.mu.RUnlock()
+
+	for _, change := range changes {
+		for _, callback := range callbacks {
+			callback(change)
+		}
+	}
+}
+
+// MemoryOutput implements Output for a single client of a MemoryOutputCollection.
+type MemoryOutput struct {
+	collection *MemoryOutputCollection
+	client     string
+	secrets    map[string]Secret // Keyed by filename, guarded by collection.mu
+	Logger     *logrus.Entry
+}
+
+// lookup finds a secret by filename or alias.  The caller must hold the collection's lock.
+func (out *MemoryOutput) lookup(filename string) (Secret, bool) {
+	if secret, ok := out.secrets[filename]; ok {
+		return copySecret(secret), true
+	}
+	for _, secret := range out.secrets {
+		for _, alias := range secret.Aliases {
+			if alias == filename {
+				return copySecret(secret), true
+			}
+		}
+	}
+	return Secret{}, false
+}
+
+// Validate returns true if the secret is held with the same content and metadata as when it was written.
+func (out *MemoryOutput) Validate(secret *Secret, state secretState) bool {
+	if state.Checksum != secret.Checksum {
+		return false
+	}
+	if state.Owner != secret.Owner || state.Group != secret.Group || state.Mode != secret.Mode {
+		return false
+	}
+	if !equalStrings(state.Aliases, secret.Aliases) {
+		return false
+	}
+
+	filename, err := secret.Filename()
+	if err != nil {
+		return false
+	}
+
+	out.collection.mu.RLock()
+	held, ok := out.secrets[filename]
+	out.collection.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	return sha256.Sum256(held.Content) == state.ContentHash
+}
+
+// Write stores a copy of a secret.
+func (out *MemoryOutput) Write(secret *Secret) (*secretState, error) {
+	filename, err := secret.Filename()
+	if err != nil {
+		return nil, err
+	}
+	// Enforce the same mode parsing as OutputDir, even though nothing is written to a filesystem.
+	mode, err := secret.ModeValue()
+	if err != nil {
+		return nil, err
+	}
+
+	stored := copySecret(*secret)
+	out.collection.mu.Lock()
+	_, present := out.secrets[filename]
+	out.secrets[filename] = stored
+	out.collection.mu.Unlock()
+
+	change := Change{Client: out.client, Filename: filename, Type: SecretAdded}
+	if present {
+		change.Type = SecretChanged
+	}
+	out.collection.notify(change)
+
+	return &secretState{
+		ContentHash: sha256.Sum256(stored.Content),
+		Checksum:    secret.Checksum,
+		FileInfo:    output.FileInfo{Mode: mode},
+		Owner:       secret.Owner,
+		Group:       secret.Group,
+		Mode:        secret.Mode,
+		Aliases:     secret.Aliases,
+	}, nil
+}
+
+// Remove a secret.  Like deleting a file, it's an error if the secret isn't present.
+func (out *MemoryOutput) Remove(name string) error {
+	out.collection.mu.Lock()
+	_, present := out.secrets[name]
+	delete(out.secrets, name)
+	out.collection.mu.Unlock()
+
+	if !present {
+		return fmt.Errorf("secret %s not held for client %s", name, out.client)
+	}
+	out.collection.notify(Change{Client: out.client, Filename: name, Type: SecretRemoved})
+	return nil
+}
+
+// RemoveAll removes every secret, and the client itself from the collection.
+func (out *MemoryOutput) RemoveAll() (uint, error) {
+	out.collection.mu.Lock()
+	var changes []Change
+	for filename := range out.secrets {
+		changes = append(changes, Change{Client: out.client, Filename: filename, Type: SecretRemoved})
+	}
+	out.secrets = map[string]Secret{}
+	delete(out.collection.outputs, out.client)
+	out.collection.mu.Unlock()
+
+	out.collection.notify(changes...)
+	return uint(len(changes)), nil
+}
+
+// Cleanup removes secrets that aren't in the given map.
+func (out *MemoryOutput) Cleanup(secrets map[string]Secret) (uint, error) {
+	out.collection.mu.Lock()
+	var changes []Change
+	for filename := range out.secrets {
+		if _, present := secrets[filename]; !present {
+			out.Logger.WithField("file", filename).Info("Removing unknown secret")
+			delete(out.secrets, filename)
+			changes = append(changes, Change{Client: out.client, Filename: filename, Type: SecretRemoved})
+		}
+	}
+	out.collection.mu.Unlock()
+
+	out.collection.notify(changes...)
+	return uint(len(changes)), nil
+}
+
+// copySecret returns a copy of secret that shares no memory with it, so callers can't modify what we hold.
+func copySecret(secret Secret) Secret {
+	secret.Content = append(content(nil), secret.Content...)
+	secret.Aliases = append([]string(nil), secret.Aliases...)
+	if secret.FilenameOverride != nil {
+		filename := *secret.FilenameOverride
+		secret.FilenameOverride = &filename
+	}
+	return secret
+}
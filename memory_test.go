@@ -0,0 +1,160 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryOutputLifecycle(t *testing.T) {
+	collection := NewMemoryOutputCollection()
+	var changes []Change
+	collection.Notify(func(change Change) {
+		changes = append(changes, change)
+	})
+
+	out, err := collection.NewOutput(testClientConfig("client 1"), testLogger())
+	require.NoError(t, err)
+
+	secret := testSecret("secret")
+	secret.Aliases = []string{"alias"}
+	state, err := out.Write(&secret)
+	require.NoError(t, err)
+	assert.True(t, out.Validate(&secret, *state), "Expected just-written secret to be valid")
+
+	held, ok := collection.Secret("client 1", "secret")
+	require.True(t, ok)
+	assert.Equal(t, secret.Content, held.Content)
+	_, ok = collection.Secret("client 1", "alias")
+	assert.True(t, ok, "Expected secret to be readable by alias")
+
+	// Callers get a copy, so they can't tamper with what's held.
+	held.Content[0] = 'X'
+	assert.True(t, out.Validate(&secret, *state), "Expected secret to be unchanged by modifying a copy")
+
+	// Writing again is a change, and a different checksum isn't valid
+	_, err = out.Write(&secret)
+	require.NoError(t, err)
+	changed := secret
+	changed.Checksum = "DEF0"
+	assert.False(t, out.Validate(&changed, *state))
+
+	// Same validation of filenames and modes as OutputDir
+	bad := testSecret("../secret")
+	_, err = out.Write(&bad)
+	assert.Error(t, err)
+	bad = testSecret("secret")
+	bad.Mode = "9999"
+	_, err = out.Write(&bad)
+	assert.Error(t, err)
+
+	deleted, err := out.Cleanup(map[string]Secret{"secret": secret})
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+
+	require.NoError(t, out.Remove("secret"))
+	assert.Error(t, out.Remove("secret"), "Expected error removing a secret that's not held")
+	assert.False(t, out.Validate(&secret, *state), "Expected secret invalid after removal")
+
+	assert.Equal(t, []Change{
+		{Client: "client 1", Filename: "secret", Type: SecretAdded},
+		{Client: "client 1", Filename: "secret", Type: SecretChanged},
+		{Client: "client 1", Filename: "secret", Type: SecretRemoved},
+	}, changes)
+}
+
+func TestMemoryOutputCollectionCleanup(t *testing.T) {
+	collection := NewMemoryOutputCollection()
+	for _, name := range []string{"client 1", "client 2"} {
+		out, err := collection.NewOutput(testClientConfig(name), testLogger())
+		require.NoError(t, err)
+		secret := testSecret("secret")
+		_, err = out.Write(&secret)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"client 1", "client 2"}, collection.Clients())
+
+	deleted, errs := collection.Cleanup(map[string]struct{}{"client 1": {}}, testLogger())
+	assert.Empty(t, errs)
+	assert.EqualValues(t, 1, deleted)
+	assert.Equal(t, []string{"client 1"}, collection.Clients())
+	assert.Empty(t, collection.Secrets("client 2"))
+	assert.Len(t, collection.Secrets("client 1"), 1)
+}
+
+func TestMemoryOutputWithSyncer(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+
+	config, err := LoadConfig("fixtures/configs/test-config.yaml")
+	require.NoError(t, err)
+	collection := NewMemoryOutputCollection()
+	syncer, err := NewSyncer(config, collection, logrus.NewEntry(logrus.New()), metricsForTest())
+	require.NoError(t, err)
+	syncer.config.CaFile = testCaFile
+	resetSyncerServer(syncer, server)
+
+	// Read concurrently with syncing, which the race detector checks.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			collection.Secret("client1", "Nobody_PgPass")
+		}
+	}()
+	_, errs := syncer.RunOnce()
+	wg.Wait()
+	require.Empty(t, errs)
+
+	for _, entry := range syncer.clients {
+		secrets := collection.Secrets(entry.DirName)
+		assert.Len(t, secrets, 2)
+		assert.Equal(t, "0400", secrets["Nobody_PgPass"].Mode)
+	}
+}
+
+// This shows how to embed keysync in another program, holding secrets in memory.
+func ExampleMemoryOutputCollection() {
+	config, err := LoadConfig("keysync-config.yaml")
+	if err != nil {
+		panic(err)
+	}
+
+	secrets := NewMemoryOutputCollection()
+	secrets.Notify(func(change Change) {
+		fmt.Printf("%s changed in %s\n", change.Filename, change.Client)
+	})
+
+	syncer, err := NewSyncer(config, secrets, logrus.NewEntry(logrus.New()), metricsForTest())
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		if err := syncer.Run(); err != nil {
+			panic(err)
+		}
+	}()
+
+	if secret, ok := secrets.Secret("my-client", "my-secret"); ok {
+		fmt.Println(len(secret.Content))
+	}
+}
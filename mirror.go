@@ -0,0 +1,200 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package keysync
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mirrorManifest lists the files keysync wrote to a mirror directory, which are the only ones it will remove.
+const mirrorManifest = ".keysync-files"
+
+// MultiOutput writes a client's secrets to several outputs, such as a directory and its mirrors.
+// Each target is written, validated and cleaned up independently, so a broken target doesn't stop
+// secrets reaching the others.  It remembers the state written to each target, and only rewrites
+// targets that no longer validate.
+type MultiOutput struct {
+	Targets []*OutputDir
+	Logger  *logrus.Entry
+
+	mu     sync.Mutex
+	states map[string][]*secretState // Keyed by filename, one entry per target (nil if not written)
+}
+
+var _ Output = &MultiOutput{}
+
+// targetState returns the state we wrote to a target, if any.  The caller must hold mu.
+func (m *MultiOutput) targetState(filename string, target int) *secretState {
+	states, ok := m.states[filename]
+	if !ok {
+		return nil
+	}
+	return states[target]
+}
+
+// Validate returns true only if the secret is valid in every target.
+func (m *MultiOutput) Validate(secret *Secret, state secretState) bool {
+	filename, err := secret.Filename()
+	if err != nil {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, target := range m.Targets {
+		targetState := m.targetState(filename, i)
+		if targetState == nil || !target.Validate(secret, *targetState) {
+			return false
+		}
+	}
+	return true
+}
+
+// Write a secret to every target it isn't already valid in.  An error is only returned if no target
+// has the secret; targets that failed are retried on the next sync, as Validate won't pass until they succeed.
+func (m *MultiOutput) Write(secret *Secret) (*secretState, error) {
+	filename, err := secret.Filename()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.states == nil {
+		m.states = map[string][]*secretState{}
+	}
+	if _, ok := m.states[filename]; !ok {
+		m.states[filename] = make([]*secretState, len(m.Targets))
+	}
+
+	var written *secretState
+	var errs []error
+	for i, target := range m.Targets {
+		if state := m.targetState(filename, i); state != nil && target.Validate(secret, *state) {
+			written = state
+			continue
+		}
+		state, err := target.Write(secret)
+		if err != nil {
+			target.Logger.WithError(err).WithField("secret", filename).Error("Failed to write secret to target")
+			m.states[filename][i] = nil
+			errs = append(errs, err)
+			continue
+		}
+		m.states[filename][i] = state
+		written = state
+	}
+
+	if written == nil {
+		return nil, fmt.Errorf("failed writing to all targets: %v", errs)
+	}
+	return written, nil
+}
+
+// Remove a secret from every target.
+func (m *MultiOutput) Remove(name string) error {
+	m.mu.Lock()
+	delete(m.states, name)
+	m.mu.Unlock()
+
+	var errs []error
+	for _, target := range m.Targets {
+		if err := target.Remove(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return combineErrors(errs)
+}
+
+// RemoveAll removes the client's directory, and the files keysync wrote to each mirror.
+func (m *MultiOutput) RemoveAll() (uint, error) {
+	m.mu.Lock()
+	m.states = nil
+	m.mu.Unlock()
+
+	var deleted uint
+	var errs []error
+	for _, target := range m.Targets {
+		count, err := target.RemoveAll()
+		deleted += count
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return deleted, combineErrors(errs)
+}
+
+// Cleanup unknown files from the client's directory, and files keysync wrote to mirrors that are no longer needed.
+func (m *MultiOutput) Cleanup(secrets map[string]Secret) (uint, error) {
+	m.mu.Lock()
+	for filename := range m.states {
+		if _, present := secrets[filename]; !present {
+			delete(m.states, filename)
+		}
+	}
+	m.mu.Unlock()
+
+	var deleted uint
+	var errs []error
+	for _, target := range m.Targets {
+		count, err := target.Cleanup(secrets)
+		deleted += count
+		if err != nil {
+			target.Logger.WithError(err).Warn("Failed cleaning up target")
+			errs = append(errs, err)
+		}
+	}
+	return deleted, combineErrors(errs)
+}
+
+// staleMirrors returns the mirrors out writes to that aren't among mirrors, keyed by directory.
+func staleMirrors(out Output, mirrors []MirrorConfig) map[string]Output {
+	multi, ok := out.(*MultiOutput)
+	if !ok {
+		return nil
+	}
+	stale := map[string]Output{}
+	// The first target is the client's own directory.
+	for _, target := range multi.Targets[1:] {
+		stale[mirrorKey(target.WriteDirectory)] = target
+	}
+	for _, mirror := range mirrors {
+		delete(stale, mirrorKey(mirror.Directory))
+	}
+	return stale
+}
+
+// mirrorKey normalises a mirror directory, so "/srv/app/" and "/srv/app" are the same mirror.
+func mirrorKey(directory string) string {
+	if abs, err := filepath.Abs(directory); err == nil {
+		return abs
+	}
+	return filepath.Clean(directory)
+}
+
+// combineErrors returns nil for no errors, the error itself for one, and a summary otherwise.
+func combineErrors(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return fmt.Errorf("errors: %v", errs)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package keysync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirrors(t *testing.T) {
+	c := testConfig(t)
+	defer os.RemoveAll(c.SecretsDir)
+	mirrorDir, err := ioutil.TempDir("", "keysyncMirrorTest")
+	require.NoError(t, err)
+	defer os.RemoveAll(mirrorDir)
+
+	cc := testClientConfig("client 1")
+	cc.Mirrors = []MirrorConfig{
+		{Directory: filepath.Join(mirrorDir, "good")},
+		// Linux's /proc filesystem, which we'll never be writing to, so this mirror always fails.
+		{Directory: filepath.Join(mirrorDir, "broken"), FsType: 0x9fa0},
+	}
+	out, err := OutputDirCollection{Config: &c}.NewOutput(cc, testLogger())
+	require.NoError(t, err)
+	require.Len(t, out.(*MultiOutput).Targets, 3)
+
+	secret := testSecret("secret")
+	state, err := out.Write(&secret)
+	require.NoError(t, err, "Expected a broken mirror not to fail the write")
+
+	for _, dir := range []string{filepath.Join(c.SecretsDir, cc.DirName), filepath.Join(mirrorDir, "good")} {
+		filecontents, err := ioutil.ReadFile(filepath.Join(dir, "secret"))
+		assert.NoError(t, err)
+		assert.Equal(t, secret.Content, content(filecontents))
+	}
+	_, err = os.Stat(filepath.Join(mirrorDir, "broken", "secret"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Invalid until the broken mirror is written, so it's retried every sync.
+	assert.False(t, out.Validate(&secret, *state))
+
+	// Once fixed, the secret is valid everywhere.
+	out.(*MultiOutput).Targets[2].EnforceFilesystem = 0
+	state, err = out.Write(&secret)
+	require.NoError(t, err)
+	assert.True(t, out.Validate(&secret, *state))
+
+	// Tampering with one target only invalidates that one.
+	require.NoError(t, os.Remove(filepath.Join(mirrorDir, "good", "secret")))
+	assert.False(t, out.Validate(&secret, *state))
+	_, err = out.Write(&secret)
+	require.NoError(t, err)
+	assert.True(t, out.Validate(&secret, *state))
+
+	// Unknown files are removed from the client's directory, but a mirror's are the operator's.
+	for _, dir := range []string{filepath.Join(c.SecretsDir, cc.DirName), filepath.Join(mirrorDir, "good")} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "junk"), []byte("junk"), 0400))
+	}
+	deleted, err := out.Cleanup(map[string]Secret{"secret": secret})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, deleted)
+	_, err = os.Stat(filepath.Join(mirrorDir, "good", "junk"))
+	assert.NoError(t, err)
+
+	// Secrets keysync wrote to a mirror are removed once they're gone.
+	deleted, err = out.Cleanup(map[string]Secret{})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, deleted)
+	_, err = out.Write(&secret)
+	require.NoError(t, err)
+
+	require.NoError(t, out.Remove("secret"))
+	for _, dir := range []string{filepath.Join(c.SecretsDir, cc.DirName), filepath.Join(mirrorDir, "good"), filepath.Join(mirrorDir, "broken")} {
+		_, err = os.Stat(filepath.Join(dir, "secret"))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	_, err = out.Write(&secret)
+	require.NoError(t, err)
+	deleted, err = out.RemoveAll()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, deleted)
+
+	// Mirror directories, and anything keysync didn't write there, are left alone.
+	files, err := ioutil.ReadDir(filepath.Join(mirrorDir, "good"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "junk", files[0].Name())
+	_, err = os.Stat(filepath.Join(c.SecretsDir, cc.DirName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSyncerRemovesStaleMirrors(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+	c := testConfig(t)
+	defer os.RemoveAll(c.SecretsDir)
+	mirrorDir, err := ioutil.TempDir("", "keysyncMirrorTest")
+	require.NoError(t, err)
+	defer os.RemoveAll(mirrorDir)
+	clientsDir, err := ioutil.TempDir("", "keysync-clients")
+	require.NoError(t, err)
+	defer os.RemoveAll(clientsDir)
+
+	clientCertPath, _ := filepath.Abs(clientCert)
+	clientKeyPath, _ := filepath.Abs(clientKey)
+	writeClients := func(mirrors ...string) {
+		clientYAML := fmt.Sprintf("client1:\n  cert: %s\n  key: %s\n  mirrors:\n", clientCertPath, clientKeyPath)
+		for _, mirror := range mirrors {
+			clientYAML += fmt.Sprintf("    - directory: %s/%s\n", mirrorDir, mirror)
+		}
+		require.NoError(t, ioutil.WriteFile(filepath.Join(clientsDir, "client1.yaml"), []byte(clientYAML), 0600))
+	}
+
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", server)
+	require.NoError(t, err)
+	syncer.config.ClientsDir = clientsDir
+	syncer.config.SecretsDir = c.SecretsDir
+	syncer.outputCollection = OutputDirCollection{Config: syncer.config}
+
+	writeClients("kept", "dropped")
+	require.NoError(t, os.MkdirAll(filepath.Join(mirrorDir, "dropped"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(mirrorDir, "dropped", "other"), []byte("other"), 0400))
+	_, errs := syncer.RunOnce()
+	require.Empty(t, errs)
+	_, err = os.Stat(filepath.Join(mirrorDir, "dropped", "Nobody_PgPass"))
+	require.NoError(t, err)
+
+	// A mirror removed from the config has the secrets keysync wrote removed, and nothing else.  One written
+	// differently is the same mirror.
+	writeClients("kept/")
+	_, errs = syncer.RunOnce()
+	require.Empty(t, errs)
+	files, err := ioutil.ReadDir(filepath.Join(mirrorDir, "dropped"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "other", files[0].Name())
+	_, err = os.Stat(filepath.Join(mirrorDir, "kept", "Nobody_PgPass"))
+	assert.NoError(t, err)
+}
+
+func TestMirrorValidation(t *testing.T) {
+	config := Config{SecretsDir: "/secrets"}
+	cc := testClientConfig("client 1")
+
+	cc.Mirrors = []MirrorConfig{{Directory: "relative"}}
+	assert.Error(t, cc.validate(&config))
+
+	cc.Mirrors = []MirrorConfig{{Directory: "/secrets/nested"}}
+	assert.Error(t, cc.validate(&config))
+
+	cc.Mirrors = []MirrorConfig{{Directory: "/container/secrets"}}
+	assert.NoError(t, cc.validate(&config))
+}
@@ -0,0 +1,70 @@
+package output
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ACLEntry grants read access to a file to a user or group, in addition to its owner and group.
+// Like file modes, only read access is supported.
+type ACLEntry struct {
+	Group bool // The entry is for a group if true, otherwise for a user
+	ID    int
+}
+
+// ACL is a list of extended POSIX ACL entries.
+type ACL []ACLEntry
+
+// String returns the canonical form of an ACL, as stored in FileInfo: entries are sorted users first, then
+// groups, by ID, formatted like "user:1000:r,group:2000:r".  It's empty for an ACL with no entries.
+func (acl ACL) String() string {
+	sorted := append(ACL{}, acl...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Group != sorted[j].Group {
+			return !sorted[i].Group
+		}
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	var entries []string
+	for i, entry := range sorted {
+		if i > 0 && entry == sorted[i-1] {
+			continue
+		}
+		tag := "user"
+		if entry.Group {
+			tag = "group"
+		}
+		entries = append(entries, fmt.Sprintf("%s:%d:r", tag, entry.ID))
+	}
+	return strings.Join(entries, ",")
+}
+
+// ParseACL parses the canonical form returned by ACL.String.
+func ParseACL(s string) (ACL, error) {
+	var acl ACL
+	if s == "" {
+		return acl, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) != 3 || fields[2] != "r" {
+			return nil, fmt.Errorf("invalid ACL entry '%s'", entry)
+		}
+		id, err := strconv.ParseUint(fields[1], 10 /* base */, 32 /* bits */)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACL entry '%s': %v", entry, err)
+		}
+		switch fields[0] {
+		case "user":
+			acl = append(acl, ACLEntry{ID: int(id)})
+		case "group":
+			acl = append(acl, ACLEntry{Group: true, ID: int(id)})
+		default:
+			return nil, fmt.Errorf("invalid ACL entry '%s'", entry)
+		}
+	}
+	return acl, nil
+}
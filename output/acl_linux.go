@@ -0,0 +1,105 @@
+package output
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants from linux/posix_acl_xattr.h and linux/posix_acl.h
+const (
+	aclXattr      = "system.posix_acl_access"
+	aclVersion    = 2
+	aclUserObj    = 0x01
+	aclUser       = 0x02
+	aclGroupObj   = 0x04
+	aclGroup      = 0x08
+	aclMask       = 0x10
+	aclOther      = 0x20
+	aclUndefined  = 0xffffffff
+	aclRead       = 0x04
+	aclEntrySize  = 8
+	aclHeaderSize = 4
+)
+
+// setACL sets the access ACL on an open file, as setfacl would.  The owner, group and other entries
+// come from mode, and the mask allows reading if the group or any named entry can.
+// Setting an ACL updates the group bits of the file mode to the mask.
+func setACL(file *os.File, acl ACL, mode os.FileMode) error {
+	acl, err := ParseACL(acl.String()) // Sorted and de-duplicated, as the kernel requires
+	if err != nil {
+		return err
+	}
+
+	perm := func(bits os.FileMode) uint16 {
+		if mode&bits != 0 {
+			return aclRead
+		}
+		return 0
+	}
+
+	buf := make([]byte, aclHeaderSize, aclHeaderSize+aclEntrySize*(len(acl)+4))
+	binary.LittleEndian.PutUint32(buf, aclVersion)
+	add := func(tag, perm uint16, id uint32) {
+		entry := make([]byte, aclEntrySize)
+		binary.LittleEndian.PutUint16(entry[0:], tag)
+		binary.LittleEndian.PutUint16(entry[2:], perm)
+		binary.LittleEndian.PutUint32(entry[4:], id)
+		buf = append(buf, entry...)
+	}
+
+	add(aclUserObj, perm(0400), aclUndefined)
+	for _, entry := range acl {
+		if !entry.Group {
+			add(aclUser, aclRead, uint32(entry.ID))
+		}
+	}
+	add(aclGroupObj, perm(0040), aclUndefined)
+	for _, entry := range acl {
+		if entry.Group {
+			add(aclGroup, aclRead, uint32(entry.ID))
+		}
+	}
+	add(aclMask, aclRead, aclUndefined)
+	add(aclOther, perm(0004), aclUndefined)
+
+	return unix.Fsetxattr(int(file.Fd()), aclXattr, buf, 0)
+}
+
+// getACL reads the named user and group entries of a file's access ACL.  Files without an ACL, or on
+// filesystems that don't support them, have an empty ACL.
+func getACL(file *os.File) (ACL, error) {
+	fd := int(file.Fd())
+	size, err := unix.Fgetxattr(fd, aclXattr, nil)
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Fgetxattr(fd, aclXattr, buf)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:size]
+
+	var acl ACL
+	for offset := aclHeaderSize; offset+aclEntrySize <= len(buf); offset += aclEntrySize {
+		tag := binary.LittleEndian.Uint16(buf[offset:])
+		perm := binary.LittleEndian.Uint16(buf[offset+2:])
+		id := int(binary.LittleEndian.Uint32(buf[offset+4:]))
+		if (tag == aclUser || tag == aclGroup) && perm != aclRead {
+			// Keysync never writes these, so someone has changed the file
+			return nil, fmt.Errorf("unexpected ACL permissions %o for id %d", perm, id)
+		}
+		switch tag {
+		case aclUser:
+			acl = append(acl, ACLEntry{ID: id})
+		case aclGroup:
+			acl = append(acl, ACLEntry{Group: true, ID: id})
+		}
+	}
+	return acl, nil
+}
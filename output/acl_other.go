@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package output
+
+import (
+	"errors"
+	"os"
+)
+
+// setACL is only implemented on Linux.
+func setACL(file *os.File, acl ACL, mode os.FileMode) error {
+	return errors.New("POSIX ACLs are only supported on linux")
+}
+
+// getACL always returns an empty ACL, as ACLs are only supported on linux.
+func getACL(file *os.File) (ACL, error) {
+	return nil, nil
+}
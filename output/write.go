@@ -15,6 +15,9 @@ type FileInfo struct {
 	Mode os.FileMode
 	UID  int
 	GID  int
+	// ACL is the extended ACL in the canonical form from ACL.String, empty if there's none.
+	// It's a string so that FileInfo can be compared with ==.
+	ACL string
 }
 
 // GetFileInfo from an open file
@@ -27,7 +30,12 @@ func GetFileInfo(file *os.File) (*FileInfo, error) {
 	uid := int(stat.Sys().(*syscall.Stat_t).Uid)
 	gid := int(stat.Sys().(*syscall.Stat_t).Gid)
 
-	return &FileInfo{filemode, uid, gid}, nil
+	acl, err := getACL(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ACL: %v", err)
+	}
+
+	return &FileInfo{filemode, uid, gid, acl.String()}, nil
 }
 
 // WriteFileAtomically creates a temporary file, sets perms, writes content, and renames it to filename
@@ -73,6 +81,17 @@ func WriteFileAtomically(path string, chownFiles bool, fileInfo FileInfo, enforc
 		return nil, err
 	}
 
+	// The ACL is set after the mode, as it sets the mode's group bits to its mask.
+	if fileInfo.ACL != "" {
+		acl, err := ParseACL(fileInfo.ACL)
+		if err != nil {
+			return nil, err
+		}
+		if err := setACL(f, acl, fileInfo.Mode); err != nil {
+			return nil, fmt.Errorf("failed setting ACL: %v", err)
+		}
+	}
+
 	if enforceFilesystem != 0 {
 		good, err := isFilesystem(f, enforceFilesystem)
 		if err != nil {
@@ -105,6 +124,28 @@ func WriteFileAtomically(path string, chownFiles bool, fileInfo FileInfo, enforc
 	return fileinfo, nil
 }
 
+// SymlinkAtomically points the symlink at path to target, replacing anything already there.
+// Like WriteFileAtomically, the link is created under a temporary name and renamed into place.
+func SymlinkAtomically(target, path string) error {
+	path = filepath.Clean(path)
+	if strings.Contains(path, "..") {
+		return fmt.Errorf("non-canonical file path: %s", path)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	tmp := path + hex.EncodeToString(buf)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	// Try to remove the link, in event the rename fails.
+	defer os.Remove(tmp)
+
+	return os.Rename(tmp, path)
+}
+
 // The Filesystem identification.  On Mac, this is uint32, and int64 on linux
 // So both are safe to store as an int64.
 // Linux Tmpfs = 0x01021994
@@ -0,0 +1,415 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/square/keysync/backup"
+)
+
+// RecordConfig makes a Keywhiz client record its requests and responses, for replay with backend: replay.
+type RecordConfig struct {
+	Path      string `yaml:"path"`       // Mandatory: JSON lines are appended to this file
+	PublicKey string `yaml:"public_key"` // Optional: Encrypt secret contents to this key, from keyunwrap generate
+}
+
+// ReplayConfig is the recording a client with backend: replay reads its secrets from.
+type ReplayConfig struct {
+	Path       string `yaml:"path"`        // Mandatory: A recording made with a RecordConfig
+	PrivateKey string `yaml:"private_key"` // Optional: Decrypts secret contents, if they were encrypted
+}
+
+func (cfg RecordConfig) validate() error {
+	if cfg.PublicKey == "" {
+		return nil
+	}
+	_, err := backup.ParsePublicKey(cfg.PublicKey)
+	return err
+}
+
+func (cfg ReplayConfig) validate() error {
+	if cfg.Path == "" {
+		return errors.New("replay backend needs replay.path")
+	}
+	return nil
+}
+
+// recordedExchange is one line of a recording: a request and the response to it, or the error sending it.
+// Secret contents in the response never appear in clear: each secret's "secret" is replaced by "secretHash", its
+// SHA-256, and "secretSealed", its contents sealed to the recording's public key if it has one.  Successful
+// responses that can't be parsed, such as truncated ones, are left out entirely in case they hold secrets.
+type recordedExchange struct {
+	Time        time.Time       `json:"time"`
+	Server      string          `json:"server"`
+	Method      string          `json:"method"`
+	Path        string          `json:"path"`
+	Request     string          `json:"request,omitempty"` // The body of a batch request, which is secret names
+	Status      int             `json:"status,omitempty"`
+	Error       string          `json:"error,omitempty"` // Sending the request or reading the response failed
+	Body        json.RawMessage `json:"body,omitempty"`
+	BodyText    string          `json:"bodyText,omitempty"` // An error response's message
+	BodyOmitted bool            `json:"bodyOmitted,omitempty"`
+	BodyHash    string          `json:"bodyHash,omitempty"` // The SHA-256 of an omitted body
+}
+
+// recorder appends exchanges to a recording.
+type recorder struct {
+	mu        sync.Mutex
+	file      *os.File
+	recipient *[32]byte
+	logger    *logrus.Entry
+}
+
+func newRecorder(cfg RecordConfig, logger *logrus.Entry) (*recorder, error) {
+	var recipient *[32]byte
+	if cfg.PublicKey != "" {
+		var err error
+		if recipient, err = backup.ParsePublicKey(cfg.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening recording: %v", err)
+	}
+	return &recorder{file: file, recipient: recipient, logger: logger}, nil
+}
+
+// record writes an exchange.  Failing to record is logged rather than failing the request.
+func (r *recorder) record(req *http.Request, requestBody []byte, resp *http.Response, body []byte, err error) {
+	exchange := recordedExchange{
+		Time:    time.Now().UTC(),
+		Server:  req.URL.Host,
+		Method:  req.Method,
+		Path:    req.URL.Path,
+		Request: string(requestBody),
+	}
+	if err != nil {
+		exchange.Error = err.Error()
+	}
+	if resp != nil {
+		exchange.Status = resp.StatusCode
+		r.recordBody(&exchange, body)
+	}
+
+	line, err := json.Marshal(exchange)
+	if err != nil {
+		r.logger.WithError(err).Warn("Failed to record exchange")
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.file.Write(append(line, '\n')); err != nil {
+		r.logger.WithError(err).Warn("Failed to record exchange")
+	}
+}
+
+func (r *recorder) recordBody(exchange *recordedExchange, body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	if exchange.Status != http.StatusOK {
+		// Error messages from Keywhiz don't hold secrets.
+		exchange.BodyText = string(body)
+		return
+	}
+	sanitized, err := r.sanitize(body)
+	if err != nil {
+		sum := sha256.Sum256(body)
+		exchange.BodyOmitted = true
+		exchange.BodyHash = hex.EncodeToString(sum[:])
+		return
+	}
+	exchange.Body = sanitized
+}
+
+// sanitize replaces the contents of the secrets in a response, which is either a secret or a list of them.
+func (r *recorder) sanitize(body []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var objects []map[string]interface{}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		objects = append(objects, v)
+	case []interface{}:
+		for _, item := range v {
+			object, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("expected a list of secrets")
+			}
+			objects = append(objects, object)
+		}
+	default:
+		return nil, errors.New("expected a secret or list of secrets")
+	}
+
+	for _, object := range objects {
+		encoded, ok := object["secret"].(string)
+		if !ok || encoded == "" {
+			continue
+		}
+		var contents content
+		if err := contents.UnmarshalJSON([]byte(`"` + encoded + `"`)); err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(contents)
+		object["secret"] = ""
+		object["secretHash"] = hex.EncodeToString(sum[:])
+		if r.recipient != nil {
+			sealed, err := backup.Seal(contents, r.recipient)
+			if err != nil {
+				return nil, err
+			}
+			object["secretSealed"] = base64.StdEncoding.EncodeToString(sealed)
+		}
+	}
+	return json.Marshal(value)
+}
+
+// recordingTransport records every exchange sent through it, including each retry.  Response bodies are read in
+// full so they can be recorded, so a recording client doesn't stream secrets.  Only up to limit bytes are read,
+// as for any other response.
+type recordingTransport struct {
+	next     http.RoundTripper
+	recorder *recorder
+	limit    int64 // If positive, the longest response body to read
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var requestBody []byte
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			requestBody, _ = ioutil.ReadAll(body)
+			body.Close()
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.recorder.record(req, requestBody, nil, nil, err)
+		return nil, err
+	}
+	if t.limit > 0 {
+		resp.Body = limitBody(resp.Body, t.limit)
+	}
+	body, readErr := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	t.recorder.record(req, requestBody, resp, body, readErr)
+	resp.Body = &replayedBody{Reader: bytes.NewReader(body), err: readErr}
+	return resp, nil
+}
+
+// CloseIdleConnections passes through to the wrapped transport, so replacing a recording client closes its
+// connections.
+func (t *recordingTransport) CloseIdleConnections() {
+	if closer, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+// replayedBody is a response body that ends with err, if there is one, instead of io.EOF.
+type replayedBody struct {
+	*bytes.Reader
+	err error
+}
+
+func (b *replayedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF && b.err != nil {
+		err = b.err
+	}
+	return n, err
+}
+
+func (b *replayedBody) Close() error {
+	return nil
+}
+
+// replayTransport answers requests from a recording.  Each request gets the first response recorded for the same
+// method and path that hasn't been replayed yet, so retries and failures replay as they happened.
+type replayTransport struct {
+	mu         sync.Mutex
+	exchanges  []recordedExchange
+	replayed   []bool
+	privateKey []byte
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, exchange := range t.exchanges {
+		if t.replayed[i] || exchange.Method != req.Method || exchange.Path != req.URL.Path {
+			continue
+		}
+		t.replayed[i] = true
+		if exchange.Status == 0 {
+			return nil, fmt.Errorf("recorded error: %s", exchange.Error)
+		}
+		body, err := t.body(exchange)
+		if err != nil {
+			return nil, err
+		}
+		var readErr error
+		if exchange.Error != "" {
+			readErr = fmt.Errorf("recorded error: %s", exchange.Error)
+		}
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", exchange.Status, http.StatusText(exchange.Status)),
+			StatusCode: exchange.Status,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       &replayedBody{Reader: bytes.NewReader(body), err: readErr},
+			Request:    req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded response left for %s %s", req.Method, req.URL.Path)
+}
+
+// body restores a recorded response body.  Secrets get their contents back if they were sealed and there's a
+// private key, and otherwise get their hash as their contents, so that changed contents still replay as changes.
+func (t *replayTransport) body(exchange recordedExchange) ([]byte, error) {
+	if exchange.BodyText != "" {
+		return []byte(exchange.BodyText), nil
+	}
+	if len(exchange.Body) == 0 {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(exchange.Body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("parsing recorded response: %v", err)
+	}
+
+	var objects []interface{}
+	if list, ok := value.([]interface{}); ok {
+		objects = list
+	} else {
+		objects = []interface{}{value}
+	}
+	for _, item := range objects {
+		object, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		hash, ok := object["secretHash"].(string)
+		if !ok {
+			continue
+		}
+		contents := []byte("sha256:" + hash)
+		if sealed, ok := object["secretSealed"].(string); ok && t.privateKey != nil {
+			data, err := base64.StdEncoding.DecodeString(sealed)
+			if err != nil {
+				return nil, fmt.Errorf("decoding recorded secret: %v", err)
+			}
+			if contents, err = backup.Open(data, t.privateKey); err != nil {
+				return nil, fmt.Errorf("opening recorded secret: %v", err)
+			}
+		}
+		object["secret"] = base64.StdEncoding.EncodeToString(contents)
+		delete(object, "secretHash")
+		delete(object, "secretSealed")
+	}
+	return json.Marshal(value)
+}
+
+// readRecording reads the exchanges in a recording.
+func readRecording(path string) ([]recordedExchange, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening recording: %v", err)
+	}
+	defer file.Close()
+
+	var exchanges []recordedExchange
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var exchange recordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &exchange); err != nil {
+			return nil, fmt.Errorf("recording %s line %d: %v", path, line, err)
+		}
+		exchanges = append(exchanges, exchange)
+	}
+	return exchanges, scanner.Err()
+}
+
+// NewReplayClient returns a Keywhiz client that reads from a recording instead of a server.  It behaves as the
+// recorded client did, with the same retries and secret mapping, so a sync against it reproduces a recorded one.
+func NewReplayClient(cfg *ClientConfig, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) (Client, error) {
+	logger = logger.WithField("logger", "replay_client")
+
+	exchanges, err := readRecording(cfg.Replay.Path)
+	if err != nil {
+		return nil, err
+	}
+	transport := &replayTransport{exchanges: exchanges, replayed: make([]bool, len(exchanges))}
+	if cfg.Replay.PrivateKey != "" {
+		if transport.privateKey, err = ioutil.ReadFile(cfg.Replay.PrivateKey); err != nil {
+			return nil, fmt.Errorf("reading replay private key: %v", err)
+		}
+	}
+
+	params := httpClientParams{
+		transport:  transport,
+		maxRetries: int(cfg.MaxRetries),
+		// Recorded retries are replayed without waiting for them.
+		minBackoff: time.Nanosecond,
+		maxBackoff: time.Nanosecond,
+	}
+	initial, err := params.buildClient()
+	if err != nil {
+		return nil, err
+	}
+	return &KeywhizHTTPClient{
+		logger:      logger,
+		httpClient:  initial,
+		servers:     singleServerPool(&url.URL{Scheme: "https", Host: "replay"}, metricsHandle),
+		params:      params,
+		mapping:     cfg.SecretMapping,
+		failCount:   metrics.NewCounter(),
+		lastSuccess: metrics.NewGauge(),
+		retries:     newRetryMetrics(metrics.NewRegistry()),
+	}, nil
+}
@@ -0,0 +1,191 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/square/keysync/keywhiztest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// recordSyncs syncs three times against a fake Keywhiz, changing it between syncs, and returns what each sync did.
+func recordSyncs(t *testing.T, clientConfig *ClientConfig) []Updated {
+	tlsConfig, err := keywhiztest.TLSConfig(testCaFile, testCaFile, "fixtures/CA/cacert.crt")
+	require.Nil(t, err)
+	fake := keywhiztest.New(
+		keywhiztest.Secret{Name: "one", Content: []byte("first secret")},
+		keywhiztest.Secret{Name: "two", Content: []byte("second secret")},
+	)
+	server := fake.StartTLS(tlsConfig)
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.Nil(t, err)
+
+	client, err := NewClient(clientConfig, testCaFile, serverURL, testLogger(), metricsForTest())
+	require.Nil(t, err)
+	return syncThrice(t, client, func(i int) {
+		switch i {
+		case 1:
+			fake.Set(keywhiztest.Secret{Name: "one", Content: []byte("edited secret")})
+			fake.Inject(keywhiztest.Fault{Path: "/secrets", Status: http.StatusServiceUnavailable, Times: 1})
+		case 2:
+			fake.Set(keywhiztest.Secret{Name: "two", Content: []byte("edited again")})
+			fake.DeleteAfterList("two")
+		}
+	})
+}
+
+func syncThrice(t *testing.T, client Client, before func(int)) []Updated {
+	output, err := NewMemoryOutputCollection().NewOutput(testClientConfig("client1"), testLogger())
+	require.Nil(t, err)
+	entry := &syncerEntry{client, ClientConfig{}, output, map[string]secretState{}}
+	var results []Updated
+	for i := 0; i < 3; i++ {
+		before(i)
+		updated, err := entry.Sync()
+		require.Nil(t, err)
+		results = append(results, updated)
+	}
+	return results
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-record")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	clientConfig := defaultClientConfig()
+	clientConfig.MaxRetries = 3
+	clientConfig.Record.Path = filepath.Join(dir, "recording.jsonl")
+	recorded := recordSyncs(t, clientConfig)
+	assert.Equal(t, []Updated{{Added: 2}, {Changed: 1}, {Deleted: 1}}, recorded)
+
+	recording, err := ioutil.ReadFile(clientConfig.Record.Path)
+	require.Nil(t, err)
+	assert.NotContains(t, string(recording), base64.StdEncoding.EncodeToString([]byte("first secret")))
+	assert.NotContains(t, string(recording), "first secret")
+	assert.Contains(t, string(recording), `"status":503`)
+
+	replayConfig := defaultClientConfig()
+	replayConfig.MaxRetries = 3
+	replayConfig.Replay.Path = clientConfig.Record.Path
+	client, err := NewReplayClient(replayConfig, testLogger(), metricsForTest())
+	require.Nil(t, err)
+	assert.Equal(t, recorded, syncThrice(t, client, func(int) {}))
+
+	// Without the contents, secrets replay with their hash as their contents.
+	client, err = NewReplayClient(replayConfig, testLogger(), metricsForTest())
+	require.Nil(t, err)
+	_, err = client.SecretList()
+	require.Nil(t, err)
+	secrets, err := client.SecretListWithContents([]string{"one", "two"})
+	require.Nil(t, err)
+	assert.Regexp(t, "^sha256:[0-9a-f]{64}$", string(secrets["one"].Content))
+
+	// The failed listing is retried, then there's nothing left to replay.
+	for i := 0; i < 2; i++ {
+		_, err = client.SecretList()
+		require.Nil(t, err)
+	}
+	_, err = client.SecretList()
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no recorded response left for GET /secrets")
+}
+
+func TestRecordEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-record")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	pubkey, privkey, err := box.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	keyFile := filepath.Join(dir, "private.key")
+	require.Nil(t, ioutil.WriteFile(keyFile, privkey[:], 0600))
+
+	clientConfig := defaultClientConfig()
+	clientConfig.MaxRetries = 3
+	clientConfig.Record = RecordConfig{
+		Path:      filepath.Join(dir, "recording.jsonl"),
+		PublicKey: base64.StdEncoding.EncodeToString(pubkey[:]),
+	}
+	recordSyncs(t, clientConfig)
+
+	replayConfig := defaultClientConfig()
+	replayConfig.Replay = ReplayConfig{Path: clientConfig.Record.Path, PrivateKey: keyFile}
+	client, err := NewReplayClient(replayConfig, testLogger(), metricsForTest())
+	require.Nil(t, err)
+	_, err = client.SecretList()
+	require.Nil(t, err)
+	secrets, err := client.SecretListWithContents([]string{"one", "two"})
+	require.Nil(t, err)
+	assert.EqualValues(t, "first secret", secrets["one"].Content)
+	assert.EqualValues(t, "second secret", secrets["two"].Content)
+}
+
+func TestRecordConfigValidation(t *testing.T) {
+	cfg := &Config{SecretsDir: "/tmp/keysync-secrets"}
+	client := ClientConfig{Backend: BackendReplay}
+	assert.EqualError(t, client.validate(cfg), "replay backend needs replay.path")
+	client.Replay.Path = "recording.jsonl"
+	assert.Nil(t, client.validate(cfg), "Replaying needs no key")
+
+	client = ClientConfig{Key: "client.key", Record: RecordConfig{Path: "recording.jsonl", PublicKey: "bm90IGEga2V5"}}
+	assert.EqualError(t, client.validate(cfg), "bad record config: public key wasn't 32 bytes: 9")
+	client.Record.PublicKey = ""
+	assert.Nil(t, client.validate(cfg))
+	client.Backend = BackendVault
+	client.Vault = VaultConfig{Address: "https://vault:8200", Path: "app"}
+	assert.EqualError(t, client.validate(cfg), "record is only supported with backend: keywhiz")
+}
+
+func TestRecordRespectsResponseLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysync-record")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	tlsConfig, err := keywhiztest.TLSConfig(testCaFile, testCaFile, "fixtures/CA/cacert.crt")
+	require.Nil(t, err)
+	fake := keywhiztest.New(keywhiztest.Secret{Name: "big", Content: make([]byte, 1<<20)})
+	server := fake.StartTLS(tlsConfig)
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.Nil(t, err)
+
+	clientConfig := defaultClientConfig()
+	clientConfig.ResponseLimit = 1024
+	clientConfig.Record.Path = filepath.Join(dir, "recording.jsonl")
+	client, err := NewClient(clientConfig, testCaFile, serverURL, testLogger(), metricsForTest())
+	require.Nil(t, err)
+
+	_, err = client.SecretListWithContents([]string{"big"})
+	var tooLarge ResponseTooLarge
+	require.True(t, errors.As(err, &tooLarge), "%v", err)
+
+	// The recording stopped reading at the limit, too.
+	recording, err := ioutil.ReadFile(clientConfig.Record.Path)
+	require.Nil(t, err)
+	assert.Contains(t, string(recording), "response is larger than the limit of 1024 bytes")
+}
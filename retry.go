@@ -0,0 +1,129 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Reasons a request is retried, used in log messages and as metric names.
+const (
+	retryConnection  = "connection"
+	retryServerError = "server_error"
+	retryRateLimited = "rate_limited"
+)
+
+// retryReason classifies a failed request.  It returns "" if retrying wouldn't help, including for successes.
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return ""
+		}
+		// A server that fails verification will fail it again.
+		var pinErr PinMismatch
+		var revoked CertificateRevoked
+		var unknownAuthority x509.UnknownAuthorityError
+		var invalid x509.CertificateInvalidError
+		var hostname x509.HostnameError
+		if errors.As(err, &pinErr) || errors.As(err, &revoked) || errors.As(err, &unknownAuthority) ||
+			errors.As(err, &invalid) || errors.As(err, &hostname) {
+			return ""
+		}
+		return retryConnection
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return retryRateLimited
+	case isServerError(resp) && resp.StatusCode != http.StatusNotImplemented:
+		return retryServerError
+	}
+	return ""
+}
+
+// isServerError is true for a 5xx response, which makes the server pool try the next server.
+func isServerError(resp *http.Response) bool {
+	return resp.StatusCode >= 500
+}
+
+// retryAfter returns how long the response asks us to wait, from a Retry-After header in seconds or as an HTTP
+// date.  It returns 0 if there's no usable header.
+func retryAfter(resp *http.Response, now time.Time) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// retryMetrics counts retries by reason, and requests that weren't retried because the budget ran out.
+type retryMetrics struct {
+	byReason        map[string]metrics.Counter
+	budgetExhausted metrics.Counter
+}
+
+func newRetryMetrics(registry metrics.Registry) retryMetrics {
+	m := retryMetrics{
+		byReason:        map[string]metrics.Counter{},
+		budgetExhausted: metrics.GetOrRegisterCounter("runtime.server.retry_budget_exhausted", registry),
+	}
+	for _, reason := range []string{retryConnection, retryServerError, retryRateLimited} {
+		m.byReason[reason] = metrics.GetOrRegisterCounter("runtime.server.retries."+reason, registry)
+	}
+	return m
+}
+
+type retryBudgetKey struct{}
+
+// retryBudget is shared by every request made with a context from WithRetryBudget.
+type retryBudget struct {
+	remaining int64
+}
+
+// WithRetryBudget limits the total number of retries made by requests using the returned context, so one sync
+// against a struggling server can't spend max_retries on every secret.  Requests still make their first attempt
+// once the budget is spent.
+func WithRetryBudget(ctx context.Context, retries int) context.Context {
+	return context.WithValue(ctx, retryBudgetKey{}, &retryBudget{remaining: int64(retries)})
+}
+
+// takeRetry spends one retry from the context's budget, returning false if none are left.
+// A context without a budget allows unlimited retries.
+func takeRetry(ctx context.Context) bool {
+	budget, ok := ctx.Value(retryBudgetKey{}).(*retryBudget)
+	if !ok {
+		return true
+	}
+	return atomic.AddInt64(&budget.remaining, -1) >= 0
+}
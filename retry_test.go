@@ -0,0 +1,231 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sirupsen/logrus"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryReason(t *testing.T) {
+	status := func(code int) *http.Response { return &http.Response{StatusCode: code} }
+
+	assert.Equal(t, "", retryReason(status(200), nil))
+	assert.Equal(t, "", retryReason(status(404), nil))
+	assert.Equal(t, "", retryReason(status(501), nil))
+	assert.Equal(t, retryServerError, retryReason(status(500), nil))
+	assert.Equal(t, retryServerError, retryReason(status(503), nil))
+	assert.Equal(t, retryRateLimited, retryReason(status(429), nil))
+	assert.Equal(t, retryConnection, retryReason(nil, errors.New("connection refused")))
+	assert.Equal(t, "", retryReason(nil, &url.Error{Op: "Get", URL: "https://example.com", Err: context.Canceled}))
+	assert.Equal(t, "", retryReason(nil, &url.Error{Op: "Get", URL: "https://example.com", Err: PinMismatch{}}))
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	header := func(value string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": []string{value}}}
+	}
+
+	assert.Equal(t, 3*time.Second, retryAfter(header("3"), now))
+	assert.Equal(t, 90*time.Second, retryAfter(header(now.Add(90*time.Second).Format(http.TimeFormat)), now))
+	assert.Equal(t, time.Duration(0), retryAfter(header(now.Add(-time.Hour).Format(http.TimeFormat)), now))
+	assert.Equal(t, time.Duration(0), retryAfter(header("soon"), now))
+	assert.Equal(t, time.Duration(0), retryAfter(header("-1"), now))
+	assert.Equal(t, time.Duration(0), retryAfter(&http.Response{}, now))
+	assert.Equal(t, time.Duration(0), retryAfter(nil, now))
+}
+
+// newRetryClient returns a client for server with its own metrics registry, so counters start at zero.
+func newRetryClient(t *testing.T, server *httptest.Server, maxRetries uint16) (*KeywhizHTTPClient, metrics.Registry) {
+	serverURL, _ := url.Parse(server.URL)
+	cfg := defaultClientConfig()
+	cfg.MaxRetries = maxRetries
+	registry := metrics.NewRegistry()
+	client, err := NewClient(cfg, testCaFile, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{Registry: registry})
+	require.Nil(t, err)
+	return client.(*KeywhizHTTPClient), registry
+}
+
+func counterValue(registry metrics.Registry, name string) int64 {
+	return registry.Get(name).(metrics.Counter).Count()
+}
+
+func TestClientRetriesRateLimited(t *testing.T) {
+	var hits int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write(fixture("secretsWithoutContent.json"))
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	client, registry := newRetryClient(t, server, 3)
+	secrets, err := client.SecretList()
+	require.Nil(t, err)
+	assert.Len(t, secrets, 2)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&hits))
+	assert.EqualValues(t, 1, counterValue(registry, "runtime.server.retries.rate_limited"))
+	assert.EqualValues(t, 0, counterValue(registry, "runtime.server.retries.server_error"))
+}
+
+func TestClientDoesNotWaitPastMaxBackoff(t *testing.T) {
+	var hits int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	defer server.Close()
+
+	client, registry := newRetryClient(t, server, 3)
+	_, err := client.SecretList()
+	assert.NotNil(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&hits))
+	assert.EqualValues(t, 0, counterValue(registry, "runtime.server.retries.rate_limited"))
+}
+
+func TestClientRetriesConnectionErrors(t *testing.T) {
+	server := createDefaultServer()
+	server.Close()
+
+	client, registry := newRetryClient(t, server, 3)
+	_, err := client.SecretList()
+	assert.NotNil(t, err)
+	assert.EqualValues(t, 2, counterValue(registry, "runtime.server.retries.connection"))
+}
+
+func TestClientRetryBudget(t *testing.T) {
+	var hits int32
+	server := createFailingServer(&hits)
+	defer server.Close()
+
+	client, registry := newRetryClient(t, server, 5)
+	ctx := WithRetryBudget(context.Background(), 3)
+
+	// The first request spends the whole budget...
+	_, err := client.SecretListContext(ctx)
+	assert.NotNil(t, err)
+	assert.EqualValues(t, 4, atomic.LoadInt32(&hits))
+
+	// ...so later ones in the same sync get a single attempt.
+	_, err = client.SecretContext(ctx, "secret")
+	assert.NotNil(t, err)
+	assert.EqualValues(t, 5, atomic.LoadInt32(&hits))
+	assert.EqualValues(t, 3, counterValue(registry, "runtime.server.retries.server_error"))
+	assert.EqualValues(t, 2, counterValue(registry, "runtime.server.retry_budget_exhausted"))
+}
+
+// closeTracker counts response bodies that are closed.
+type closeTracker struct {
+	transport http.RoundTripper
+	opened    int32
+	closed    int32
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	tracker *closeTracker
+}
+
+func (b trackedBody) Close() error {
+	atomic.AddInt32(&b.tracker.closed, 1)
+	return b.ReadCloser.Close()
+}
+
+func (c *closeTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.transport.RoundTrip(req)
+	if err == nil {
+		atomic.AddInt32(&c.opened, 1)
+		resp.Body = trackedBody{resp.Body, c}
+	}
+	return resp, err
+}
+
+func TestClientClosesRetriedBodies(t *testing.T) {
+	var hits int32
+	server := createFailingServer(&hits)
+	defer server.Close()
+
+	client, _ := newRetryClient(t, server, 3)
+	tracker := &closeTracker{transport: client.httpClient.Transport}
+	client.httpClient.Transport = tracker
+
+	_, err := client.SecretList()
+	assert.NotNil(t, err)
+	assert.EqualValues(t, 3, atomic.LoadInt32(&tracker.opened))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&tracker.closed))
+}
+
+func TestClientResponseLimit(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+
+	listing := int64(len(fixture("secretsWithoutContent.json")))
+	client, _ := newRetryClient(t, server, 1)
+
+	// A response of exactly the limit is fine.
+	client.params.maxResponseSize = listing
+	_, err := client.SecretList()
+	require.Nil(t, err)
+
+	client.params.maxResponseSize = listing - 1
+	_, err = client.SecretList()
+	var tooLarge ResponseTooLarge
+	require.True(t, errors.As(err, &tooLarge), "%v", err)
+	assert.Equal(t, listing-1, tooLarge.Limit)
+}
+
+func TestLimitBodyStopsAtLimit(t *testing.T) {
+	body := limitBody(ioutil.NopCloser(strings.NewReader("0123456789")), 4)
+	buf := make([]byte, 3)
+
+	n, err := body.Read(buf)
+	assert.Equal(t, 3, n)
+	assert.Nil(t, err)
+
+	// Only the byte up to the limit is returned, and none after it.
+	var tooLarge ResponseTooLarge
+	n, err = body.Read(buf)
+	assert.Equal(t, 1, n)
+	assert.True(t, errors.As(err, &tooLarge), "%v", err)
+	for i := 0; i < 2; i++ {
+		n, err = body.Read(buf)
+		assert.Equal(t, 0, n)
+		assert.True(t, errors.As(err, &tooLarge), "%v", err)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -46,6 +47,36 @@ func ParseSecretList(data []byte) (secrets []Secret, err error) {
 	return
 }
 
+// DecodeSecretList deserializes a JSON array of secrets from r, calling fn with each one as it's decoded, so the
+// whole list is never held in memory at once.  Decoding stops at the first error, including one returned by fn.
+func DecodeSecretList(r io.Reader, fn func(Secret) error) error {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("failed to deserialize JSON []Secret: %w", err)
+	}
+	if token == nil {
+		// A JSON null is an empty list, as it is for json.Unmarshal.
+		return nil
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("failed to deserialize JSON []Secret: expected an array, found %v", token)
+	}
+	for decoder.More() {
+		var secret Secret
+		if err := decoder.Decode(&secret); err != nil {
+			return fmt.Errorf("failed to deserialize JSON []Secret: %w", err)
+		}
+		if err := fn(secret); err != nil {
+			return err
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("failed to deserialize JSON []Secret: %w", err)
+	}
+	return nil
+}
+
 // Secret represents data returned after processing a server request.
 //
 // json tags after fields indicate to json decoder the key name in JSON
@@ -60,6 +91,10 @@ type Secret struct {
 	Mode             string
 	Owner            string
 	Group            string
+	// Aliases are extra filenames for this secret, from the client's SecretMapping.  They aren't sent by the server.
+	Aliases []string `json:"-"`
+	// ACL entries granting extra users and groups read access, from the client's SecretMapping.
+	ACL []string `json:"-"`
 }
 
 // ModeValue function helps by converting a textual mode to the expected value for fuse.
@@ -15,8 +15,11 @@
 package keysync
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -63,6 +66,42 @@ func TestSecretDeserializeSecretList(t *testing.T) {
 	}
 }
 
+func TestDecodeSecretList(t *testing.T) {
+	expected, err := ParseSecretList(fixture("secrets.json"))
+	require.Nil(t, err)
+
+	var decoded []Secret
+	err = DecodeSecretList(bytes.NewReader(fixture("secrets.json")), func(secret Secret) error {
+		decoded = append(decoded, secret)
+		return nil
+	})
+	require.Nil(t, err)
+	assert.Equal(t, expected, decoded)
+
+	// null is an empty list
+	count := 0
+	countSecrets := func(Secret) error {
+		count++
+		return nil
+	}
+	assert.Nil(t, DecodeSecretList(strings.NewReader("null"), countSecrets))
+	assert.Equal(t, 0, count)
+
+	assert.NotNil(t, DecodeSecretList(strings.NewReader(`{"name": "secret"}`), countSecrets))
+	assert.NotNil(t, DecodeSecretList(strings.NewReader(`[{"name": "a"}, {"name": `), countSecrets))
+	assert.Equal(t, 1, count)
+
+	// An error from the callback stops decoding.
+	stop := errors.New("stop")
+	count = 0
+	err = DecodeSecretList(bytes.NewReader(fixture("secrets.json")), func(Secret) error {
+		count++
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, 1, count)
+}
+
 func TestSecretModeValue(t *testing.T) {
 	newAssert := assert.New(t)
 
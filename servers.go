@@ -0,0 +1,224 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// ServerConfig is one of several Keywhiz servers keysync can fail over between.
+type ServerConfig struct {
+	Address  string `yaml:"address"`  // The server to connect to (host:port)
+	Priority int    `yaml:"priority"` // Servers with lower priority values are preferred
+}
+
+// ServerStatus reports the health of a server, for the /status endpoint.
+type ServerStatus struct {
+	Address  string     `json:"address"`
+	Priority int        `json:"priority"`
+	Healthy  bool       `json:"healthy"`
+	FailedAt *time.Time `json:"failed_at,omitempty"`
+}
+
+// ServerPool passively tracks the health of Keywhiz servers, from the results of requests made to them.
+// A server that fails with a connection error or 5xx response is avoided for the cooldown period, unless
+// every other server has failed too.  A pool is shared by all the clients using the same servers.
+type ServerPool struct {
+	mu       sync.Mutex
+	servers  []*server
+	cooldown time.Duration
+	active   *server
+}
+
+type server struct {
+	config   ServerConfig
+	url      *url.URL
+	failedAt time.Time
+	requests metrics.Counter
+	failures metrics.Counter
+}
+
+// NewServerPool parses server addresses, and registers metrics for each server.
+func NewServerPool(configs []ServerConfig, cooldown time.Duration, metricsHandle *sqmetrics.SquareMetrics) (*ServerPool, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no servers configured")
+	}
+	pool := &ServerPool{cooldown: cooldown}
+	for _, config := range configs {
+		serverURL, err := url.Parse("https://" + config.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing server: %s", config.Address)
+		}
+		pool.servers = append(pool.servers, newServer(config, serverURL, metricsHandle))
+	}
+	// Stable, so servers with the same priority are tried in the order they were configured.
+	sort.SliceStable(pool.servers, func(i, j int) bool {
+		return pool.servers[i].config.Priority < pool.servers[j].config.Priority
+	})
+
+	for _, s := range pool.servers {
+		s := s
+		metricsHandle.AddGauge(s.metricName("healthy"), func() int64 {
+			if pool.healthy(s, time.Now()) {
+				return 1
+			}
+			return 0
+		})
+	}
+	return pool, nil
+}
+
+// singleServerPool wraps an already-parsed URL, for clients talking to just one server.
+func singleServerPool(serverURL *url.URL, metricsHandle *sqmetrics.SquareMetrics) *ServerPool {
+	config := ServerConfig{Address: serverURL.Host}
+	return &ServerPool{servers: []*server{newServer(config, serverURL, metricsHandle)}}
+}
+
+func newServer(config ServerConfig, serverURL *url.URL, metricsHandle *sqmetrics.SquareMetrics) *server {
+	s := &server{config: config, url: serverURL}
+	s.requests = metrics.GetOrRegisterCounter(s.metricName("requests"), metricsHandle.Registry)
+	s.failures = metrics.GetOrRegisterCounter(s.metricName("failures"), metricsHandle.Registry)
+	return s
+}
+
+// metricName is runtime.server.<address>.<name>, with separators in the address replaced.
+func (s *server) metricName(name string) string {
+	address := strings.NewReplacer(".", "_", ":", "_").Replace(s.config.Address)
+	return fmt.Sprintf("runtime.server.%s.%s", address, name)
+}
+
+func (p *ServerPool) healthy(s *server, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return s.failedAt.IsZero() || now.Sub(s.failedAt) >= p.cooldown
+}
+
+// candidates returns servers in the order they should be tried: healthy servers by priority, then
+// servers in their cooldown, least recently failed first.
+func (p *ServerPool) candidates() []*server {
+	now := time.Now()
+	var healthy, cooling []*server
+	for _, s := range p.servers {
+		if p.healthy(s, now) {
+			healthy = append(healthy, s)
+		} else {
+			cooling = append(cooling, s)
+		}
+	}
+	p.mu.Lock()
+	sort.SliceStable(cooling, func(i, j int) bool {
+		return cooling[i].failedAt.Before(cooling[j].failedAt)
+	})
+	p.mu.Unlock()
+	return append(healthy, cooling...)
+}
+
+func (p *ServerPool) markFailure(s *server) {
+	s.failures.Inc(1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.failedAt = time.Now()
+}
+
+func (p *ServerPool) markSuccess(s *server) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.failedAt = time.Time{}
+	p.active = s
+}
+
+// do sends a request to each server in turn until one responds without a connection error or 5xx.
+// send is called with the server's base URL.  If every server fails, the last 5xx response is returned,
+// or the last error if no server responded at all.
+func (p *ServerPool) do(ctx context.Context, send func(*url.URL) (*http.Response, error)) (*http.Response, error) {
+	var lastResp *http.Response
+	var lastErr error
+	for _, s := range p.candidates() {
+		if ctx.Err() != nil {
+			break
+		}
+		s.requests.Inc(1)
+		resp, err := send(s.url)
+		if err != nil && ctx.Err() != nil {
+			// Cancelled, which says nothing about the server's health.
+			return nil, err
+		}
+		if err == nil && !isServerError(resp) {
+			p.markSuccess(s)
+			if lastResp != nil {
+				lastResp.Body.Close()
+			}
+			return resp, nil
+		}
+		p.markFailure(s)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if lastResp != nil {
+			lastResp.Body.Close()
+		}
+		lastResp = resp
+	}
+
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	if lastErr == nil {
+		lastErr = ctx.Err()
+	}
+	return nil, lastErr
+}
+
+// Active returns the address of the server that most recently succeeded, or "" if none has.
+func (p *ServerPool) Active() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active == nil {
+		return ""
+	}
+	return p.active.config.Address
+}
+
+// Status reports the health of every server, in priority order.
+func (p *ServerPool) Status() []ServerStatus {
+	now := time.Now()
+	var statuses []ServerStatus
+	for _, s := range p.servers {
+		status := ServerStatus{
+			Address:  s.config.Address,
+			Priority: s.config.Priority,
+			Healthy:  p.healthy(s, now),
+		}
+		p.mu.Lock()
+		if !s.failedAt.IsZero() {
+			failedAt := s.failedAt
+			status.FailedAt = &failedAt
+		}
+		p.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,194 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createFailingServer returns a server that responds 503 to every request, counting them.
+func createFailingServer(hits *int32) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	server.TLS = testCerts(testCaFile)
+	server.StartTLS()
+	return server
+}
+
+func serverAddress(server *httptest.Server) string {
+	serverURL, _ := url.Parse(server.URL)
+	return serverURL.Host
+}
+
+func newPoolClient(t *testing.T, pool *ServerPool) *KeywhizHTTPClient {
+	client, err := NewClientWithServers(defaultClientConfig(), testCaFile, pool, logrus.NewEntry(logrus.New()), metricsForTest())
+	require.Nil(t, err)
+	return client.(*KeywhizHTTPClient)
+}
+
+func TestServerPoolFailsOverOn5xx(t *testing.T) {
+	var hits int32
+	primary := createFailingServer(&hits)
+	defer primary.Close()
+	backup := createDefaultServer()
+	defer backup.Close()
+
+	// Configured out of order, to check that priority decides
+	pool, err := NewServerPool([]ServerConfig{
+		{Address: serverAddress(backup), Priority: 10},
+		{Address: serverAddress(primary), Priority: 1},
+	}, time.Minute, metricsForTest())
+	require.Nil(t, err)
+	client := newPoolClient(t, pool)
+
+	secrets, err := client.SecretList()
+	require.Nil(t, err)
+	assert.Len(t, secrets, 2)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&hits))
+	assert.Equal(t, serverAddress(backup), pool.Active())
+
+	status := pool.Status()
+	require.Len(t, status, 2)
+	assert.Equal(t, serverAddress(primary), status[0].Address)
+	assert.False(t, status[0].Healthy)
+	assert.NotNil(t, status[0].FailedAt)
+	assert.True(t, status[1].Healthy)
+
+	// The primary is cooling down, so isn't tried again.
+	_, err = client.SecretList()
+	require.Nil(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&hits))
+}
+
+func TestServerPoolFailsOverOnConnectionError(t *testing.T) {
+	closed := createDefaultServer()
+	closed.Close()
+	backup := createDefaultServer()
+	defer backup.Close()
+
+	pool, err := NewServerPool([]ServerConfig{
+		{Address: serverAddress(closed)},
+		{Address: serverAddress(backup)},
+	}, time.Minute, metricsForTest())
+	require.Nil(t, err)
+	client := newPoolClient(t, pool)
+
+	secret, err := client.Secret("Nobody_PgPass")
+	require.Nil(t, err)
+	assert.Equal(t, "Nobody_PgPass", secret.Name)
+	assert.Equal(t, serverAddress(backup), pool.Active())
+}
+
+func TestServerPoolRetriesAfterCooldown(t *testing.T) {
+	var hits int32
+	primary := createFailingServer(&hits)
+	defer primary.Close()
+	backup := createDefaultServer()
+	defer backup.Close()
+
+	pool, err := NewServerPool([]ServerConfig{
+		{Address: serverAddress(primary)},
+		{Address: serverAddress(backup)},
+	}, 0, metricsForTest())
+	require.Nil(t, err)
+	client := newPoolClient(t, pool)
+
+	for i := 0; i < 3; i++ {
+		_, err = client.SecretList()
+		require.Nil(t, err)
+	}
+	// With no cooldown, the preferred server is tried every time.
+	assert.EqualValues(t, 3, atomic.LoadInt32(&hits))
+}
+
+func TestServerPoolAllServersFail(t *testing.T) {
+	var primaryHits, backupHits int32
+	primary := createFailingServer(&primaryHits)
+	defer primary.Close()
+	backup := createFailingServer(&backupHits)
+	defer backup.Close()
+
+	pool, err := NewServerPool([]ServerConfig{
+		{Address: serverAddress(primary)},
+		{Address: serverAddress(backup)},
+	}, time.Minute, metricsForTest())
+	require.Nil(t, err)
+	client := newPoolClient(t, pool)
+
+	_, err = client.SecretList()
+	assert.NotNil(t, err)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&primaryHits))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&backupHits))
+	assert.Equal(t, "", pool.Active())
+
+	// Servers in their cooldown are still tried as a last resort, least recently failed first.
+	_, err = client.SecretList()
+	assert.NotNil(t, err)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&primaryHits))
+	assert.EqualValues(t, 2, atomic.LoadInt32(&backupHits))
+}
+
+func TestNewServerPoolFails(t *testing.T) {
+	_, err := NewServerPool(nil, time.Minute, metricsForTest())
+	assert.NotNil(t, err)
+
+	_, err = NewServerPool([]ServerConfig{{Address: "\\"}}, time.Minute, metricsForTest())
+	assert.NotNil(t, err)
+}
+
+func TestApiStatusShowsActiveServer(t *testing.T) {
+	var hits int32
+	primary := createFailingServer(&hits)
+	defer primary.Close()
+	backup := createDefaultServer()
+	defer backup.Close()
+
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", backup)
+	require.Nil(t, err)
+	syncer.servers, err = NewServerPool([]ServerConfig{
+		{Address: serverAddress(primary)},
+		{Address: serverAddress(backup), Priority: 1},
+	}, time.Minute, metricsForTest())
+	require.Nil(t, err)
+
+	_, errs := syncer.RunOnce()
+	require.Empty(t, errs)
+	syncer.updateSuccessTimestamp()
+
+	api := &APIServer{syncer: syncer, logger: logrus.NewEntry(logrus.New())}
+	recorder := httptest.NewRecorder()
+	api.status(recorder, httptest.NewRequest("GET", "/status", nil))
+	require.Equal(t, http.StatusOK, recorder.Code)
+
+	status := StatusResponse{}
+	require.Nil(t, json.Unmarshal(recorder.Body.Bytes(), &status))
+	assert.True(t, status.Ok)
+	assert.Equal(t, serverAddress(backup), status.ActiveServer)
+	require.Len(t, status.Servers, 2)
+	assert.False(t, status.Servers[0].Healthy)
+	assert.True(t, status.Servers[1].Healthy)
+}
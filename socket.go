@@ -0,0 +1,265 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/square/keysync/ownership"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// PeerCredentials identify the process on the other end of a Unix socket, as reported by the kernel.
+type PeerCredentials struct {
+	PID int32
+	UID int
+	GID int
+}
+
+type peerCredentialsKey struct{}
+
+// SocketOutputCollection holds secrets in memory, and serves them over a Unix domain socket instead of
+// writing files.  Every request is authorized using the caller's peer credentials, as if the secret were
+// a file with the secret's mode and ownership, and logged to an audit trail.
+//
+// Secrets are available at /secrets/{client}/{filename}, and /secrets/{client} lists the filenames the
+// caller is allowed to read.
+type SocketOutputCollection struct {
+	*MemoryOutputCollection
+	Config *Config
+
+	mu        sync.RWMutex
+	ownership map[string]ownership.Ownership // Default ownership for each client
+	logger    *logrus.Entry
+	audit     *logrus.Entry
+}
+
+var _ OutputCollection = &SocketOutputCollection{}
+
+// NewSocketOutputCollection listens on config.SocketPath, and serves requests in the background.
+func NewSocketOutputCollection(config *Config, baseLogger *logrus.Entry) (*SocketOutputCollection, error) {
+	c := &SocketOutputCollection{
+		MemoryOutputCollection: NewMemoryOutputCollection(),
+		Config:                 config,
+		ownership:              map[string]ownership.Ownership{},
+		logger:                 baseLogger.WithField("logger", "socket_server"),
+		audit:                  baseLogger.WithField("logger", "socket_audit"),
+	}
+
+	// Remove a stale socket from a previous run; anything else at the path is an error from Listen.
+	if info, err := os.Lstat(config.SocketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(config.SocketPath); err != nil {
+			return nil, fmt.Errorf("removing stale socket %s: %v", config.SocketPath, err)
+		}
+	}
+	listener, err := net.Listen("unix", config.SocketPath)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %v", config.SocketPath, err)
+	}
+	// Anyone may connect: access is decided per-secret from their credentials.
+	if err := os.Chmod(config.SocketPath, 0666); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("setting permissions on %s: %v", config.SocketPath, err)
+	}
+
+	server := &http.Server{
+		Handler: c.router(),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			creds, err := peerCredentials(conn)
+			if err != nil {
+				c.logger.WithError(err).Warn("Unable to get peer credentials")
+				return ctx
+			}
+			return context.WithValue(ctx, peerCredentialsKey{}, creds)
+		},
+	}
+	go func() {
+		err := server.Serve(listener)
+		c.logger.WithError(err).WithField("path", config.SocketPath).Error("Serve")
+	}()
+
+	return c, nil
+}
+
+// NewOutput resolves the client's default ownership, used to authorize requests, and returns an in-memory output.
+func (c *SocketOutputCollection) NewOutput(clientConfig ClientConfig, logger *logrus.Entry) (Output, error) {
+	defaultOwnership := ownership.NewOwnership(
+		clientConfig.User,
+		clientConfig.Group,
+		c.Config.DefaultUser,
+		c.Config.DefaultGroup,
+		ownership.Os{},
+		logger,
+	)
+
+	c.mu.Lock()
+	c.ownership[clientConfig.DirName] = defaultOwnership
+	c.mu.Unlock()
+
+	out, err := c.MemoryOutputCollection.NewOutput(clientConfig, logger)
+	if err != nil {
+		return nil, err
+	}
+	return socketOutput{out.(*MemoryOutput), c}, nil
+}
+
+// Cleanup removes clients not in known, and forgets their ownership.
+func (c *SocketOutputCollection) Cleanup(known map[string]struct{}, logger *logrus.Entry) (uint, []error) {
+	deleted, errs := c.MemoryOutputCollection.Cleanup(known, logger)
+	c.prune()
+	return deleted, errs
+}
+
+// prune forgets the ownership of clients that no longer have an output, so a client that's created again is
+// authorized by its new config rather than a stale one.
+func (c *SocketOutputCollection) prune() {
+	current := map[string]bool{}
+	for _, name := range c.Clients() {
+		current[name] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.ownership {
+		if !current[name] {
+			delete(c.ownership, name)
+		}
+	}
+}
+
+// socketOutput is a client's in-memory output, whose ownership is forgotten when the client is removed.
+type socketOutput struct {
+	*MemoryOutput
+	collection *SocketOutputCollection
+}
+
+func (out socketOutput) RemoveAll() (uint, error) {
+	removed, err := out.MemoryOutput.RemoveAll()
+	out.collection.prune()
+	return removed, err
+}
+
+func (c *SocketOutputCollection) router() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/secrets/{client}", c.list).Methods(httpGet...)
+	router.HandleFunc("/secrets/{client}/{filename}", c.read).Methods(httpGet...)
+	return router
+}
+
+// list returns a JSON list of the filenames the peer may read.
+func (c *SocketOutputCollection) list(w http.ResponseWriter, r *http.Request) {
+	client := mux.Vars(r)["client"]
+	peer, ok := r.Context().Value(peerCredentialsKey{}).(PeerCredentials)
+	logger := c.audit.WithField("client", client)
+	if !ok {
+		logger.Warn("Denied list request from unidentified peer")
+		writeError(w, http.StatusForbidden, fmt.Errorf("unable to identify caller"))
+		return
+	}
+
+	filenames := []string{}
+	for filename, secret := range c.Secrets(client) {
+		if c.authorize(peer, client, &secret) {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+	logger.WithFields(logrus.Fields{
+		"pid":     peer.PID,
+		"uid":     peer.UID,
+		"gid":     peer.GID,
+		"secrets": len(filenames),
+	}).Info("Listed secrets")
+
+	out, _ := json.Marshal(filenames)
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(out)
+}
+
+// read returns the raw content of a secret, if the peer may read it.
+func (c *SocketOutputCollection) read(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	client, filename := vars["client"], vars["filename"]
+	peer, ok := r.Context().Value(peerCredentialsKey{}).(PeerCredentials)
+	logger := c.audit.WithFields(logrus.Fields{
+		"client": client,
+		"secret": filename,
+	})
+	if !ok {
+		logger.Warn("Denied request from unidentified peer")
+		writeError(w, http.StatusForbidden, fmt.Errorf("unable to identify caller"))
+		return
+	}
+	logger = logger.WithFields(logrus.Fields{
+		"pid": peer.PID,
+		"uid": peer.UID,
+		"gid": peer.GID,
+	})
+
+	secret, ok := c.Secret(client, filename)
+	if !ok {
+		logger.Info("Request for unknown secret")
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown secret"))
+		return
+	}
+	if !c.authorize(peer, client, secret) {
+		logger.Warn("Denied secret access")
+		writeError(w, http.StatusForbidden, fmt.Errorf("permission denied"))
+		return
+	}
+
+	logger.Info("Allowed secret access")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write(secret.Content)
+}
+
+// authorize applies file permission semantics to a secret.
+func (c *SocketOutputCollection) authorize(peer PeerCredentials, client string, secret *Secret) bool {
+	c.mu.RLock()
+	defaultOwnership, ok := c.ownership[client]
+	c.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	mode, err := secret.ModeValue()
+	if err != nil {
+		return false
+	}
+	return permitted(peer, secret.OwnershipValue(defaultOwnership), mode)
+}
+
+// permitted checks the read bits of mode, as the kernel would for a file with the given owner.
+// Only the peer's primary group is known from the socket, so supplementary groups don't grant access.
+func permitted(peer PeerCredentials, owner ownership.Ownership, mode os.FileMode) bool {
+	switch {
+	case peer.UID == 0:
+		// Root could read the equivalent file, too.
+		return true
+	case peer.UID == owner.UID:
+		return mode&0400 != 0
+	case peer.GID == owner.GID:
+		return mode&0040 != 0
+	default:
+		return mode&0004 != 0
+	}
+}
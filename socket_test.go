@@ -0,0 +1,154 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package keysync
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/square/keysync/ownership"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocketPermitted(t *testing.T) {
+	owner := ownership.Ownership{UID: 1000, GID: 2000}
+	testData := []struct {
+		peer     PeerCredentials
+		mode     os.FileMode
+		expected bool
+	}{
+		{PeerCredentials{UID: 0, GID: 0}, 0400, true},
+		{PeerCredentials{UID: 1000, GID: 1}, 0400, true},
+		{PeerCredentials{UID: 1000, GID: 2000}, 0040, false},
+		{PeerCredentials{UID: 1001, GID: 2000}, 0440, true},
+		{PeerCredentials{UID: 1001, GID: 2000}, 0400, false},
+		{PeerCredentials{UID: 1001, GID: 2001}, 0440, false},
+		{PeerCredentials{UID: 1001, GID: 2001}, 0444, true},
+	}
+	for _, data := range testData {
+		assert.Equal(t, data.expected, permitted(data.peer, owner, data.mode), "%+v with mode %o", data.peer, data.mode)
+	}
+}
+
+func TestSocketServesSecrets(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Peer credentials are only supported on linux")
+	}
+
+	dir, err := ioutil.TempDir("", "keysyncSocketTest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{SocketPath: filepath.Join(dir, "keysync.sock")}
+	collection, err := NewSocketOutputCollection(&config, testLogger())
+	require.NoError(t, err)
+
+	out, err := collection.NewOutput(testClientConfig("client1"), testLogger())
+	require.NoError(t, err)
+	secret := testSecret("secret")
+	_, err = out.Write(&secret)
+	require.NoError(t, err)
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", config.SocketPath)
+		},
+	}}
+
+	resp, err := client.Get("http://keysync/secrets/client1/secret")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	if os.Getuid() == 0 {
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []byte(secret.Content), body)
+	} else {
+		// The test secret is owned by root, since no users are configured, and 0440.
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	resp, err = client.Get("http://keysync/secrets/client1/missing")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Listing is audited too, with who asked and how many secrets they were shown.
+	auditLogger, hook := logtest.NewNullLogger()
+	collection.audit = logrus.NewEntry(auditLogger)
+	resp, err = client.Get("http://keysync/secrets/client1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	entry := hook.LastEntry()
+	require.NotNil(t, entry)
+	assert.Equal(t, "Listed secrets", entry.Message)
+	assert.Equal(t, "client1", entry.Data["client"])
+	assert.Equal(t, os.Getuid(), entry.Data["uid"])
+	if os.Getuid() == 0 {
+		assert.Equal(t, 1, entry.Data["secrets"])
+	} else {
+		assert.Equal(t, 0, entry.Data["secrets"])
+	}
+}
+
+func TestSocketForgetsRemovedClients(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keysyncSocketTest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config := Config{SocketPath: filepath.Join(dir, "keysync.sock")}
+	collection, err := NewSocketOutputCollection(&config, testLogger())
+	require.NoError(t, err)
+
+	rootGroup := PeerCredentials{UID: 4242, GID: 0}
+	daemonGroup := PeerCredentials{UID: 4242, GID: 1}
+	secret := testSecret("secret")
+	create := func(group string) Output {
+		clientConfig := testClientConfig("client1")
+		clientConfig.Group = group
+		out, err := collection.NewOutput(clientConfig, testLogger())
+		require.NoError(t, err)
+		_, err = out.Write(&secret)
+		require.NoError(t, err)
+		return out
+	}
+
+	create("root")
+	assert.True(t, collection.authorize(rootGroup, "client1", &secret))
+
+	// Deleted as an unknown client, then created again with another group.
+	_, errs := collection.Cleanup(map[string]struct{}{}, testLogger())
+	require.Empty(t, errs)
+	assert.False(t, collection.authorize(rootGroup, "client1", &secret))
+	out := create("daemon")
+	assert.False(t, collection.authorize(rootGroup, "client1", &secret))
+	assert.True(t, collection.authorize(daemonGroup, "client1", &secret))
+
+	// Removing the output directly forgets it too.
+	_, err = out.RemoveAll()
+	require.NoError(t, err)
+	assert.Empty(t, collection.ownership)
+}
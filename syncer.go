@@ -15,10 +15,12 @@
 package keysync
 
 import (
+	"context"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"math/rand"
-	"net/url"
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -46,6 +48,10 @@ type secretState struct {
 	Owner string
 	Group string
 	Mode  string
+	// Aliases are the symlinks we made to this secret
+	Aliases []string
+	// ACL is the configured ACL entries, before resolving users and groups
+	ACL []string
 }
 
 type syncerEntry struct {
@@ -59,7 +65,9 @@ type syncerEntry struct {
 // Construct one using the NewSyncer and AddClient functions
 type Syncer struct {
 	config                 *Config
-	server                 *url.URL
+	servers                *ServerPool
+	clientServers          map[string]*ServerPool // Pools for clients that override the server, by address
+	certExpiry             sync.Map               // Client name to func() time.Time, for certificate expiry metrics
 	clients                map[string]syncerEntry
 	logger                 *logrus.Entry
 	metricsHandle          *sqmetrics.SquareMetrics
@@ -113,11 +121,14 @@ func NewSyncer(config *Config, outputCollection OutputCollection, logger *logrus
 		outputCollection: outputCollection,
 	}
 
-	serverURL, err := url.Parse("https://" + config.Server)
+	cooldown, err := time.ParseDuration(config.ServerCooldown)
+	if err != nil && config.ServerCooldown != "" {
+		return nil, fmt.Errorf("couldn't parse server cooldown '%s': %v", config.ServerCooldown, err)
+	}
+	syncer.servers, err = NewServerPool(config.ServerConfigs(), cooldown, metricsHandle)
 	if err != nil {
-		return nil, fmt.Errorf("failed parsing server: %s", config.Server)
+		return nil, err
 	}
-	syncer.server = serverURL
 
 	// Add callback for last success gauge
 	metricsHandle.AddGauge("seconds_since_last_success", func() int64 {
@@ -139,7 +150,7 @@ func NewSyncerFromFile(config *Config, clientConfig ClientConfig, bundle string,
 		disableClientReloading: true,
 	}
 
-	client, err := NewBackupBundleClient(bundle, logger)
+	client, err := NewBackupBundleClient(bundle, clientConfig.SecretMapping, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -193,6 +204,7 @@ func (s *Syncer) mostRecentError() (err error) {
 
 type pendingCleanup struct {
 	Outputs map[string]Output
+	Mirrors map[string]Output // Mirrors removed from clients that are still configured, by directory
 }
 
 func (p *pendingCleanup) cleanup(logger *logrus.Entry) (uint, []error) {
@@ -212,6 +224,16 @@ func (p *pendingCleanup) cleanup(logger *logrus.Entry) (uint, []error) {
 			deleted += outputDeleted
 		}
 	}
+	for directory, output := range p.Mirrors {
+		outputDeleted, err := output.RemoveAll()
+		deleted += outputDeleted
+		if err != nil {
+			errors = append(errors, err)
+			logger.WithError(err).WithField("mirror", directory).Warn("Failed to remove old mirror")
+		} else {
+			logger.WithField("mirror", directory).Info("Removed old mirror")
+		}
+	}
 
 	return deleted, errors
 }
@@ -229,11 +251,12 @@ func (s *Syncer) LoadClients() (*pendingCleanup, error) {
 	}
 	s.logger.WithField("count", len(newConfigs)).Info("Loaded configs")
 
+	pending := &pendingCleanup{Outputs: map[string]Output{}, Mirrors: map[string]Output{}}
 	for name, clientConfig := range newConfigs {
 		// If there's already a client loaded, reload it
 		syncerEntry, ok := s.clients[name]
 		if ok {
-			if syncerEntry.ClientConfig == clientConfig {
+			if reflect.DeepEqual(syncerEntry.ClientConfig, clientConfig) {
 				// Exists, and the same config.
 				err := syncerEntry.Client.RebuildClient()
 				if err != nil {
@@ -249,25 +272,64 @@ func (s *Syncer) LoadClients() (*pendingCleanup, error) {
 			continue
 
 		}
+		if ok {
+			closeClient(syncerEntry.Client, s.logger)
+			for directory, output := range staleMirrors(syncerEntry.output, clientConfig.Mirrors) {
+				pending.Mirrors[directory] = output
+			}
+		}
 		s.clients[name] = *client
 	}
 
-	pending := &pendingCleanup{Outputs: map[string]Output{}}
 	for name, client := range s.clients {
 		// Record which clients have gone away, for later cleanup.
 		_, ok := newConfigs[name]
 		if !ok {
 			pending.Outputs[name] = client.output
+			closeClient(client.Client, s.logger)
 			delete(s.clients, name)
+			s.certExpiry.Delete(name)
 		}
 	}
 	return pending, nil
 }
 
+// closeClient releases what a client that's no longer used holds open, if it holds anything.
+func closeClient(client Client, logger *logrus.Entry) {
+	if closer, ok := client.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.WithError(err).Warn("Failed to close old client")
+		}
+	}
+}
+
 // buildClient collects the configuration and builds a client.  Most of this code should probably be refactored ito NewClient
 func (s *Syncer) buildClient(name string, clientConfig ClientConfig, metricsHandle *sqmetrics.SquareMetrics) (*syncerEntry, error) {
 	clientLogger := s.logger.WithField("client", name)
-	client, err := NewClient(&clientConfig, s.config.CaFile, s.server, clientLogger, metricsHandle)
+	caFile := clientConfig.CaFile
+	if caFile == "" {
+		caFile = s.config.CaFile
+	}
+	var client Client
+	var err error
+	switch clientConfig.Backend {
+	case BackendVault:
+		client, err = NewVaultClient(&clientConfig, caFile, clientLogger, metricsHandle)
+	case BackendHTTP:
+		client, err = NewHTTPJSONClient(&clientConfig, caFile, clientLogger, metricsHandle)
+	case BackendLocal:
+		client, err = NewLocalClient(clientConfig.Local, clientConfig.SecretMapping, clientLogger)
+	case BackendBundle:
+		client, err = NewBundleClient(clientConfig.Bundle, clientConfig.SecretMapping, clientLogger)
+	case BackendReplay:
+		client, err = NewReplayClient(&clientConfig, clientLogger, metricsHandle)
+	default:
+		var servers *ServerPool
+		if servers, err = s.serversFor(clientConfig); err != nil {
+			return nil, err
+		}
+		client, err = NewClientWithServers(&clientConfig, caFile, servers, clientLogger, metricsHandle)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -277,9 +339,65 @@ func (s *Syncer) buildClient(name string, clientConfig ClientConfig, metricsHand
 		return nil, err
 	}
 
+	// A replayed client has no certificate.
+	if certClient, ok := client.(interface{ certNotAfter() time.Time }); ok && clientConfig.Backend != BackendReplay {
+		s.registerCertMetrics(name, certClient.certNotAfter)
+	}
+
 	return &syncerEntry{client, clientConfig, output, map[string]secretState{}}, nil
 }
 
+// registerCertMetrics exports a client's certificate expiry, as a unix timestamp and as seconds from now.
+// Gauges are registered once per client name, and read whichever client was built for that name most recently.
+func (s *Syncer) registerCertMetrics(name string, notAfter func() time.Time) {
+	if _, loaded := s.certExpiry.LoadOrStore(name, notAfter); loaded {
+		s.certExpiry.Store(name, notAfter)
+		return
+	}
+	current := func() (time.Time, bool) {
+		notAfter, ok := s.certExpiry.Load(name)
+		if !ok {
+			return time.Time{}, false
+		}
+		return notAfter.(func() time.Time)(), true
+	}
+	s.metricsHandle.AddGauge(fmt.Sprintf("runtime.client.%s.cert_not_after", name), func() int64 {
+		notAfter, ok := current()
+		if !ok {
+			return 0
+		}
+		return notAfter.Unix()
+	})
+	s.metricsHandle.AddGauge(fmt.Sprintf("runtime.client.%s.cert_seconds_to_expiry", name), func() int64 {
+		notAfter, ok := current()
+		if !ok {
+			return 0
+		}
+		return int64(time.Until(notAfter) / time.Second)
+	})
+}
+
+// serversFor returns the global server pool, unless the client overrides the server.  Clients overriding it
+// with the same address share a pool, so they share its view of the server's health.
+func (s *Syncer) serversFor(clientConfig ClientConfig) (*ServerPool, error) {
+	if clientConfig.Server == "" {
+		return s.servers, nil
+	}
+	if pool, ok := s.clientServers[clientConfig.Server]; ok {
+		return pool, nil
+	}
+	cooldown, _ := time.ParseDuration(s.config.ServerCooldown)
+	pool, err := NewServerPool([]ServerConfig{{Address: clientConfig.Server}}, cooldown, s.metricsHandle)
+	if err != nil {
+		return nil, err
+	}
+	if s.clientServers == nil {
+		s.clientServers = map[string]*ServerPool{}
+	}
+	s.clientServers[clientConfig.Server] = pool
+	return pool, nil
+}
+
 // Randomize the sleep interval, increasing up to 1/4 of the duration.
 func randomize(d time.Duration) time.Duration {
 	maxAdded := float64(d) / 4
@@ -290,8 +408,13 @@ func randomize(d time.Duration) time.Duration {
 
 // Run the main sync loop.
 func (s *Syncer) Run() error {
+	return s.RunContext(context.Background())
+}
+
+// RunContext runs the main sync loop until ctx is done, when it returns the context's error.
+func (s *Syncer) RunContext(ctx context.Context) error {
 	for {
-		_, errors := s.RunOnce()
+		_, errors := s.RunOnceContext(ctx)
 		var err error
 		if len(errors) != 0 {
 			if len(errors) == 1 {
@@ -312,12 +435,21 @@ func (s *Syncer) Run() error {
 		}
 		sleep := randomize(s.pollInterval)
 		s.logger.WithField("duration", sleep).Info("Sleeping")
-		time.Sleep(sleep)
+		if err := sleepContext(ctx, sleep); err != nil {
+			s.logger.WithError(err).Info("Stopping syncer")
+			return err
+		}
 	}
 }
 
 // RunOnce runs the syncer once, for all clients, without sleeps.
 func (s *Syncer) RunOnce() (Updated, []error) {
+	return s.RunOnceContext(context.Background())
+}
+
+// RunOnceContext runs the syncer once, for all clients, without sleeps.  If ctx is done, remaining
+// clients fail without making requests.
+func (s *Syncer) RunOnceContext(ctx context.Context) (Updated, []error) {
 	var updated Updated
 	s.syncMutex.Lock()
 	defer s.syncMutex.Unlock()
@@ -330,7 +462,7 @@ func (s *Syncer) RunOnce() (Updated, []error) {
 	clientDirs := map[string]struct{}{}
 	for name, entry := range s.clients {
 		clientDirs[entry.ClientConfig.DirName] = struct{}{}
-		thisupdated, err := entry.Sync()
+		thisupdated, err := entry.SyncContext(ctx)
 		if err != nil {
 			// Record error but continue updating other clients
 			s.logger.WithError(err).WithField("name", name).Error("Failed while syncing")
@@ -362,9 +494,17 @@ func (s *Syncer) RunOnce() (Updated, []error) {
 // Sync this: Download and write all secrets.
 // Returns the number of secrets added, changed, or deleted secrets
 func (entry *syncerEntry) Sync() (Updated, error) {
+	return entry.SyncContext(context.Background())
+}
+
+// SyncContext is Sync, stopping early if ctx is done.
+func (entry *syncerEntry) SyncContext(ctx context.Context) (Updated, error) {
 	updated := Updated{}
+	if entry.RetryBudget > 0 {
+		ctx = WithRetryBudget(ctx, int(entry.RetryBudget))
+	}
 
-	secrets, err := entry.Client.SecretList()
+	secrets, err := entry.Client.SecretListContext(ctx)
 	if err != nil {
 		entry.Logger().WithError(err).Error("Failed to list secrets")
 		return updated, err
@@ -389,28 +529,29 @@ func (entry *syncerEntry) Sync() (Updated, error) {
 		}
 	}
 
-	retrievedSecrets, err := entry.Client.SecretListWithContents(needsRetrieval)
-	if err != nil {
-		// This may be caused by a secret being deleted between listing and fetching, or by requesting
-		// a secret we are not allowed to access. Fall back to retrieving the secrets individually.
-		foundDeleted := entry.syncSecretsIndividually(needsRetrieval)
-		pendingDeletions = append(pendingDeletions, foundDeleted...)
-	} else {
-		for filename, secret := range retrievedSecrets {
-			added, err := entry.writeSecret(filename, &secret)
-			switch {
-			case err != nil:
-				entry.Logger().WithFields(logrus.Fields{
-					"secret":   secret.Name,
-					"filename": filename,
-				}).WithError(err).Error("Failed to write secret")
-			case added:
-				updated.Added++
-			default:
-				updated.Changed++
-			}
+	fetched, err := entry.fetchSecrets(ctx, needsRetrieval, secrets, func(filename string, secret *Secret) {
+		added, err := entry.writeSecret(filename, secret)
+		switch {
+		case err != nil:
+			entry.Logger().WithFields(logrus.Fields{
+				"secret":   secret.Name,
+				"filename": filename,
+			}).WithError(err).Error("Failed to write secret")
+		case added:
+			updated.Added++
+		default:
+			updated.Changed++
 		}
+	})
+	if err != nil {
+		entry.Logger().WithError(err).Warn("Sync cancelled")
+		return updated, err
+	}
+	for _, filename := range fetched.forbidden {
+		entry.Logger().WithField("secret", secrets[filename].Name).Warn("Secret is listed but forbidden, keeping any previous copy")
 	}
+	// We defer actual deletion to later, so that new secrets are always written before any are deleted.
+	pendingDeletions = append(pendingDeletions, fetched.deleted...)
 
 	// For all secrets we've previously synced, remove state for ones not returned
 	for filename := range entry.SyncState {
@@ -437,30 +578,6 @@ func (entry *syncerEntry) Sync() (Updated, error) {
 	return updated, nil
 }
 
-func (entry *syncerEntry) syncSecretsIndividually(names []string) []string {
-	var pendingDeletions []string
-	for _, name := range names {
-		secret, err := entry.Client.Secret(name)
-		if err != nil {
-			// This is essentially a race condition: A secret was deleted between listing and fetching
-			if _, deleted := err.(SecretDeleted); deleted {
-				// We defer actual deletion to a later call, so that new secrets are always written
-				// before any are deleted.
-				pendingDeletions = append(pendingDeletions, name)
-			}
-			continue
-		}
-
-		if _, err := entry.writeSecret(name, secret); err != nil {
-			entry.Logger().WithFields(logrus.Fields{
-				"secret":   secret.Name,
-				"filename": name,
-			}).WithError(err).Error("Failed to write secret")
-		}
-	}
-	return pendingDeletions
-}
-
 // writeSecret writes the given secret to disk and validates it. On success, writeSecret returns true if the secret was added and false if it was changed.
 func (entry *syncerEntry) writeSecret(filename string, secret *Secret) (bool, error) {
 	state, err := entry.output.Write(secret)
@@ -15,12 +15,16 @@
 package keysync
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -100,6 +104,58 @@ func TestSyncerBuildClient(t *testing.T) {
 	require.NotNil(t, entry)
 }
 
+func TestSyncerClientServerOverride(t *testing.T) {
+	var hits int32
+	oldServer := createFailingServer(&hits)
+	defer oldServer.Close()
+	newServer := createDefaultServer()
+	defer newServer.Close()
+
+	clientsDir, err := ioutil.TempDir("", "keysync-clients")
+	require.Nil(t, err)
+	defer os.RemoveAll(clientsDir)
+	clientCertPath, _ := filepath.Abs(clientCert)
+	clientKeyPath, _ := filepath.Abs(clientKey)
+	caPath, _ := filepath.Abs(testCaFile)
+	writeClients := func(overrides string) {
+		clientYAML := fmt.Sprintf("client1:\n  cert: %s\n  key: %s\n%s", clientCertPath, clientKeyPath, overrides)
+		require.Nil(t, ioutil.WriteFile(filepath.Join(clientsDir, "client1.yaml"), []byte(clientYAML), 0600))
+	}
+
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", oldServer)
+	require.Nil(t, err)
+	syncer.config.ClientsDir = clientsDir
+	// The global CA doesn't match either server's certificate.
+	syncer.config.CaFile = "fixtures/CA/cacert.crt"
+
+	writeClients("")
+	_, err = syncer.LoadClients()
+	require.Nil(t, err)
+	oldClient := syncer.clients["client1"].Client
+	assert.Equal(t, syncer.servers, oldClient.(*KeywhizHTTPClient).servers)
+
+	// Moving the client to the new server and CA rebuilds it.
+	writeClients(fmt.Sprintf("  server: %s\n  ca_file: %s\n  tls_server_name: example.com\n", serverAddress(newServer), caPath))
+	_, err = syncer.LoadClients()
+	require.Nil(t, err)
+	entry := syncer.clients["client1"]
+	assert.NotEqual(t, oldClient, entry.Client)
+	assert.Equal(t, caPath, entry.ClientConfig.CaFile)
+	assert.Equal(t, syncer.clientServers[serverAddress(newServer)], entry.Client.(*KeywhizHTTPClient).servers)
+
+	secrets, err := entry.Client.SecretList()
+	require.Nil(t, err)
+	assert.Len(t, secrets, 2)
+	assert.EqualValues(t, 0, hits)
+
+	// The server name is verified against the server's certificate.
+	writeClients(fmt.Sprintf("  server: %s\n  ca_file: %s\n  tls_server_name: wrong.example.com\n", serverAddress(newServer), caPath))
+	_, err = syncer.LoadClients()
+	require.Nil(t, err)
+	_, err = syncer.clients["client1"].Client.SecretList()
+	assert.NotNil(t, err)
+}
+
 func TestSyncerRandomDuration(t *testing.T) {
 	testData := []struct{ start, end string }{
 		{"100s", "125s"},
@@ -384,3 +440,30 @@ func TestSyncerEntrySyncKeywhizFails(t *testing.T) {
 		require.Equal(t, 0, output.NumDeletes(), "Expect no secrets to be deleted after sync")
 	}
 }
+
+func TestSyncerRunContextStops(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", server)
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- syncer.RunContext(ctx)
+	}()
+
+	// The poll interval is 60s, so only cancellation stops this quickly.
+	cancel()
+	select {
+	case err := <-done:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected syncer to stop when cancelled")
+	}
+
+	// A cancelled sync doesn't write anything
+	_, errs := syncer.RunOnceContext(ctx)
+	assert.NotEmpty(t, errs)
+}
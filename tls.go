@@ -0,0 +1,169 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// TLSConfig is the TLS policy for connections to Keywhiz.  It can be set globally, and overridden per client.
+type TLSConfig struct {
+	MinVersion   string   `yaml:"min_version"`   // Optional: "1.0" to "1.3". Defaults to 1.2.
+	MaxVersion   string   `yaml:"max_version"`   // Optional: Defaults to the highest version Go supports.
+	CipherSuites []string `yaml:"cipher_suites"` // Optional: Names like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites aren't configurable.
+	Pins         []string `yaml:"pins"`          // Optional: "sha256/<base64>" hashes of the server's SPKI, or a CA's in its chain.
+}
+
+// PinMismatch is returned when a server's certificate chain doesn't contain any pinned public key.
+// It can mean the server is being impersonated by someone holding a certificate from the trusted CA.
+type PinMismatch struct {
+	ServerName string
+	Pins       []string // The pins of the certificates the server presented
+}
+
+func (e PinMismatch) Error() string {
+	return fmt.Sprintf("no pinned public key in certificate chain for %s (got %s)", e.ServerName, strings.Join(e.Pins, ", "))
+}
+
+// tlsPolicy is a parsed TLSConfig.
+type tlsPolicy struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	pins         map[string]bool
+	pinFailures  metrics.Counter
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// setDefaults fills in anything not set from the global policy.
+func (c *TLSConfig) setDefaults(global TLSConfig) {
+	if c.MinVersion == "" {
+		c.MinVersion = global.MinVersion
+	}
+	if c.MaxVersion == "" {
+		c.MaxVersion = global.MaxVersion
+	}
+	if len(c.CipherSuites) == 0 {
+		c.CipherSuites = global.CipherSuites
+	}
+	if len(c.Pins) == 0 {
+		c.Pins = global.Pins
+	}
+}
+
+// policy parses and checks the config.
+func (c TLSConfig) policy() (*tlsPolicy, error) {
+	p := &tlsPolicy{
+		minVersion:   tls.VersionTLS12,
+		cipherSuites: ciphers,
+	}
+
+	if c.MinVersion != "" {
+		version, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS min_version '%s'", c.MinVersion)
+		}
+		p.minVersion = version
+	}
+	if c.MaxVersion != "" {
+		version, ok := tlsVersions[c.MaxVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS max_version '%s'", c.MaxVersion)
+		}
+		p.maxVersion = version
+	}
+	if p.maxVersion != 0 && p.maxVersion < p.minVersion {
+		return nil, fmt.Errorf("TLS max_version %s is lower than min_version", c.MaxVersion)
+	}
+
+	if len(c.CipherSuites) > 0 {
+		suites := map[string]*tls.CipherSuite{}
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite
+		}
+		p.cipherSuites = nil
+		for _, name := range c.CipherSuites {
+			suite, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite '%s'", name)
+			}
+			if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+				return nil, fmt.Errorf("TLS 1.3 cipher suite '%s' can't be configured", name)
+			}
+			p.cipherSuites = append(p.cipherSuites, suite.ID)
+		}
+	}
+
+	if len(c.Pins) > 0 {
+		p.pins = map[string]bool{}
+		for _, pin := range c.Pins {
+			hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if !strings.HasPrefix(pin, "sha256/") || err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid pin '%s': expected sha256/ and a base64 SHA-256 hash", pin)
+			}
+			p.pins[pin] = true
+		}
+	}
+	return p, nil
+}
+
+// apply sets the policy on a tls.Config.
+func (p *tlsPolicy) apply(config *tls.Config) {
+	config.MinVersion = p.minVersion
+	config.MaxVersion = p.maxVersion
+	config.CipherSuites = p.cipherSuites
+	if len(p.pins) > 0 {
+		config.VerifyConnection = p.verifyPins
+	}
+}
+
+// verifyPins runs after the chain has been verified against the CA, and checks that it contains a pinned key.
+func (p *tlsPolicy) verifyPins(state tls.ConnectionState) error {
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			if p.pins[spkiPin(cert)] {
+				return nil
+			}
+		}
+	}
+
+	var presented []string
+	for _, cert := range state.PeerCertificates {
+		presented = append(presented, spkiPin(cert))
+	}
+	if p.pinFailures != nil {
+		p.pinFailures.Inc(1)
+	}
+	return PinMismatch{ServerName: state.ServerName, Pins: presented}
+}
+
+// spkiPin returns the pin for a certificate's public key, in the same format as the config.
+func spkiPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	sqmetrics "github.com/square/go-sq-metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSConfigPolicy(t *testing.T) {
+	// Defaults are unchanged from before the policy was configurable.
+	policy, err := TLSConfig{}.policy()
+	require.Nil(t, err)
+	assert.EqualValues(t, tls.VersionTLS12, policy.minVersion)
+	assert.EqualValues(t, 0, policy.maxVersion)
+	assert.Equal(t, ciphers, policy.cipherSuites)
+	assert.Nil(t, policy.pins)
+
+	policy, err = TLSConfig{
+		MinVersion:   "1.2",
+		MaxVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+		Pins:         []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	}.policy()
+	require.Nil(t, err)
+	assert.EqualValues(t, tls.VersionTLS13, policy.maxVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, policy.cipherSuites)
+	assert.True(t, policy.pins["sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="])
+
+	for _, invalid := range []TLSConfig{
+		{MinVersion: "1.4"},
+		{MaxVersion: "TLS1.2"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{CipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{CipherSuites: []string{"TLS_AES_128_GCM_SHA256"}},
+		{Pins: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}},
+		{Pins: []string{"sha256/not-base64"}},
+		{Pins: []string{"sha256/AAAA"}},
+	} {
+		_, err := invalid.policy()
+		assert.NotNil(t, err, "%+v", invalid)
+	}
+}
+
+func TestTLSConfigDefaults(t *testing.T) {
+	global := TLSConfig{MinVersion: "1.3", Pins: []string{"sha256/global"}}
+	client := TLSConfig{Pins: []string{"sha256/client"}}
+	client.setDefaults(global)
+	assert.Equal(t, TLSConfig{MinVersion: "1.3", Pins: []string{"sha256/client"}}, client)
+}
+
+func TestClientPinning(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	pin := spkiPin(server.Certificate())
+
+	cfg := defaultClientConfig()
+	cfg.TLS.Pins = []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", pin}
+	client, err := NewClient(cfg, testCaFile, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{})
+	require.Nil(t, err)
+	_, err = client.SecretList()
+	assert.Nil(t, err)
+
+	// A server whose key isn't pinned is rejected, even though its certificate is trusted.
+	cfg.TLS.Pins = []string{"sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+	client, err = NewClient(cfg, testCaFile, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{})
+	require.Nil(t, err)
+	_, err = client.SecretList()
+	require.NotNil(t, err)
+
+	var mismatch PinMismatch
+	require.True(t, errors.As(err, &mismatch), "%v", err)
+	assert.Equal(t, []string{pin}, mismatch.Pins)
+}
+
+func TestClientTLSVersions(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+	server.TLS.MinVersion = tls.VersionTLS13
+	serverURL, _ := url.Parse(server.URL)
+
+	cfg := defaultClientConfig()
+	cfg.TLS.MaxVersion = "1.2"
+	client, err := NewClient(cfg, testCaFile, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{})
+	require.Nil(t, err)
+	_, err = client.SecretList()
+	assert.NotNil(t, err)
+
+	cfg.TLS = TLSConfig{MinVersion: "1.3"}
+	client, err = NewClient(cfg, testCaFile, serverURL, logrus.NewEntry(logrus.New()), &sqmetrics.SquareMetrics{})
+	require.Nil(t, err)
+	_, err = client.SecretList()
+	assert.Nil(t, err)
+}
@@ -130,7 +130,7 @@ func createNewSyncer(configFile string, server *httptest.Server) (*Syncer, error
 // Reset the given syncer's server URL to point to the given server
 func resetSyncerServer(syncer *Syncer, server *httptest.Server) *Syncer {
 	serverURL, _ := url.Parse(server.URL)
-	syncer.server = serverURL
+	syncer.servers = singleServerPool(serverURL, syncer.metricsHandle)
 	return syncer
 }
 
@@ -0,0 +1,406 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	sqmetrics "github.com/square/go-sq-metrics"
+)
+
+// VaultConfig says where a client's secrets are kept in Vault.
+type VaultConfig struct {
+	Address   string `yaml:"address"`    // Mandatory: Vault's URL, such as https://vault.example.com:8200
+	Mount     string `yaml:"mount"`      // Where the KV version 2 engine is mounted.  Defaults to "secret".
+	Path      string `yaml:"path"`       // The secrets directly under this path are synced
+	AuthMount string `yaml:"auth_mount"` // Where the cert auth method is mounted.  Defaults to "cert".
+	Role      string `yaml:"role"`       // The cert auth role to log in as, if not the one matching the certificate
+	Namespace string `yaml:"namespace"`  // Vault Enterprise namespace, if any
+	Field     string `yaml:"field"`      // The key in each secret's data holding its contents.  Defaults to "content".
+}
+
+func (v *VaultConfig) setDefaults() {
+	if v.Mount == "" {
+		v.Mount = "secret"
+	}
+	if v.AuthMount == "" {
+		v.AuthMount = "cert"
+	}
+	if v.Field == "" {
+		v.Field = "content"
+	}
+}
+
+func (v VaultConfig) validate() error {
+	if v.Address == "" {
+		return errors.New("vault backend needs vault.address")
+	}
+	if _, err := url.Parse(v.Address); err != nil {
+		return fmt.Errorf("bad vault.address '%s': %v", v.Address, err)
+	}
+	return nil
+}
+
+// VaultClient reads secrets from a HashiCorp Vault KV version 2 engine, logging in with the client's certificate
+// through Vault's cert auth method.  Each secret's version is used as its checksum, and its custom metadata may set
+// mode, owner, group and filename.  A value is base64-decoded if the custom metadata has encoding: base64.
+type VaultClient struct {
+	// Vault is reached with a Keywhiz client's TLS settings, retries and backoff.
+	transport *KeywhizHTTPClient
+	config    VaultConfig
+	mapping   SecretMapping
+	logger    *logrus.Entry
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time // Zero if the token doesn't expire
+}
+
+// NewVaultClient returns a client for the Vault server and path in cfg.Vault.
+func NewVaultClient(cfg *ClientConfig, caFile string, logger *logrus.Entry, metricsHandle *sqmetrics.SquareMetrics) (Client, error) {
+	config := cfg.Vault
+	config.setDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	address, err := url.Parse(config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := NewClientWithServers(cfg, caFile, singleServerPool(address, metricsHandle), logger, metricsHandle)
+	if err != nil {
+		return nil, err
+	}
+	return &VaultClient{
+		transport: transport.(*KeywhizHTTPClient),
+		config:    config,
+		mapping:   cfg.SecretMapping,
+		logger:    logger.WithField("logger", "vault_client"),
+	}, nil
+}
+
+// vaultError is returned for an unexpected response from Vault.
+type vaultError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e vaultError) Error() string {
+	return fmt.Sprintf("vault responded %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// login gets a token with the cert auth method, unless the current one is still good.
+func (c *VaultClient) login(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && (c.tokenExpiry.IsZero() || time.Now().Before(c.tokenExpiry)) {
+		return c.token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"name": c.config.Role})
+	if err != nil {
+		return "", err
+	}
+	var login struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	pathname := path.Join("v1/auth", c.config.AuthMount, "login")
+	if err := c.send(ctx, "POST", pathname, "", body, &login); err != nil {
+		return "", fmt.Errorf("logging in to vault: %w", err)
+	}
+	if login.Auth.ClientToken == "" {
+		return "", errors.New("logging in to vault: no token in response")
+	}
+
+	c.token = login.Auth.ClientToken
+	c.tokenExpiry = time.Time{}
+	if login.Auth.LeaseDuration > 0 {
+		// Log in again a little before the token expires, rather than have a request fail.
+		lease := time.Duration(login.Auth.LeaseDuration) * time.Second
+		c.tokenExpiry = time.Now().Add(lease * 9 / 10)
+	}
+	c.logger.WithField("expires", c.tokenExpiry).Debug("Logged in to vault")
+	return c.token, nil
+}
+
+// forgetToken drops a token that Vault has rejected, so the next request logs in again.
+func (c *VaultClient) forgetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+// request makes an authenticated request, decoding the JSON response into result.  A rejected token is replaced once.
+func (c *VaultClient) request(ctx context.Context, method, pathname string, result interface{}) error {
+	for attempt := 0; ; attempt++ {
+		token, err := c.login(ctx)
+		if err != nil {
+			return err
+		}
+		err = c.send(ctx, method, pathname, token, nil, result)
+		var vErr vaultError
+		if attempt == 0 && errors.As(err, &vErr) && vErr.StatusCode == http.StatusForbidden && !c.tokenValid(ctx, token) {
+			// The token was revoked or expired early.
+			c.forgetToken(token)
+			continue
+		}
+		return err
+	}
+}
+
+// tokenValid asks Vault whether a token is still good, as a 403 is also how Vault denies a path the token's policies
+// don't allow.  If Vault can't say, the token is assumed to be good, so a denial isn't retried with a new login.
+func (c *VaultClient) tokenValid(ctx context.Context, token string) bool {
+	var lookup map[string]interface{}
+	err := c.send(ctx, "GET", "v1/auth/token/lookup-self", token, nil, &lookup)
+	var vErr vaultError
+	return !errors.As(err, &vErr) || vErr.StatusCode != http.StatusForbidden
+}
+
+func (c *VaultClient) send(ctx context.Context, method, pathname, token string, body []byte, result interface{}) error {
+	header := http.Header{}
+	if body != nil {
+		header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		header.Set("X-Vault-Token", token)
+	}
+	if c.config.Namespace != "" {
+		header.Set("X-Vault-Namespace", c.config.Namespace)
+	}
+
+	now := time.Now()
+	resp, err := c.transport.requestWithRetry(ctx, method, pathname, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	c.logger.Infof("%s /%s %d %v", method, pathname, resp.StatusCode, time.Since(now))
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errResponse struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(data, &errResponse)
+		return vaultError{StatusCode: resp.StatusCode, Errors: errResponse.Errors}
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("decoding vault response to %s: %v", pathname, err)
+	}
+	return nil
+}
+
+// vaultMetadata is the part of a KV version 2 secret's metadata used to fill in a Secret.
+type vaultMetadata struct {
+	CreatedTime    time.Time         `json:"created_time"`
+	UpdatedTime    time.Time         `json:"updated_time"`
+	CustomMetadata map[string]string `json:"custom_metadata"`
+}
+
+// secret builds a Secret, without contents, from Vault's metadata.
+func (m vaultMetadata) secret(name string, version int64) Secret {
+	secret := Secret{
+		Name:      name,
+		Checksum:  strconv.FormatInt(version, 10),
+		CreatedAt: m.CreatedTime,
+		UpdatedAt: m.UpdatedTime,
+		Mode:      m.CustomMetadata["mode"],
+		Owner:     m.CustomMetadata["owner"],
+		Group:     m.CustomMetadata["group"],
+	}
+	if filename, ok := m.CustomMetadata["filename"]; ok {
+		secret.FilenameOverride = &filename
+	}
+	return secret
+}
+
+// Secret returns the current version of a secret, with its contents.
+func (c *VaultClient) Secret(name string) (*Secret, error) {
+	return c.SecretContext(context.Background(), name)
+}
+
+// SecretContext is Secret, returning early if ctx is done.
+func (c *VaultClient) SecretContext(ctx context.Context, name string) (*Secret, error) {
+	secret, err := c.readSecret(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !c.mapping.apply(secret) {
+		return nil, fmt.Errorf("secret %v is excluded by client config", name)
+	}
+	return secret, nil
+}
+
+func (c *VaultClient) readSecret(ctx context.Context, name string) (*Secret, error) {
+	var response struct {
+		Data struct {
+			Data     map[string]interface{} `json:"data"`
+			Metadata struct {
+				vaultMetadata
+				Version int64 `json:"version"`
+			} `json:"metadata"`
+		} `json:"data"`
+	}
+	err := c.request(ctx, "GET", path.Join("v1", c.config.Mount, "data", c.config.Path, name), &response)
+	var vErr vaultError
+	if errors.As(err, &vErr) {
+		switch vErr.StatusCode {
+		case http.StatusNotFound:
+			// Also returned for a deleted or destroyed current version.
+			c.logger.Warnf("Secret %v not found", name)
+			return nil, SecretDeleted{}
+		case http.StatusForbidden:
+			c.logger.Warnf("Secret %v is forbidden to this client", name)
+			return nil, SecretForbidden{}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := response.Data.Data[c.config.Field].(string)
+	if !ok {
+		return nil, fmt.Errorf("secret %v has no string field %s", name, c.config.Field)
+	}
+	metadata := response.Data.Metadata
+	secret := metadata.secret(name, metadata.Version)
+	secret.Content = content(value)
+	if metadata.CustomMetadata["encoding"] == "base64" {
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("secret %v is not valid base64: %v", name, err)
+		}
+		secret.Content = decoded
+	}
+	secret.Length = uint64(len(secret.Content))
+	return &secret, nil
+}
+
+// SecretList returns the secrets under the configured path, without their contents.
+func (c *VaultClient) SecretList() (map[string]Secret, error) {
+	return c.SecretListContext(context.Background())
+}
+
+// SecretListContext lists the secrets under the configured path, and reads each one's metadata for its current
+// version.  Subdirectories are skipped, and so are secrets whose current version is deleted.
+func (c *VaultClient) SecretListContext(ctx context.Context) (map[string]Secret, error) {
+	var list struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	err := c.request(ctx, "LIST", path.Join("v1", c.config.Mount, "metadata", c.config.Path), &list)
+	if vErr := (vaultError{}); errors.As(err, &vErr) && vErr.StatusCode == http.StatusNotFound {
+		// Vault 404s for an empty path.
+		return map[string]Secret{}, nil
+	} else if err != nil {
+		c.transport.failCountInc()
+		return nil, fmt.Errorf("error listing vault secrets: %w", err)
+	}
+
+	var secrets []Secret
+	for _, key := range list.Data.Keys {
+		if strings.HasSuffix(key, "/") {
+			c.logger.WithField("directory", key).Debug("Skipping vault subdirectory")
+			continue
+		}
+		var response struct {
+			Data struct {
+				vaultMetadata
+				CurrentVersion int64 `json:"current_version"`
+				Versions       map[string]struct {
+					DeletionTime string `json:"deletion_time"`
+					Destroyed    bool   `json:"destroyed"`
+				} `json:"versions"`
+			} `json:"data"`
+		}
+		err := c.request(ctx, "GET", path.Join("v1", c.config.Mount, "metadata", c.config.Path, key), &response)
+		if vErr := (vaultError{}); errors.As(err, &vErr) && vErr.StatusCode == http.StatusNotFound {
+			// Deleted since it was listed.
+			continue
+		} else if err != nil {
+			c.transport.failCountInc()
+			return nil, fmt.Errorf("error reading vault metadata for %s: %w", key, err)
+		}
+		metadata := response.Data
+		current := metadata.Versions[strconv.FormatInt(metadata.CurrentVersion, 10)]
+		if current.DeletionTime != "" || current.Destroyed {
+			continue
+		}
+		secrets = append(secrets, metadata.secret(key, metadata.CurrentVersion))
+	}
+	c.transport.markSuccess()
+	return secretsByFilename(secrets, &c.mapping)
+}
+
+// SecretListWithContents returns the given secrets with their contents, keyed by filename.
+func (c *VaultClient) SecretListWithContents(secrets []string) (map[string]Secret, error) {
+	return c.SecretListWithContentsContext(context.Background(), secrets)
+}
+
+// SecretListWithContentsContext reads each secret in turn, as Vault has no batch API.  Like Keywhiz, it fails if
+// any secret can't be read.
+func (c *VaultClient) SecretListWithContentsContext(ctx context.Context, secrets []string) (map[string]Secret, error) {
+	list, err := readEach(ctx, secrets, c.readSecret)
+	if err != nil {
+		c.transport.failCountInc()
+		return nil, err
+	}
+	c.transport.markSuccess()
+	return secretsByFilename(list, &c.mapping)
+}
+
+// Logger returns the logger for this client.
+func (c *VaultClient) Logger() *logrus.Entry {
+	return c.logger
+}
+
+// RebuildClient picks up a changed client certificate or CA.  The current token is kept until it expires.
+func (c *VaultClient) RebuildClient() error {
+	return c.transport.RebuildClient()
+}
+
+// Close releases anything the client holds open, such as a workload API stream.
+func (c *VaultClient) Close() error {
+	return c.transport.Close()
+}
+
+// certNotAfter returns the expiry of the client certificate currently in use.
+func (c *VaultClient) certNotAfter() time.Time {
+	return c.transport.certNotAfter()
+}
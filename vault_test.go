@@ -0,0 +1,282 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type vaultSecret struct {
+	value    string
+	version  int
+	deleted  bool
+	metadata map[string]string
+}
+
+// vaultStub is a minimal Vault server with a KV version 2 engine at "secret" and cert auth at "cert".
+type vaultStub struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	secrets map[string]*vaultSecret // By path under the mount
+	token   string
+	logins  int
+	denied  map[string]bool
+}
+
+func newVaultStub() *vaultStub {
+	v := &vaultStub{secrets: map[string]*vaultSecret{}, denied: map[string]bool{}}
+	v.Server = httptest.NewUnstartedServer(http.HandlerFunc(v.serve))
+	v.TLS = testCerts(testCaFile)
+	v.TLS.ClientAuth = tls.RequireAnyClientCert
+	v.StartTLS()
+	return v
+}
+
+func (v *vaultStub) serve(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	reply := func(status int, body interface{}) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+	errorReply := func(status int, message string) {
+		reply(status, map[string][]string{"errors": {message}})
+	}
+
+	if r.URL.Path == "/v1/auth/cert/login" {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Method != "POST" || req["name"] != "keysync" || len(r.TLS.PeerCertificates) == 0 {
+			errorReply(http.StatusBadRequest, "bad login")
+			return
+		}
+		v.logins++
+		v.token = fmt.Sprintf("token-%d", v.logins)
+		reply(http.StatusOK, map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": v.token, "lease_duration": 3600},
+		})
+		return
+	}
+	if v.token == "" || r.Header.Get("X-Vault-Token") != v.token {
+		errorReply(http.StatusForbidden, "permission denied")
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v1/auth/token/lookup-self":
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"id": v.token}})
+
+	case r.Method == "LIST" && strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/") + "/"
+		keys := []string{}
+		seen := map[string]bool{}
+		for name := range v.secrets {
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			key := strings.TrimPrefix(name, prefix)
+			if i := strings.Index(key, "/"); i >= 0 {
+				key = key[:i+1]
+			}
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			errorReply(http.StatusNotFound, "")
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"keys": keys}})
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/"):
+		secret, ok := v.secrets[strings.TrimPrefix(r.URL.Path, "/v1/secret/metadata/")]
+		if !ok {
+			errorReply(http.StatusNotFound, "")
+			return
+		}
+		deletionTime := ""
+		if secret.deleted {
+			deletionTime = "2020-01-02T00:00:00Z"
+		}
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"created_time":    "2020-01-01T00:00:00Z",
+			"updated_time":    "2020-01-02T00:00:00Z",
+			"current_version": secret.version,
+			"custom_metadata": secret.metadata,
+			"versions": map[string]interface{}{
+				fmt.Sprint(secret.version): map[string]interface{}{"deletion_time": deletionTime, "destroyed": false},
+			},
+		}})
+
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/v1/secret/data/"):
+		name := strings.TrimPrefix(r.URL.Path, "/v1/secret/data/")
+		secret, ok := v.secrets[name]
+		if v.denied[name] {
+			errorReply(http.StatusForbidden, "permission denied")
+			return
+		}
+		if !ok || secret.deleted {
+			errorReply(http.StatusNotFound, "")
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"data": map[string]string{"content": secret.value},
+			"metadata": map[string]interface{}{
+				"created_time":    "2020-01-01T00:00:00Z",
+				"custom_metadata": secret.metadata,
+				"version":         secret.version,
+			},
+		}})
+
+	default:
+		errorReply(http.StatusNotFound, "")
+	}
+}
+
+func newVaultClientForTest(t *testing.T, stub *vaultStub) *VaultClient {
+	cfg := defaultClientConfig()
+	cfg.Backend = BackendVault
+	cfg.Vault = VaultConfig{Address: stub.URL, Path: "app", Role: "keysync"}
+	client, err := NewVaultClient(cfg, testCaFile, logrus.NewEntry(logrus.New()), metricsForTest())
+	require.Nil(t, err)
+	return client.(*VaultClient)
+}
+
+func TestVaultClientListsAndReadsSecrets(t *testing.T) {
+	stub := newVaultStub()
+	defer stub.Close()
+	stub.secrets["app/db_password"] = &vaultSecret{value: "hunter2", version: 3, metadata: map[string]string{"mode": "0440", "owner": "nobody", "group": "nogroup"}}
+	stub.secrets["app/api_key"] = &vaultSecret{value: base64.StdEncoding.EncodeToString([]byte("k3y\x00")), version: 1, metadata: map[string]string{"filename": "api.key", "encoding": "base64"}}
+	stub.secrets["app/old"] = &vaultSecret{value: "gone", version: 2, deleted: true}
+	stub.secrets["app/nested/ignored"] = &vaultSecret{value: "x", version: 1}
+	stub.secrets["other/secret"] = &vaultSecret{value: "x", version: 1}
+
+	client := newVaultClientForTest(t, stub)
+	secrets, err := client.SecretList()
+	require.Nil(t, err)
+	require.Len(t, secrets, 2)
+	assert.Equal(t, "3", secrets["db_password"].Checksum)
+	assert.Equal(t, "0440", secrets["db_password"].Mode)
+	assert.Equal(t, "nobody", secrets["db_password"].Owner)
+	assert.Equal(t, "nogroup", secrets["db_password"].Group)
+	assert.Equal(t, "api_key", secrets["api.key"].Name)
+	assert.Empty(t, secrets["api.key"].Content)
+
+	secret, err := client.Secret("db_password")
+	require.Nil(t, err)
+	assert.EqualValues(t, "hunter2", secret.Content)
+	assert.EqualValues(t, 7, secret.Length)
+	assert.Equal(t, "3", secret.Checksum)
+
+	withContents, err := client.SecretListWithContents([]string{"db_password", "api_key"})
+	require.Nil(t, err)
+	assert.EqualValues(t, "k3y\x00", withContents["api.key"].Content)
+	assert.Equal(t, 1, stub.logins)
+
+	_, err = client.Secret("old")
+	assert.Equal(t, SecretDeleted{}, err)
+	stub.denied["app/db_password"] = true
+	_, err = client.Secret("db_password")
+	assert.Equal(t, SecretForbidden{}, err)
+	_, err = client.SecretListWithContents([]string{"db_password", "api_key"})
+	assert.Equal(t, BatchError{StatusCode: http.StatusForbidden, Message: "secret db_password is forbidden"}, err)
+	assert.Equal(t, 1, stub.logins, "A denied path doesn't mean the token is bad")
+}
+
+func TestVaultClientLogsInAgain(t *testing.T) {
+	stub := newVaultStub()
+	defer stub.Close()
+	stub.secrets["app/db_password"] = &vaultSecret{value: "hunter2", version: 1}
+
+	client := newVaultClientForTest(t, stub)
+	_, err := client.Secret("db_password")
+	require.Nil(t, err)
+
+	// The token is revoked, so the client logs in for a new one.
+	stub.mu.Lock()
+	stub.token = "revoked"
+	stub.mu.Unlock()
+	_, err = client.Secret("db_password")
+	require.Nil(t, err)
+	assert.Equal(t, 2, stub.logins)
+}
+
+func TestVaultClientSyncs(t *testing.T) {
+	stub := newVaultStub()
+	defer stub.Close()
+	stub.secrets["app/db_password"] = &vaultSecret{value: "hunter2", version: 1}
+	stub.secrets["app/api_key"] = &vaultSecret{value: "k3y", version: 1}
+
+	client := newVaultClientForTest(t, stub)
+	output := &InMemoryOutput{Secrets: map[string]Secret{}, logger: logrus.NewEntry(logrus.New())}
+	entry := &syncerEntry{client, ClientConfig{}, output, map[string]secretState{}}
+	updated, err := entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Added: 2}, updated)
+	assert.EqualValues(t, "hunter2", output.Secrets["db_password"].Content)
+
+	// A deleted secret is removed on the next sync.
+	stub.secrets["app/api_key"].deleted = true
+	updated, err = entry.Sync()
+	require.Nil(t, err)
+	assert.Equal(t, Updated{Deleted: 1}, updated)
+	assert.NotContains(t, output.Secrets, "api_key")
+}
+
+func TestVaultConfigValidation(t *testing.T) {
+	cfg := &Config{SecretsDir: "/tmp/keysync-secrets"}
+	client := ClientConfig{Key: clientKey, Backend: BackendVault}
+	assert.EqualError(t, client.validate(cfg), "vault backend needs vault.address")
+
+	client.Vault.Address = "https://vault.example.com:8200"
+	assert.Nil(t, client.validate(cfg))
+
+	client.Backend = "consul"
+	assert.EqualError(t, client.validate(cfg), "unknown backend 'consul'")
+}
+
+func TestSyncerBuildsVaultClient(t *testing.T) {
+	server := createDefaultServer()
+	defer server.Close()
+	stub := newVaultStub()
+	defer stub.Close()
+
+	syncer, err := createNewSyncer("fixtures/configs/test-config.yaml", server)
+	require.Nil(t, err)
+
+	cfg := defaultClientConfig()
+	cfg.Backend = BackendVault
+	cfg.Vault = VaultConfig{Address: stub.URL, Path: "app", Role: "keysync"}
+	entry, err := syncer.buildClient("vaulted", *cfg, metricsForTest())
+	require.Nil(t, err)
+	assert.IsType(t, &VaultClient{}, entry.Client)
+	_, ok := syncer.certExpiry.Load("vaulted")
+	assert.True(t, ok)
+}
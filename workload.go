@@ -0,0 +1,192 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spiffe/go-spiffe/v2/svid/x509svid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// WorkloadAPIConfig gets a client's certificate and CA bundle from a SPIFFE Workload API, instead of key and cert
+// files.  The certificate and bundle are kept up to date as the Workload API rotates them.
+type WorkloadAPIConfig struct {
+	Socket   string `yaml:"socket"`    // Mandatory: The Workload API's Unix socket, as a path or unix:///path
+	SpiffeID string `yaml:"spiffe_id"` // Optional: Which SVID to use, if the workload has several.  Defaults to the first.
+}
+
+func (cfg WorkloadAPIConfig) validate(c *ClientConfig) error {
+	if c.Key != "" || c.Cert != "" {
+		return errors.New("workload_api.socket can't be used with key or cert")
+	}
+	if cfg.SpiffeID != "" && !strings.HasPrefix(cfg.SpiffeID, "spiffe://") {
+		return fmt.Errorf("workload_api.spiffe_id must start with spiffe://: '%s'", cfg.SpiffeID)
+	}
+	return nil
+}
+
+// workloadSource holds the latest SVID and bundle from the Workload API.  It's used as both the client
+// certificate and the CA pool of a KeywhizHTTPClient.  The certificate is used for the next handshake as soon as
+// it's rotated; a rotated bundle is used from the next RebuildClient, as a changed ca_file is.
+type workloadSource struct {
+	spiffeID string
+	logger   *logrus.Entry
+	ctx      context.Context
+	cancel   func()
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	lastErr error
+	ready   chan struct{} // Closed once there's a certificate
+}
+
+// newWorkloadSource starts watching the Workload API, and waits up to timeout for the first SVID.  The Workload API
+// client reconnects with backoff if its stream ends.
+func newWorkloadSource(cfg WorkloadAPIConfig, timeout time.Duration, logger *logrus.Entry) (*workloadSource, error) {
+	addr := cfg.Socket
+	if !strings.HasPrefix(addr, "unix://") {
+		socket, err := filepath.Abs(addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = "unix://" + socket
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := workloadapi.New(ctx, workloadapi.WithAddr(addr))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("workload API at %s: %v", cfg.Socket, err)
+	}
+	w := &workloadSource{
+		spiffeID: cfg.SpiffeID,
+		logger:   logger.WithField("socket", cfg.Socket),
+		ctx:      ctx,
+		ready:    make(chan struct{}),
+	}
+	w.cancel = func() {
+		cancel()
+		client.Close()
+	}
+	go client.WatchX509Context(ctx, w)
+
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	select {
+	case <-w.ready:
+		return w, nil
+	case <-time.After(timeout):
+		w.cancel()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return nil, fmt.Errorf("no SVID from workload API at %s after %v: %v", cfg.Socket, timeout, w.lastErr)
+	}
+}
+
+// OnX509ContextUpdate applies an update from the Workload API.  A bad update is logged, and the previous SVID kept.
+func (w *workloadSource) OnX509ContextUpdate(update *workloadapi.X509Context) {
+	if err := w.update(update); err != nil {
+		w.mu.Lock()
+		w.lastErr = err
+		w.mu.Unlock()
+		w.logger.WithError(err).Error("Bad update from workload API")
+	}
+}
+
+// OnX509ContextWatchError records why the Workload API stream failed.  It's reconnected with backoff.
+func (w *workloadSource) OnX509ContextWatchError(err error) {
+	if w.ctx.Err() != nil {
+		return
+	}
+	w.mu.Lock()
+	w.lastErr = err
+	w.mu.Unlock()
+	w.logger.WithError(err).Warn("Workload API stream failed, reconnecting")
+}
+
+// update uses the configured SVID from an update, and the trust bundle for its trust domain.
+func (w *workloadSource) update(update *workloadapi.X509Context) error {
+	var svid *x509svid.SVID
+	for _, candidate := range update.SVIDs {
+		if w.spiffeID == "" || candidate.ID.String() == w.spiffeID {
+			svid = candidate
+			break
+		}
+	}
+	if svid == nil {
+		return fmt.Errorf("no SVID for %s in %d from workload API", w.spiffeID, len(update.SVIDs))
+	}
+	bundle, err := update.Bundles.GetX509BundleForTrustDomain(svid.ID.TrustDomain())
+	if err != nil {
+		return fmt.Errorf("no bundle for %s: %v", svid.ID, err)
+	}
+
+	cert := &tls.Certificate{PrivateKey: svid.PrivateKey, Leaf: svid.Certificates[0]}
+	for _, c := range svid.Certificates {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	pool := x509.NewCertPool()
+	for _, c := range bundle.X509Authorities() {
+		pool.AddCert(c)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	first := w.cert == nil
+	w.cert, w.pool, w.lastErr = cert, pool, nil
+	w.logger.WithFields(logrus.Fields{"spiffe_id": svid.ID.String(), "not_after": cert.Leaf.NotAfter}).Info("Received SVID from workload API")
+	if first {
+		close(w.ready)
+	}
+	return nil
+}
+
+// GetClientCertificate is used as the tls.Config callback, so a rotated SVID is used for the next handshake.
+func (w *workloadSource) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cert, nil
+}
+
+// NotAfter returns the expiry of the SVID in use.
+func (w *workloadSource) NotAfter() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cert.Leaf.NotAfter
+}
+
+// Pool returns the latest trust bundle.
+func (w *workloadSource) Pool() (*x509.CertPool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pool, nil
+}
+
+// Close stops watching the Workload API.
+func (w *workloadSource) Close() error {
+	w.cancel()
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2017 Square Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keysync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/square/keysync/keywhiztest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// workloadAPIStandIn is a local stand-in for a SPIFFE Workload API, served by gRPC.  It sends an X509SVIDResponse
+// when a FetchX509SVID stream opens, and another for each rotation.
+type workloadAPIStandIn struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+	socket    string
+	responses chan *workload.X509SVIDResponse
+	initial   *workload.X509SVIDResponse
+}
+
+func newWorkloadAPIStandIn(t *testing.T, initial *workload.X509SVIDResponse) *workloadAPIStandIn {
+	dir, err := ioutil.TempDir("", "keysync-workload")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	s := &workloadAPIStandIn{socket: filepath.Join(dir, "agent.sock"), responses: make(chan *workload.X509SVIDResponse), initial: initial}
+	listener, err := net.Listen("unix", s.socket)
+	require.Nil(t, err)
+	server := grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(server, s)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return s
+}
+
+func (s *workloadAPIStandIn) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if len(md.Get("workload.spiffe.io")) != 1 || md.Get("workload.spiffe.io")[0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	if err := stream.Send(s.initial); err != nil {
+		return err
+	}
+	for {
+		select {
+		case response := <-s.responses:
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// testSVIDIssuer signs SVIDs for tests, and is trusted by a fake Keywhiz for client certificates.
+type testSVIDIssuer struct {
+	*keywhiztest.CA
+	caFile string
+}
+
+func newTestSVIDIssuer(t *testing.T) *testSVIDIssuer {
+	ca, err := keywhiztest.NewCA("Test SVID CA")
+	require.Nil(t, err)
+	file, err := ioutil.TempFile("", "keysync-svid-ca")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.Remove(file.Name()) })
+	_, err = file.Write(ca.CertPEM())
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+	return &testSVIDIssuer{CA: ca, caFile: file.Name()}
+}
+
+// svid returns an X509SVID named by commonName, with the test server's certificate as its bundle.
+func (issuer *testSVIDIssuer) svid(t *testing.T, spiffeID, commonName string) *workload.X509SVID {
+	id, err := url.Parse(spiffeID)
+	require.Nil(t, err)
+	cert, err := issuer.Issue(&x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		URIs:         []*url.URL{id},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	require.Nil(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.Nil(t, err)
+	bundle, err := tls.LoadX509KeyPair(testCaFile, testCaFile)
+	require.Nil(t, err)
+	return &workload.X509SVID{SpiffeId: spiffeID, X509Svid: cert.Certificate[0], X509SvidKey: pkcs8, Bundle: bundle.Certificate[0]}
+}
+
+func TestWorkloadAPIClient(t *testing.T) {
+	issuer := newTestSVIDIssuer(t)
+	standIn := newWorkloadAPIStandIn(t, &workload.X509SVIDResponse{
+		Svids: []*workload.X509SVID{issuer.svid(t, "spiffe://example.org/client1", "client1")},
+	})
+
+	tlsConfig, err := keywhiztest.TLSConfig(testCaFile, testCaFile, issuer.caFile)
+	require.Nil(t, err)
+	fake := keywhiztest.New(keywhiztest.Secret{Name: "one", Content: []byte("first")})
+	server := fake.StartTLS(tlsConfig)
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	require.Nil(t, err)
+
+	clientConfig := &ClientConfig{
+		WorkloadAPI: WorkloadAPIConfig{Socket: "unix://" + standIn.socket},
+		MaxRetries:  1,
+		Timeout:     "5s",
+		MinBackoff:  "1ms",
+		MaxBackoff:  "10ms",
+	}
+	// No CA file: the server is trusted through the bundle from the workload API.
+	client, err := NewClient(clientConfig, "", serverURL, testLogger(), metricsForTest())
+	require.Nil(t, err)
+	defer client.(io.Closer).Close()
+
+	_, err = client.SecretList()
+	require.Nil(t, err)
+	assert.Equal(t, "client1", fake.Requests()[0].Client)
+
+	// A rotated SVID is used for new connections.
+	standIn.responses <- &workload.X509SVIDResponse{
+		Svids: []*workload.X509SVID{issuer.svid(t, "spiffe://example.org/client1", "client2")},
+	}
+	source := client.(*KeywhizHTTPClient).params.keyPair.(*workloadSource)
+	assert.Eventually(t, func() bool {
+		cert, _ := source.GetClientCertificate(nil)
+		return cert.Leaf.Subject.CommonName == "client2"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Nil(t, client.RebuildClient())
+	_, err = client.SecretList()
+	require.Nil(t, err)
+	assert.Equal(t, "client2", fake.Requests()[1].Client)
+}
+
+func TestWorkloadAPISpiffeID(t *testing.T) {
+	issuer := newTestSVIDIssuer(t)
+	standIn := newWorkloadAPIStandIn(t, &workload.X509SVIDResponse{Svids: []*workload.X509SVID{
+		issuer.svid(t, "spiffe://example.org/client1", "client1"),
+		issuer.svid(t, "spiffe://example.org/client3", "client3"),
+	}})
+
+	source, err := newWorkloadSource(WorkloadAPIConfig{Socket: standIn.socket, SpiffeID: "spiffe://example.org/client3"}, 5*time.Second, testLogger())
+	require.Nil(t, err)
+	defer source.Close()
+	cert, err := source.GetClientCertificate(nil)
+	require.Nil(t, err)
+	assert.Equal(t, "client3", cert.Leaf.Subject.CommonName)
+	assert.Equal(t, cert.Leaf.NotAfter, source.NotAfter())
+
+	// Without the requested SVID, the client never becomes ready.
+	_, err = newWorkloadSource(WorkloadAPIConfig{Socket: standIn.socket, SpiffeID: "spiffe://example.org/other"}, 200*time.Millisecond, testLogger())
+	assert.NotNil(t, err)
+	_, err = newWorkloadSource(WorkloadAPIConfig{Socket: standIn.socket + ".missing"}, 200*time.Millisecond, testLogger())
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "no SVID from workload API")
+}
+
+func TestWorkloadAPIConfigValidation(t *testing.T) {
+	cfg := &Config{SecretsDir: "/tmp/keysync-secrets"}
+	client := ClientConfig{WorkloadAPI: WorkloadAPIConfig{Socket: "unix:///run/spire/agent.sock"}}
+	assert.Nil(t, client.validate(cfg), "No key needed")
+	client.Key = "client.key"
+	assert.EqualError(t, client.validate(cfg), "workload_api.socket can't be used with key or cert")
+	client.Key = ""
+	client.WorkloadAPI.SpiffeID = "example.org/client"
+	assert.EqualError(t, client.validate(cfg), "workload_api.spiffe_id must start with spiffe://: 'example.org/client'")
+}
+
+func TestWorkloadAPIClientsClose(t *testing.T) {
+	issuer := newTestSVIDIssuer(t)
+	standIn := newWorkloadAPIStandIn(t, &workload.X509SVIDResponse{
+		Svids: []*workload.X509SVID{issuer.svid(t, "spiffe://example.org/client1", "client1")},
+	})
+
+	newConfig := func(backend string) *ClientConfig {
+		cfg := defaultClientConfig()
+		cfg.Key, cfg.Cert = "", ""
+		cfg.WorkloadAPI = WorkloadAPIConfig{Socket: standIn.socket}
+		cfg.Backend = backend
+		cfg.Vault = VaultConfig{Address: "https://vault.example.com", Path: "app"}
+		cfg.HTTP = jsonStubConfig("https://secrets.example.com")
+		return cfg
+	}
+	vault, err := NewVaultClient(newConfig(BackendVault), "", testLogger(), metricsForTest())
+	require.Nil(t, err)
+	httpJSON, err := NewHTTPJSONClient(newConfig(BackendHTTP), "", testLogger(), metricsForTest())
+	require.Nil(t, err)
+
+	// Closing the client stops its workload API stream.
+	for _, client := range []Client{vault, httpJSON} {
+		closer, ok := client.(io.Closer)
+		require.True(t, ok, "%T", client)
+		require.Nil(t, closer.Close())
+	}
+	for _, transport := range []*KeywhizHTTPClient{vault.(*VaultClient).transport, httpJSON.(*HTTPJSONClient).transport} {
+		assert.NotNil(t, transport.params.keyPair.(*workloadSource).ctx.Err())
+	}
+}
@@ -21,6 +21,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/square/keysync/output"
 	"github.com/square/keysync/ownership"
@@ -57,27 +60,67 @@ type OutputDirCollection struct {
 }
 
 func (c OutputDirCollection) NewOutput(clientConfig ClientConfig, logger *logrus.Entry) (Output, error) {
+	writeDirectory := filepath.Join(c.Config.SecretsDir, clientConfig.DirName)
+	primary, err := c.newOutputDir(writeDirectory, clientConfig.User, clientConfig.Group, c.Config.FsType, logger)
+	if len(clientConfig.Mirrors) == 0 {
+		if err != nil {
+			return nil, err
+		}
+		return primary, nil
+	}
+
+	// With mirrors, one broken target doesn't stop the others being written.
+	multi := &MultiOutput{Logger: logger}
+	if err != nil {
+		logger.WithError(err).Warn("Failed setting up output")
+	}
+	multi.Targets = append(multi.Targets, primary)
+	for _, mirror := range clientConfig.Mirrors {
+		user, group, fsType := clientConfig.User, clientConfig.Group, c.Config.FsType
+		if mirror.User != "" {
+			user = mirror.User
+		}
+		if mirror.Group != "" {
+			group = mirror.Group
+		}
+		if mirror.FsType != 0 {
+			fsType = mirror.FsType
+		}
+		mirrorLogger := logger.WithField("mirror", mirror.Directory)
+		out, err := c.newOutputDir(mirror.Directory, user, group, fsType, mirrorLogger)
+		if err != nil {
+			mirrorLogger.WithError(err).Warn("Failed setting up mirror")
+		}
+		// Mirror directories are the operator's, and may hold other files.
+		out.Manifest = mirrorManifest
+		multi.Targets = append(multi.Targets, out)
+	}
+	return multi, nil
+}
+
+// newOutputDir returns an OutputDir writing to directory.  If the directory can't be created, it returns
+// an error along with the OutputDir, as later writes will retry creating it.
+func (c OutputDirCollection) newOutputDir(directory, user, group string, fsType output.Filesystem, logger *logrus.Entry) (*OutputDir, error) {
 	defaultOwnership := ownership.NewOwnership(
-		clientConfig.User,
-		clientConfig.Group,
+		user,
+		group,
 		c.Config.DefaultUser,
 		c.Config.DefaultGroup,
 		ownership.Os{},
 		logger,
 	)
 
-	writeDirectory := filepath.Join(c.Config.SecretsDir, clientConfig.DirName)
-	if err := os.MkdirAll(writeDirectory, 0775); err != nil {
-		return nil, fmt.Errorf("failed to mkdir client directory '%s': %v", writeDirectory, err)
-	}
-
-	return &OutputDir{
-		WriteDirectory:    writeDirectory,
-		EnforceFilesystem: c.Config.FsType,
+	out := &OutputDir{
+		WriteDirectory:    directory,
+		EnforceFilesystem: fsType,
 		ChownFiles:        c.Config.ChownFiles,
 		DefaultOwnership:  defaultOwnership,
 		Logger:            logger,
-	}, nil
+	}
+	if err := os.MkdirAll(directory, 0775); err != nil {
+		return out, fmt.Errorf("failed to mkdir client directory '%s': %v", directory, err)
+	}
+	return out, nil
 }
 
 func (c OutputDirCollection) Cleanup(known map[string]struct{}, logger *logrus.Entry) (uint, []error) {
@@ -118,6 +161,11 @@ type OutputDir struct {
 	EnforceFilesystem output.Filesystem // What filesystem type do we expect to write to?
 	ChownFiles        bool              // Do we chown the file? (Needs root or CAP_CHOWN).
 	Logger            *logrus.Entry
+	// Manifest, if set, is a file in WriteDirectory listing every file written there.  Cleanup and RemoveAll then
+	// only remove listed files, and never the directory itself.
+	Manifest string
+
+	manifestMu sync.Mutex
 }
 
 // Validate verifies the secret is written to disk with the correct content, permissions, and ownership
@@ -137,6 +185,21 @@ func (out *OutputDir) Validate(secret *Secret, state secretState) bool {
 		return false
 	}
 
+	// Check the aliases are still what's configured, and still point at the secret
+	if !equalStrings(state.Aliases, secret.Aliases) || !equalStrings(state.ACL, secret.ACL) {
+		return false
+	}
+	for _, alias := range secret.Aliases {
+		target, err := os.Readlink(filepath.Join(out.WriteDirectory, alias))
+		if err != nil || target != filename {
+			out.Logger.WithFields(logrus.Fields{
+				"secret": filename,
+				"alias":  alias,
+			}).Warn("Secret alias changed unexpectedly")
+			return false
+		}
+	}
+
 	// Check on-disk permissions, and ownership against what's configured.
 	f, err := os.Open(path)
 	if err != nil {
@@ -174,11 +237,46 @@ func (out *OutputDir) Validate(secret *Secret, state secretState) bool {
 
 }
 
+// Remove deletes a secret, along with any aliases pointing at it.
 func (out *OutputDir) Remove(name string) error {
-	return os.Remove(filepath.Join(out.WriteDirectory, name))
+	fileInfos, err := ioutil.ReadDir(out.WriteDirectory)
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		path := filepath.Join(out.WriteDirectory, fileInfo.Name())
+		if target, err := os.Readlink(path); err == nil && target == name {
+			if err := os.Remove(path); err != nil {
+				out.Logger.WithError(err).WithField("alias", fileInfo.Name()).Warn("Unable to delete alias")
+			}
+		}
+	}
+	if err := os.Remove(filepath.Join(out.WriteDirectory, name)); err != nil {
+		return err
+	}
+	return out.updateManifest(func(files map[string]struct{}) {
+		for file := range files {
+			if file == name {
+				delete(files, file)
+			} else if _, err := os.Lstat(filepath.Join(out.WriteDirectory, file)); os.IsNotExist(err) {
+				// An alias removed above.
+				delete(files, file)
+			}
+		}
+	})
 }
 
 func (out *OutputDir) RemoveAll() (uint, error) {
+	if out.Manifest != "" {
+		deleted, err := out.removeListed(map[string]struct{}{})
+		if err != nil {
+			return deleted, err
+		}
+		return deleted, os.Remove(filepath.Join(out.WriteDirectory, out.Manifest))
+	}
 	// TODO: This count isn't accurate, but it also isn't worth reimplementing os.RemoveAll to count
 	return 1, os.RemoveAll(out.WriteDirectory)
 }
@@ -186,13 +284,24 @@ func (out *OutputDir) RemoveAll() (uint, error) {
 func (out *OutputDir) Cleanup(secrets map[string]Secret) (uint, error) {
 	var deleted uint
 
+	known := map[string]struct{}{}
+	for filename, secret := range secrets {
+		known[filename] = struct{}{}
+		for _, alias := range secret.Aliases {
+			known[alias] = struct{}{}
+		}
+	}
+	if out.Manifest != "" {
+		return out.removeListed(known)
+	}
+
 	fileInfos, err := ioutil.ReadDir(out.WriteDirectory)
 	if err != nil {
 		return deleted, fmt.Errorf("couldn't read directory: %s", out.WriteDirectory)
 	}
 	for _, fileInfo := range fileInfos {
 		existingFile := fileInfo.Name()
-		if _, present := secrets[existingFile]; !present {
+		if _, present := known[existingFile]; !present {
 			// This file wasn't written in the loop above, so we remove it.
 			out.Logger.WithField("file", existingFile).Info("Removing unknown file")
 			err := os.Remove(filepath.Join(out.WriteDirectory, existingFile))
@@ -219,18 +328,46 @@ func (out *OutputDir) Write(secret *Secret) (*secretState, error) {
 	if err != nil {
 		return nil, err
 	}
-	fileInfo := output.FileInfo{Mode: mode}
+	acl, err := resolveACL(secret.ACL, out.DefaultOwnership.Lookup)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo := output.FileInfo{Mode: mode, ACL: acl.String()}
 	if out.ChownFiles {
 		owner := secret.OwnershipValue(out.DefaultOwnership)
 		fileInfo.UID = owner.UID
 		fileInfo.GID = owner.GID
 	}
+	if out.Manifest != "" {
+		files := append([]string{filename}, secret.Aliases...)
+		for _, file := range files {
+			if file == out.Manifest {
+				return nil, fmt.Errorf("secret %s would overwrite %s", secret.Name, out.Manifest)
+			}
+		}
+		// Listed before they're written, so they're cleaned up even if keysync stops halfway.
+		err := out.updateManifest(func(listed map[string]struct{}) {
+			for _, file := range files {
+				listed[file] = struct{}{}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
 	path := filepath.Join(out.WriteDirectory, filename)
 	fileinfo, err := output.WriteFileAtomically(path, out.ChownFiles, fileInfo, out.EnforceFilesystem, secret.Content)
 	if err != nil {
 		return nil, err
 	}
 
+	// Links are relative, so they keep working if the secrets directory is bind-mounted elsewhere
+	for _, alias := range secret.Aliases {
+		if err := output.SymlinkAtomically(filename, filepath.Join(out.WriteDirectory, alias)); err != nil {
+			return nil, fmt.Errorf("failed to link alias %s: %v", alias, err)
+		}
+	}
+
 	state := secretState{
 		ContentHash: sha256.Sum256(secret.Content),
 		Checksum:    secret.Checksum,
@@ -238,6 +375,109 @@ func (out *OutputDir) Write(secret *Secret) (*secretState, error) {
 		Owner:       secret.Owner,
 		Group:       secret.Group,
 		Mode:        secret.Mode,
+		Aliases:     secret.Aliases,
+		ACL:         secret.ACL,
 	}
 	return &state, err
 }
+
+// equalStrings returns true if both slices have the same contents, in the same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// updateManifest changes the set of files listed in the manifest.  It does nothing without a manifest.
+func (out *OutputDir) updateManifest(update func(files map[string]struct{})) error {
+	if out.Manifest == "" {
+		return nil
+	}
+	out.manifestMu.Lock()
+	defer out.manifestMu.Unlock()
+	files, err := out.readManifest()
+	if err != nil {
+		return err
+	}
+	update(files)
+	return out.writeManifest(files)
+}
+
+// removeListed removes the files in the manifest that aren't known, returning how many were removed.
+func (out *OutputDir) removeListed(known map[string]struct{}) (uint, error) {
+	out.manifestMu.Lock()
+	defer out.manifestMu.Unlock()
+	files, err := out.readManifest()
+	if err != nil {
+		return 0, err
+	}
+	var deleted uint
+	for file := range files {
+		if _, present := known[file]; present {
+			continue
+		}
+		out.Logger.WithField("file", file).Info("Removing unknown file")
+		err := os.Remove(filepath.Join(out.WriteDirectory, file))
+		if err != nil && !os.IsNotExist(err) {
+			// Not fatal, so log and continue.  It's kept in the manifest, to try again next time.
+			out.Logger.WithError(err).Warnf("Unable to delete file")
+			continue
+		}
+		if err == nil {
+			deleted++
+		}
+		delete(files, file)
+	}
+	return deleted, out.writeManifest(files)
+}
+
+// readManifest returns the files listed in the manifest, which is empty if it doesn't exist yet.  The caller must
+// hold manifestMu.
+func (out *OutputDir) readManifest() (map[string]struct{}, error) {
+	files := map[string]struct{}{}
+	data, err := ioutil.ReadFile(filepath.Join(out.WriteDirectory, out.Manifest))
+	if os.IsNotExist(err) {
+		return files, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading manifest: %v", err)
+	}
+	for _, file := range strings.Split(string(data), "\n") {
+		// Anything that could refer outside the directory wasn't written by keysync.
+		if validFilename(file) && file != out.Manifest {
+			files[file] = struct{}{}
+		}
+	}
+	return files, nil
+}
+
+// writeManifest atomically replaces the manifest.  The caller must hold manifestMu.
+func (out *OutputDir) writeManifest(files map[string]struct{}) error {
+	var lines []string
+	for file := range files {
+		lines = append(lines, file+"\n")
+	}
+	sort.Strings(lines)
+
+	f, err := ioutil.TempFile(out.WriteDirectory, out.Manifest)
+	if err != nil {
+		return fmt.Errorf("writing manifest: %v", err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strings.Join(lines, ""))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(out.WriteDirectory, out.Manifest))
+	}
+	if err != nil {
+		return fmt.Errorf("writing manifest: %v", err)
+	}
+	return nil
+}
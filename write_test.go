@@ -182,3 +182,46 @@ func TestCustomFilenameAsFilepath(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, state)
 }
+
+// TestAliases makes sure aliases are symlinked to the secret, validated, and cleaned up.
+func TestAliases(t *testing.T) {
+	c, cc, _, out := testFixture(t)
+	defer os.RemoveAll(c.SecretsDir)
+
+	secret := testSecret("secret_name")
+	secret.Aliases = []string{"alias"}
+
+	state, err := out.Write(&secret)
+	assert.NoError(t, err)
+
+	aliasPath := filepath.Join(c.SecretsDir, cc.DirName, "alias")
+	filecontents, err := ioutil.ReadFile(aliasPath)
+	assert.NoError(t, err)
+	assert.Equal(t, secret.Content, content(filecontents))
+
+	deleted, err := out.Cleanup(map[string]Secret{"secret_name": secret})
+	assert.NoError(t, err)
+	assert.Zero(t, deleted)
+	assert.True(t, out.Validate(&secret, *state), "Expected aliased secret to be valid after cleanup")
+
+	// Pointing the alias somewhere else invalidates the secret
+	assert.NoError(t, os.Remove(aliasPath))
+	assert.NoError(t, os.Symlink("elsewhere", aliasPath))
+	assert.False(t, out.Validate(&secret, *state), "Expected secret with tampered alias to be invalid")
+
+	// Removing the alias from config invalidates the secret, and cleanup removes the link
+	state, err = out.Write(&secret)
+	assert.NoError(t, err)
+	unaliased := testSecret("secret_name")
+	assert.False(t, out.Validate(&unaliased, *state), "Expected secret with changed aliases to be invalid")
+	deleted, err = out.Cleanup(map[string]Secret{"secret_name": unaliased})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, deleted)
+
+	// Removing the secret removes its aliases too
+	_, err = out.Write(&secret)
+	assert.NoError(t, err)
+	assert.NoError(t, out.Remove("secret_name"))
+	_, err = os.Lstat(aliasPath)
+	assert.True(t, os.IsNotExist(err), "Expected alias to be removed with secret")
+}